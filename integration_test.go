@@ -0,0 +1,1176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/music-coordinator/music-coordinator/internal/testutil"
+)
+
+// testServer is a Coordinator with fixtures loaded, behind a real HTTP server
+type testServer struct {
+	*httptest.Server
+	c *Coordinator
+}
+
+// newTestServer starts a server for black-box tests of the API. Its database
+// holds the fixtures from loadFixtures.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	c := newTestCoordinator(t)
+	loadFixtures(t, c.db)
+	s := &testServer{Server: httptest.NewServer(c.Handler()), c: c}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// loadFixtures adds two intents, one playing from a group, and two locations
+func loadFixtures(t *testing.T, db *Database) {
+	t.Helper()
+	if err := db.CreatePlaylistGroup("focus", []string{"spotify:playlist:focus1", "spotify:playlist:focus2"}, nil, nil); err != nil {
+		t.Fatalf("CreatePlaylistGroup: %v", err)
+	}
+	if err := db.CreateIntent("morning", []string{"spotify:playlist:morning"}, "", IntentSettings{}); err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+	if err := db.CreateIntent("work", nil, "focus", IntentSettings{}); err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+	for name, speaker := range map[string]string{"kitchen": "media_player.kitchen", "office": "media_player.office"} {
+		if err := db.CreateLocation(name, speaker, "", ""); err != nil {
+			t.Fatalf("CreateLocation: %v", err)
+		}
+	}
+}
+
+// do sends body as JSON (when non-nil) and returns the status and response body
+func (s *testServer) do(t *testing.T, method, path string, body interface{}) (int, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = strings.NewReader(string(data))
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return resp.StatusCode, data
+}
+
+// expect fails the test unless the request returns want, and returns the body
+func (s *testServer) expect(t *testing.T, want int, method, path string, body interface{}) []byte {
+	t.Helper()
+	status, data := s.do(t, method, path, body)
+	if status != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, status, want, data)
+	}
+	return data
+}
+
+func TestIntentLifecycle(t *testing.T) {
+	s := newTestServer(t)
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents", Intent{Name: "evening", Playlists: []string{"spotify:playlist:evening"}})
+
+	var intent Intent
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents/evening", nil), &intent); err != nil {
+		t.Fatalf("decode intent: %v", err)
+	}
+	if intent.Name != "evening" || !slices.Equal(intent.Playlists, []string{"spotify:playlist:evening"}) {
+		t.Errorf("GET intent = %+v", intent)
+	}
+
+	var intents []Intent
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents", nil), &intents); err != nil {
+		t.Fatalf("decode intents: %v", err)
+	}
+	if len(intents) != 3 {
+		t.Errorf("listed %d intents, want 3", len(intents))
+	}
+
+	s.expect(t, http.StatusOK, http.MethodDelete, "/api/v1/intents/evening", nil)
+	s.expect(t, http.StatusNotFound, http.MethodGet, "/api/v1/intents/evening", nil)
+	s.expect(t, http.StatusNotFound, http.MethodDelete, "/api/v1/intents/evening", nil)
+}
+
+func TestValidationErrorResponses(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		method, path string
+		body         interface{}
+		want         ValidationErrors
+	}{
+		{http.MethodPost, "/api/v1/play", map[string]string{"queue_mode": "later"}, ValidationErrors{
+			{"intent", "required unless playlist_override is set"},
+			{"location", "required"},
+			{"queue_mode", `must be replace, next or end, got "later"`},
+		}},
+		{http.MethodPost, "/api/v1/intents", map[string]string{"selection_mode": "shuffle", "timezone": "Mars/Olympus"}, ValidationErrors{
+			{"name", "required"},
+			{"playlists", "required"},
+			{"selection_mode", `must be random or least_recently_played, got "shuffle"`},
+			{"timezone", `unknown timezone "Mars/Olympus"`},
+		}},
+		{http.MethodPut, "/api/v1/intents/morning", map[string]string{"active_start": "9pm"}, ValidationErrors{
+			{"playlists", "required unless playlist_group is set"},
+			{"active_end", "required when active_start is set"},
+			{"active_start", `must be HH:MM, got "9pm"`},
+		}},
+	} {
+		status, data := s.do(t, tc.method, tc.path, tc.body)
+		if status != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d, want 400: %s", tc.method, tc.path, status, data)
+			continue
+		}
+		var resp ValidationResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("%s %s: decode response: %v", tc.method, tc.path, err)
+		}
+		if resp.Success || !slices.Equal(resp.ValidationErrors, tc.want) {
+			t.Errorf("%s %s: validation_errors = %+v, want %+v", tc.method, tc.path, resp.ValidationErrors, tc.want)
+		}
+		if resp.Error != tc.want.Error() {
+			t.Errorf("%s %s: error = %q, want %q", tc.method, tc.path, resp.Error, tc.want.Error())
+		}
+	}
+}
+
+func TestUpdateIntentKeepsOmittedSettings(t *testing.T) {
+	s := newTestServer(t)
+	settings := IntentSettings{SelectionMode: selectionModeLeastRecentlyPlayed, ActiveStart: "20:00", ActiveEnd: "23:30", Timezone: "Europe/Berlin", QueueMode: queueModeEnd}
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents", Intent{Name: "evening", Playlists: []string{"spotify:playlist:evening"}, IntentSettings: settings})
+
+	getSettings := func() IntentSettings {
+		t.Helper()
+		var intent Intent
+		if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents/evening", nil), &intent); err != nil {
+			t.Fatalf("decode intent: %v", err)
+		}
+		return intent.IntentSettings
+	}
+
+	// The UI only sends the playlists
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/intents/evening", map[string]interface{}{"playlists": []string{"spotify:playlist:night"}})
+	if got := getSettings(); got != settings {
+		t.Errorf("settings after a playlists-only PUT = %+v, want %+v", got, settings)
+	}
+
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/intents/evening",
+		map[string]interface{}{"playlists": []string{"spotify:playlist:night"}, "active_start": "", "active_end": "", "queue_mode": queueModeNext})
+	want := settings
+	want.ActiveStart, want.ActiveEnd, want.QueueMode = "", "", queueModeNext
+	if got := getSettings(); got != want {
+		t.Errorf("settings after clearing the window = %+v, want %+v", got, want)
+	}
+}
+
+func TestActiveWindowOnlyAppliesToPlays(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now().UTC()
+	window := IntentSettings{ActiveStart: now.Add(time.Hour).Format(activeTimeLayout), ActiveEnd: now.Add(2 * time.Hour).Format(activeTimeLayout)}
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents", Intent{Name: "evening", Playlists: []string{"spotify:playlist:evening"}, IntentSettings: window})
+	s.useMockMQTT(t)
+
+	s.expect(t, http.StatusForbidden, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "evening", Location: "kitchen"})
+	s.expect(t, http.StatusForbidden, http.MethodPost, "/api/v1/locations/kitchen/queue", QueueRequest{Intent: "evening"})
+	s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents/evening/preview", nil)
+}
+
+func TestLocationLifecycle(t *testing.T) {
+	s := newTestServer(t)
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/locations", Location{Name: "bedroom", SpeakerEntity: "media_player.bedroom"})
+
+	var location Location
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/locations/bedroom", nil), &location); err != nil {
+		t.Fatalf("decode location: %v", err)
+	}
+	if location.SpeakerEntity != "media_player.bedroom" {
+		t.Errorf("speaker_entity = %q, want %q", location.SpeakerEntity, "media_player.bedroom")
+	}
+	if location.DisplayName != "bedroom" {
+		t.Errorf("display_name = %q, want the name when unset", location.DisplayName)
+	}
+
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/locations/bedroom",
+		map[string]string{"speaker_entity": "media_player.bedroom", "display_name": "Main Bedroom", "description": "By the window"})
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/locations/bedroom", map[string]string{"speaker_entity": "media_player.bedroom_2"})
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/locations/bedroom", nil), &location); err != nil {
+		t.Fatalf("decode location: %v", err)
+	}
+	if location.SpeakerEntity != "media_player.bedroom_2" || location.DisplayName != "Main Bedroom" || location.Description != "By the window" {
+		t.Errorf("location = %+v, want the labels kept across a speaker-only update", location)
+	}
+
+	s.expect(t, http.StatusOK, http.MethodDelete, "/api/v1/locations/bedroom", nil)
+	s.expect(t, http.StatusNotFound, http.MethodGet, "/api/v1/locations/bedroom", nil)
+}
+
+func TestAvailablePlaylistsShape(t *testing.T) {
+	s := newTestServer(t)
+
+	var uris []string
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/available-playlists", nil), &uris); err != nil {
+		t.Fatalf("decode available playlists as URIs: %v", err)
+	}
+	if !slices.Contains(uris, "spotify:playlist:focus1") {
+		t.Errorf("available playlists = %v, want the focus group's", uris)
+	}
+
+	var playlists []AvailablePlaylist
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/available-playlists?include_cover_art=true", nil), &playlists); err != nil {
+		t.Fatalf("decode available playlists with cover art: %v", err)
+	}
+	if len(playlists) != len(uris) || playlists[0].Playlist != uris[0] {
+		t.Errorf("with cover art = %+v, want the same playlists as %v", playlists, uris)
+	}
+}
+
+func TestPlaylistGroupUsedByIntents(t *testing.T) {
+	s := newTestServer(t)
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/playlist-groups", PlaylistGroup{Name: "unused", Playlists: []string{"spotify:playlist:x"}})
+
+	for _, includePlaylists := range []string{"false", "true"} {
+		var groups []PlaylistGroup
+		if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups?include_playlists="+includePlaylists, nil), &groups); err != nil {
+			t.Fatalf("decode groups: %v", err)
+		}
+		usedBy := map[string]int{}
+		for _, group := range groups {
+			usedBy[group.Name] = group.UsedByIntents
+		}
+		if usedBy["focus"] != 1 || usedBy["unused"] != 0 {
+			t.Errorf("include_playlists=%s: used_by_intents = %v, want focus 1 and unused 0", includePlaylists, usedBy)
+		}
+	}
+
+	var group PlaylistGroup
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups/focus", nil), &group); err != nil {
+		t.Fatalf("decode group: %v", err)
+	}
+	if group.UsedByIntents != 1 {
+		t.Errorf("used_by_intents = %d, want 1", group.UsedByIntents)
+	}
+
+	// Intent changes move the counts, so the list's ETag must not match afterwards
+	resp, err := s.Client().Get(s.URL + "/api/v1/playlist-groups")
+	if err != nil {
+		t.Fatalf("GET playlist groups: %v", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/intents/morning", Intent{PlaylistGroup: "unused"})
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/api/v1/playlist-groups", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("conditional GET playlist groups: %v", err)
+	}
+	resp.Body.Close()
+	if etag == "" || resp.StatusCode != http.StatusOK {
+		t.Errorf("conditional GET after updating an intent = %d (ETag %q), want 200", resp.StatusCode, etag)
+	}
+}
+
+func TestGetMissingPlaylistGroup(t *testing.T) {
+	s := newTestServer(t)
+
+	// An empty group still exists
+	if _, err := s.c.db.db.Exec("DELETE FROM playlist_group_item WHERE group_name = 'focus'"); err != nil {
+		t.Fatalf("empty group: %v", err)
+	}
+	s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups/focus", nil)
+
+	data := s.expect(t, http.StatusNotFound, http.MethodGet, "/api/v1/playlist-groups/nonexistent", nil)
+	if !strings.Contains(string(data), "playlist group 'nonexistent' not found") {
+		t.Errorf("response = %s, want a not found error", data)
+	}
+}
+
+func TestPlaylistGroupDuplicates(t *testing.T) {
+	s := newTestServer(t)
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/playlist-groups",
+		PlaylistGroup{Name: "evening", Playlists: []string{"Spotify:Playlist:focus1 ", "spotify:playlist:x"}})
+
+	var duplicates []string
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups/duplicates", nil), &duplicates); err != nil {
+		t.Fatalf("decode duplicates: %v", err)
+	}
+	if !slices.Equal(duplicates, []string{"spotify:playlist:focus1"}) {
+		t.Errorf("duplicates = %v, want [spotify:playlist:focus1]", duplicates)
+	}
+
+	// A group by that name would be unreachable
+	for _, name := range []string{"duplicates", "Duplicates"} {
+		s.expect(t, http.StatusBadRequest, http.MethodPost, "/api/v1/playlist-groups", PlaylistGroup{Name: name, Playlists: []string{"spotify:playlist:x"}})
+		s.expect(t, http.StatusBadRequest, http.MethodPost, "/api/v1/playlist-groups/evening/rename", RenameRequest{Name: name})
+	}
+}
+
+func TestPlaylistGroupTags(t *testing.T) {
+	s := newTestServer(t)
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/playlist-groups",
+		PlaylistGroup{Name: "evening", Playlists: []string{"spotify:playlist:x"}, Tags: []string{" Jazz", "mellow", "jazz", ""}})
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/playlist-groups/focus",
+		PlaylistGroup{Playlists: []string{"spotify:playlist:focus1"}, Tags: []string{"instrumental"}})
+
+	var group PlaylistGroup
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups/evening", nil), &group); err != nil {
+		t.Fatalf("decode group: %v", err)
+	}
+	if !slices.Equal(group.Tags, []string{"jazz", "mellow"}) {
+		t.Errorf("tags = %v, want [jazz mellow]", group.Tags)
+	}
+
+	var tags []string
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-group-tags", nil), &tags); err != nil {
+		t.Fatalf("decode tags: %v", err)
+	}
+	if !slices.Equal(tags, []string{"instrumental", "jazz", "mellow"}) {
+		t.Errorf("tags in use = %v", tags)
+	}
+
+	for _, includePlaylists := range []string{"false", "true"} {
+		var groups []PlaylistGroup
+		if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups?tag=JAZZ&include_playlists="+includePlaylists, nil), &groups); err != nil {
+			t.Fatalf("decode groups: %v", err)
+		}
+		if len(groups) != 1 || groups[0].Name != "evening" {
+			t.Errorf("include_playlists=%s: ?tag=JAZZ returned %+v, want only evening", includePlaylists, groups)
+		}
+	}
+
+	// A PUT without tags keeps them
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/playlist-groups/evening", PlaylistGroup{Playlists: []string{"spotify:playlist:y"}})
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups/evening", nil), &group); err != nil {
+		t.Fatalf("decode group: %v", err)
+	}
+	if !slices.Equal(group.Tags, []string{"jazz", "mellow"}) {
+		t.Errorf("tags after update = %v, want them kept", group.Tags)
+	}
+}
+
+func TestDuplicateNamesAreRejected(t *testing.T) {
+	s := newTestServer(t)
+
+	cases := []struct {
+		path  string
+		body  interface{}
+		error string
+	}{
+		{"/api/v1/intents", Intent{Name: "morning", Playlists: []string{"spotify:playlist:other"}}, "intent 'morning' already exists"},
+		{"/api/v1/locations", Location{Name: "kitchen", SpeakerEntity: "media_player.other"}, "location 'kitchen' already exists"},
+		{"/api/v1/playlist-groups", PlaylistGroup{Name: "focus", Playlists: []string{"spotify:playlist:other"}}, "playlist group 'focus' already exists"},
+	}
+	for _, tt := range cases {
+		var resp IntentResponse
+		if err := json.Unmarshal(s.expect(t, http.StatusConflict, http.MethodPost, tt.path, tt.body), &resp); err != nil {
+			t.Fatalf("decode error response: %v", err)
+		}
+		if resp.Error != tt.error {
+			t.Errorf("POST %s with an existing name: error %q, want %q", tt.path, resp.Error, tt.error)
+		}
+	}
+
+	var intent Intent
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents/morning", nil), &intent); err != nil {
+		t.Fatalf("decode intent: %v", err)
+	}
+	if !slices.Equal(intent.Playlists, []string{"spotify:playlist:morning"}) {
+		t.Errorf("duplicate create changed the intent: playlists = %q", intent.Playlists)
+	}
+}
+
+func TestCleanupOrphanedIntentGroupRefs(t *testing.T) {
+	s := newTestServer(t)
+	// Like an import that skipped the group check
+	if _, err := s.c.db.db.Exec("UPDATE intent SET playlist_group = 'gone' WHERE name = 'work'"); err != nil {
+		t.Fatalf("orphan intent: %v", err)
+	}
+
+	data := s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/db/cleanup", nil)
+	if !strings.Contains(string(data), "cleared 1 intent reference") {
+		t.Errorf("cleanup response = %s, want one cleared intent reference", data)
+	}
+	var group sql.NullString
+	if err := s.c.db.db.QueryRow("SELECT playlist_group FROM intent WHERE name = 'work'").Scan(&group); err != nil {
+		t.Fatalf("query intent: %v", err)
+	}
+	if group.Valid {
+		t.Errorf("playlist_group = %q after cleanup, want NULL", group.String)
+	}
+	if cleared, err := s.c.db.CleanupOrphanedIntentGroupRefs(); err != nil || cleared != 0 {
+		t.Errorf("second cleanup = %d, %v, want nothing left to clear", cleared, err)
+	}
+}
+
+func TestDBMigrateRollbackNeedsForce(t *testing.T) {
+	c := newTestCoordinator(t)
+	c.config.AuthToken = "secret"
+	latest := latestSchemaVersion()
+	target := fmt.Sprintf("/api/v1/db/migrate?version=%d", latest-1)
+
+	if w := serve(t, http.HandlerFunc(c.handleDBMigrate), http.MethodPost, target, ""); w.Code != http.StatusConflict {
+		t.Errorf("rollback without force = %d %s, want 409", w.Code, w.Body)
+	}
+	if version, err := c.db.SchemaVersion(); err != nil || version != latest {
+		t.Errorf("schema version = %d, %v, want it left at %d", version, err, latest)
+	}
+
+	if w := serve(t, http.HandlerFunc(c.handleDBMigrate), http.MethodPost, target+"&force=true", ""); w.Code != http.StatusOK {
+		t.Fatalf("forced rollback = %d %s, want 200", w.Code, w.Body)
+	}
+	if version, err := c.db.SchemaVersion(); err != nil || version != latest-1 {
+		t.Errorf("schema version = %d, %v, want %d", version, err, latest-1)
+	}
+	// Migrating forward again needs no force
+	if w := serve(t, http.HandlerFunc(c.handleDBMigrate), http.MethodPost, fmt.Sprintf("/api/v1/db/migrate?version=%d", latest), ""); w.Code != http.StatusOK {
+		t.Errorf("migrate forward = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestScheduledCleanupInvalidatesETags(t *testing.T) {
+	s := newTestServer(t)
+	s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents", nil)
+	s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/playlist-groups", nil)
+	if s.c.etags.get(resourceIntents) == "" || s.c.etags.get(resourcePlaylistGroups) == "" {
+		t.Fatal("list responses weren't given cached ETags")
+	}
+	if _, err := s.c.db.db.Exec("UPDATE intent SET playlist_group = 'gone' WHERE name = 'work'"); err != nil {
+		t.Fatalf("orphan intent: %v", err)
+	}
+
+	done := make(chan struct{})
+	go s.c.runOrphanCleanup(10*time.Millisecond, done)
+	deadline := time.Now().Add(2 * time.Second)
+	for s.c.etags.get(resourceIntents) != "" || s.c.etags.get(resourcePlaylistGroups) != "" {
+		if time.Now().After(deadline) {
+			close(done)
+			t.Fatal("scheduled cleanup left the intent and playlist group ETags cached")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(done)
+}
+
+func TestIntentPreview(t *testing.T) {
+	s := newTestServer(t)
+
+	var preview IntentPreview
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents/work/preview", nil), &preview); err != nil {
+		t.Fatalf("decode preview: %v", err)
+	}
+	total := 0
+	for playlist, count := range preview.Selections {
+		if playlist != "spotify:playlist:focus1" && playlist != "spotify:playlist:focus2" {
+			t.Errorf("preview picked %q, which isn't in the group", playlist)
+		}
+		total += count
+	}
+	if preview.Mode != selectionModeRandom || total != previewSamples {
+		t.Errorf("preview = %+v, want %d random picks", preview, previewSamples)
+	}
+
+	playlists := []string{"spotify:playlist:a", "spotify:playlist:b", "spotify:playlist:c"}
+	if err := s.c.db.CreateIntent("fair", playlists, "", IntentSettings{SelectionMode: selectionModeLeastRecentlyPlayed}); err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+	if err := s.c.db.RecordPlay("fair", "kitchen", "spotify:playlist:a", triggeredViaHTTP, ""); err != nil {
+		t.Fatalf("RecordPlay: %v", err)
+	}
+	preview = IntentPreview{}
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents/fair/preview", nil), &preview); err != nil {
+		t.Fatalf("decode preview: %v", err)
+	}
+	want := []string{"spotify:playlist:b", "spotify:playlist:c", "spotify:playlist:a"}
+	if preview.Mode != selectionModeLeastRecentlyPlayed || !slices.Equal(preview.Order, want) {
+		t.Errorf("preview = %+v, want order %v", preview, want)
+	}
+
+	s.expect(t, http.StatusNotFound, http.MethodGet, "/api/v1/intents/missing/preview", nil)
+}
+
+func TestMixedCaseLegacyNames(t *testing.T) {
+	s := newTestServer(t)
+	s.useMockMQTT(t)
+	// Rows from before names were normalized on creation
+	if _, err := s.c.db.db.Exec(`INSERT INTO intent (name, playlist) VALUES ('Evening', '["spotify:playlist:evening"]')`); err != nil {
+		t.Fatalf("insert intent: %v", err)
+	}
+	if _, err := s.c.db.db.Exec(`INSERT INTO location (name, speaker_entity) VALUES ('Den', 'media_player.den')`); err != nil {
+		t.Fatalf("insert location: %v", err)
+	}
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "evening", Location: "den"})
+	for _, path := range []string{"/api/v1/intents/evening/history", "/api/v1/locations/den/history"} {
+		var history []PlayHistoryEntry
+		if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, path, nil), &history); err != nil {
+			t.Fatalf("decode %s: %v", path, err)
+		}
+		if len(history) != 1 || history[0].IntentName != "Evening" || history[0].LocationName != "Den" {
+			t.Errorf("%s = %+v, want one play stored under Evening and Den", path, history)
+		}
+	}
+
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/intents/evening", Intent{Playlists: []string{"spotify:playlist:night"}})
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/locations/den", LocationUpdate{SpeakerEntity: "media_player.den_2"})
+	var location Location
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/locations/Den", nil), &location); err != nil {
+		t.Fatalf("decode location: %v", err)
+	}
+	if location.SpeakerEntity != "media_player.den_2" {
+		t.Errorf("speaker_entity = %q after PUT, want media_player.den_2", location.SpeakerEntity)
+	}
+
+	s.expect(t, http.StatusOK, http.MethodDelete, "/api/v1/intents/evening", nil)
+	s.expect(t, http.StatusNotFound, http.MethodGet, "/api/v1/intents/Evening", nil)
+	s.expect(t, http.StatusOK, http.MethodDelete, "/api/v1/locations/den", nil)
+	s.expect(t, http.StatusNotFound, http.MethodGet, "/api/v1/locations/Den", nil)
+}
+
+func TestIntentWithMissingGroup(t *testing.T) {
+	s := newTestServer(t)
+
+	if err := s.c.db.CreateIntent("orphan", nil, "missing", IntentSettings{}); !errors.Is(err, ErrPlaylistGroupMissing) {
+		t.Errorf("CreateIntent with a missing group: err = %v, want ErrPlaylistGroupMissing", err)
+	}
+	s.expect(t, http.StatusNotFound, http.MethodGet, "/api/v1/intents/orphan", nil)
+
+	status, data := s.do(t, http.MethodPut, "/api/v1/intents/work", Intent{PlaylistGroup: "missing"})
+	if status != http.StatusBadRequest || !strings.Contains(string(data), "playlist group 'missing' does not exist") {
+		t.Errorf("PUT with a missing group: status %d: %s", status, data)
+	}
+	var intent Intent
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/intents/work", nil), &intent); err != nil {
+		t.Fatalf("decode intent: %v", err)
+	}
+	if intent.PlaylistGroup != "focus" {
+		t.Errorf("playlist_group = %q after a rejected update, want focus", intent.PlaylistGroup)
+	}
+
+	var bulk BulkIntentsResponse
+	data = s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents/bulk", []IntentInput{{Name: "orphan", PlaylistGroup: "missing"}})
+	if err := json.Unmarshal(data, &bulk); err != nil {
+		t.Fatalf("decode bulk response: %v", err)
+	}
+	if bulk.Created != 0 || len(bulk.Errors) != 1 {
+		t.Errorf("bulk create with a missing group = %+v, want one error", bulk)
+	}
+}
+
+// fakeHA records the services called on it and reports every speaker as idle
+type fakeHA struct {
+	mu     sync.Mutex
+	calls  []haServiceCall
+	states map[string]HAEntityState // entities not listed are idle
+}
+
+type haServiceCall struct {
+	Service string
+	Data    map[string]interface{}
+}
+
+func (f *fakeHA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if service, ok := strings.CutPrefix(r.URL.Path, "/api/services/"); ok {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		f.mu.Lock()
+		f.calls = append(f.calls, haServiceCall{Service: service, Data: data})
+		f.mu.Unlock()
+		w.Write([]byte("[]"))
+		return
+	}
+	if entity, ok := strings.CutPrefix(r.URL.Path, "/api/states/"); ok {
+		f.mu.Lock()
+		state, ok := f.states[entity]
+		f.mu.Unlock()
+		if !ok {
+			state = HAEntityState{EntityID: entity, State: "idle"}
+		}
+		json.NewEncoder(w).Encode(state)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (f *fakeHA) called(service string) []haServiceCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []haServiceCall
+	for _, call := range f.calls {
+		if call.Service == service {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func TestPlayFlowOverHAHTTP(t *testing.T) {
+	s := newTestServer(t)
+	ha := &fakeHA{}
+	haServer := httptest.NewServer(ha)
+	t.Cleanup(haServer.Close)
+	s.c.haClient = NewHAClient(haServer.URL, "token", defaultPlayTimeout, 0, 0)
+	s.c.config.PlayTransport = playTransportHAHTTP
+
+	var resp IntentResponse
+	data := s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Location: "office"})
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("decode play response: %v", err)
+	}
+	if resp.SpeakerEntity != "media_player.office" {
+		t.Errorf("speaker_entity = %q, want media_player.office", resp.SpeakerEntity)
+	}
+	if resp.Playlist != "spotify:playlist:focus1" && resp.Playlist != "spotify:playlist:focus2" {
+		t.Errorf("playlist = %q, want one from the focus group", resp.Playlist)
+	}
+
+	calls := ha.called("mass/play_media")
+	if len(calls) != 1 {
+		t.Fatalf("mass.play_media called %d times, want 1", len(calls))
+	}
+	if calls[0].Data["entity_id"] != "media_player.office" || calls[0].Data["media_id"] != resp.Playlist {
+		t.Errorf("mass.play_media data = %v", calls[0].Data)
+	}
+
+	intent, err := s.c.db.GetIntent("work")
+	if err != nil {
+		t.Fatalf("GetIntent: %v", err)
+	}
+	if intent.PlayCount != 1 {
+		t.Errorf("play_count = %d, want 1", intent.PlayCount)
+	}
+
+	s.expect(t, http.StatusNotFound, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "missing", Location: "office"})
+	s.expect(t, http.StatusNotFound, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Location: "missing"})
+}
+
+func TestPlayUsesLocationHomeAssistant(t *testing.T) {
+	s := newTestServer(t)
+	global, remote := &fakeHA{}, &fakeHA{}
+	globalServer, remoteServer := httptest.NewServer(global), httptest.NewServer(remote)
+	t.Cleanup(globalServer.Close)
+	t.Cleanup(remoteServer.Close)
+	s.c.haClient = NewHAClient(globalServer.URL, "token", defaultPlayTimeout, 0, 0)
+	s.c.config.PlayTransport = playTransportHAHTTP
+
+	s.expect(t, http.StatusBadRequest, http.MethodPut, "/api/v1/locations/office/ha", LocationHA{URL: "not a url"})
+	s.expect(t, http.StatusNotFound, http.MethodPut, "/api/v1/locations/missing/ha", LocationHA{URL: remoteServer.URL})
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/locations/office/ha", LocationHA{URL: remoteServer.URL, Token: "secret"})
+
+	var settings map[string]interface{}
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/locations/office/ha", nil), &settings); err != nil {
+		t.Fatalf("decode settings: %v", err)
+	}
+	if settings["ha_url"] != remoteServer.URL || settings["ha_token_set"] != true {
+		t.Errorf("settings = %v", settings)
+	}
+	if _, ok := settings["ha_token"]; ok {
+		t.Error("settings expose the token")
+	}
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Location: "office"})
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Location: "kitchen"})
+	if n := len(remote.called("mass/play_media")); n != 1 {
+		t.Errorf("office instance got %d plays, want 1", n)
+	}
+	if n := len(global.called("mass/play_media")); n != 1 {
+		t.Errorf("default instance got %d plays, want 1", n)
+	}
+
+	// Changing the settings replaces the cached client rather than adding one
+	s.expect(t, http.StatusOK, http.MethodPut, "/api/v1/locations/office/ha", LocationHA{URL: remoteServer.URL, Token: "rotated"})
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Location: "office"})
+	if n := len(s.c.haClients); n != 1 {
+		t.Errorf("%d cached clients after changing the token, want 1", n)
+	}
+
+	s.expect(t, http.StatusOK, http.MethodDelete, "/api/v1/locations/office/ha", nil)
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Location: "office"})
+	if n := len(global.called("mass/play_media")); n != 2 {
+		t.Errorf("default instance got %d plays after reset, want 2", n)
+	}
+	if n := len(s.c.haClients); n != 0 {
+		t.Errorf("%d cached clients after the overrides were removed, want 0", n)
+	}
+}
+
+func TestPlayGroupedSpeakers(t *testing.T) {
+	s := newTestServer(t)
+	ha := &fakeHA{}
+	haServer := httptest.NewServer(ha)
+	t.Cleanup(haServer.Close)
+	s.c.haClient = NewHAClient(haServer.URL, "token", defaultPlayTimeout, 0, 0)
+	s.c.config.PlayTransport = playTransportHAHTTP
+	s.c.config.UseHASpeakerGroups = true
+	if _, err := s.c.db.CreateVolumeProfile(VolumeProfile{LocationName: "kitchen", StartTime: "00:00", EndTime: "23:59", Volume: 0.3}); err != nil {
+		t.Fatalf("CreateVolumeProfile: %v", err)
+	}
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Locations: []string{"office", "kitchen"}})
+
+	var services []string
+	for _, call := range ha.calls {
+		services = append(services, call.Service)
+	}
+	// The group stays joined while it plays
+	want := []string{"media_player/join", "media_player/volume_set", "mass/play_media"}
+	if !slices.Equal(services, want) {
+		t.Fatalf("service calls = %v, want %v", services, want)
+	}
+	if data := ha.calls[0].Data; data["entity_id"] != "media_player.office" || fmt.Sprint(data["group_members"]) != "[media_player.kitchen]" {
+		t.Errorf("media_player.join data = %v", data)
+	}
+	if data := ha.calls[1].Data; data["entity_id"] != "media_player.kitchen" || data["volume_level"] != 0.3 {
+		t.Errorf("media_player.volume_set data = %v", data)
+	}
+	if data := ha.calls[2].Data; data["entity_id"] != "media_player.office" {
+		t.Errorf("mass.play_media data = %v", data)
+	}
+}
+
+// useMockMQTT swaps the server's MQTT client for a mock and subscribes to the
+// play and control topics on it
+func (s *testServer) useMockMQTT(t *testing.T) *testutil.MockMQTTClient {
+	t.Helper()
+	client := testutil.NewMockMQTTClient()
+	s.c.mqttClient = client
+	s.c.mqttDedup = newMQTTDedupCache(mqttDedupCacheSize, time.Second)
+	if err := s.c.subscribeToPlayRequests(); err != nil {
+		t.Fatalf("subscribeToPlayRequests: %v", err)
+	}
+	return client
+}
+
+// playMedia decodes the play_media commands published to Home Assistant
+func playMedia(t *testing.T, client *testutil.MockMQTTClient) []map[string]interface{} {
+	t.Helper()
+	var commands []map[string]interface{}
+	for _, msg := range client.PublishedTo(mqttHATopic) {
+		var command map[string]interface{}
+		if err := json.Unmarshal(msg.Payload, &command); err != nil {
+			t.Fatalf("decode play_media payload %q: %v", msg.Payload, err)
+		}
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+func TestPlayFlowOverMQTT(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen"})
+
+	commands := playMedia(t, client)
+	if len(commands) != 1 {
+		t.Fatalf("published %d play_media commands, want 1", len(commands))
+	}
+	want := map[string]interface{}{"entity_id": "media_player.kitchen", "media_id": "spotify:playlist:morning", "media_type": "playlist"}
+	for key, value := range want {
+		if commands[0][key] != value {
+			t.Errorf("play_media %s = %v, want %v", key, commands[0][key], value)
+		}
+	}
+}
+
+func TestPlayReportsEstimatedDuration(t *testing.T) {
+	s := newTestServer(t)
+	s.useMockMQTT(t)
+	var lookups atomic.Int32
+	ma := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		switch r.URL.Path {
+		case "/api/playlists/spotify:playlist:morning":
+			w.Write([]byte(`{"uri": "spotify:playlist:morning", "tracks": [{"duration": 180.4}, {"duration": 240}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ma.Close)
+	s.c.maClient = NewMAClient(ma.URL, "", defaultPlayTimeout)
+
+	var resp IntentResponse
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen"}), &resp); err != nil {
+		t.Fatalf("decode play response: %v", err)
+	}
+	if resp.EstimatedDurationSeconds != 420 {
+		t.Errorf("estimated_duration_seconds = %d, want 420", resp.EstimatedDurationSeconds)
+	}
+
+	// Without a duration from MA the play still succeeds, just without the hint
+	data := s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "work", Location: "kitchen"})
+	if strings.Contains(string(data), "estimated_duration_seconds") {
+		t.Errorf("response = %s, want no duration", data)
+	}
+
+	// Durations are cached per playlist, failures included
+	missing := IntentRequest{Location: "kitchen", PlaylistOverride: "spotify:playlist:missing"}
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", missing)
+	before := lookups.Load()
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen"})
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", missing)
+	if n := lookups.Load() - before; n != 0 {
+		t.Errorf("repeat plays made %d MA lookups, want 0", n)
+	}
+}
+
+func TestPlayQueueMode(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents", map[string]interface{}{
+		"name": "later", "playlists": []string{"spotify:playlist:later"}, "queue_mode": "next",
+	})
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "later", Location: "kitchen"})
+	// The request's queue_mode wins over the intent's
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "later", Location: "kitchen", QueueMode: "end"})
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen"})
+
+	commands := playMedia(t, client)
+	if len(commands) != 3 {
+		t.Fatalf("published %d play_media commands, want 3", len(commands))
+	}
+	for i, want := range []interface{}{"next", "add", nil} {
+		if commands[i]["enqueue"] != want {
+			t.Errorf("play %d: enqueue = %v, want %v", i+1, commands[i]["enqueue"], want)
+		}
+	}
+
+	s.expect(t, http.StatusBadRequest, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen", QueueMode: "later"})
+	if !client.Deliver(mqttPlayTopic, []byte(`{"intent":"morning","location":"kitchen","queue_mode":"later"}`)) {
+		t.Fatalf("nothing subscribed to %s", mqttPlayTopic)
+	}
+	if n := len(playMedia(t, client)); n != 3 {
+		t.Errorf("published %d play_media commands after invalid queue_mode, want 3", n)
+	}
+	s.expect(t, http.StatusBadRequest, http.MethodPost, "/api/v1/intents", map[string]interface{}{
+		"name": "bad", "playlists": []string{"spotify:playlist:bad"}, "queue_mode": "sideways",
+	})
+}
+
+func TestQueueDropsPlayedEntries(t *testing.T) {
+	s := newTestServer(t)
+	s.useMockMQTT(t)
+	ha := &fakeHA{states: map[string]HAEntityState{}}
+	haServer := httptest.NewServer(ha)
+	t.Cleanup(haServer.Close)
+	s.c.haClient = NewHAClient(haServer.URL, "token", defaultPlayTimeout, 0, 0)
+
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents", map[string]interface{}{
+		"name": "second", "playlists": []string{"spotify:playlist:second"},
+	})
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents", map[string]interface{}{
+		"name": "third", "playlists": []string{"spotify:playlist:third"},
+	})
+	for _, intent := range []string{"morning", "second", "third"} {
+		s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/locations/kitchen/queue", QueueRequest{Intent: intent})
+	}
+	setState := func(state, mediaID string) {
+		ha.mu.Lock()
+		ha.states["media_player.kitchen"] = HAEntityState{State: state, Attributes: map[string]interface{}{"media_content_id": mediaID}}
+		ha.mu.Unlock()
+	}
+	queue := func() []QueueEntry {
+		var entries []QueueEntry
+		if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/locations/kitchen/queue", nil), &entries); err != nil {
+			t.Fatalf("decode queue: %v", err)
+		}
+		return entries
+	}
+
+	// Still on whatever was playing before the first queued entry
+	setState("playing", "spotify:playlist:earlier")
+	if entries := queue(); len(entries) != 3 || entries[0].Playing {
+		t.Errorf("queue = %+v, want all three entries, none playing", entries)
+	}
+
+	setState("playing", "spotify:playlist:second")
+	entries := queue()
+	if len(entries) != 2 || entries[0].IntentName != "second" || !entries[0].Playing || entries[1].IntentName != "third" || entries[1].Playing {
+		t.Errorf("queue = %+v, want second (playing) then third", entries)
+	}
+
+	setState("idle", "")
+	if entries := queue(); len(entries) != 0 {
+		t.Errorf("queue = %+v, want it empty once the speaker is idle", entries)
+	}
+}
+
+func TestPlayPlaylistOverride(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+	events := s.c.events.subscribe()
+	t.Cleanup(func() { s.c.events.unsubscribe(events) })
+
+	var resp IntentResponse
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Location: "kitchen", PlaylistOverride: "spotify:playlist:oneoff"}), &resp); err != nil {
+		t.Fatalf("decode play response: %v", err)
+	}
+	if resp.Playlist != "spotify:playlist:oneoff" {
+		t.Errorf("playlist = %q, want the override", resp.Playlist)
+	}
+	// The override wins over the intent's playlists
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen", PlaylistOverride: "spotify:playlist:oneoff"})
+
+	commands := playMedia(t, client)
+	if len(commands) != 2 {
+		t.Fatalf("published %d play_media commands, want 2", len(commands))
+	}
+	for i, command := range commands {
+		if command["media_id"] != "spotify:playlist:oneoff" {
+			t.Errorf("play %d: media_id = %v, want the override", i+1, command["media_id"])
+		}
+	}
+
+	// Both plays are announced
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-events:
+			var event PlayEvent
+			if err := json.Unmarshal([]byte(msg), &event); err != nil || event.Playlist != "spotify:playlist:oneoff" {
+				t.Errorf("play event %d = %s, want the override", i+1, msg)
+			}
+		default:
+			t.Errorf("play event %d missing", i+1)
+		}
+	}
+
+	// Neither is recorded; the override isn't one of morning's playlists
+	var stats Stats
+	if err := json.Unmarshal(s.expect(t, http.StatusOK, http.MethodGet, "/api/v1/stats", nil), &stats); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if stats.TotalPlaysAllTime != 0 || stats.MostPlayedIntent != "" {
+		t.Errorf("stats = %+v, want no recorded plays", stats)
+	}
+	intent, err := s.c.db.GetIntent("morning")
+	if err != nil {
+		t.Fatalf("GetIntent: %v", err)
+	}
+	if intent.PlayCount != 0 {
+		t.Errorf("morning play_count = %d, want 0", intent.PlayCount)
+	}
+
+	s.expect(t, http.StatusNotFound, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "missing", Location: "kitchen", PlaylistOverride: "spotify:playlist:oneoff"})
+	closed := IntentSettings{ActiveStart: time.Now().UTC().Add(time.Hour).Format(activeTimeLayout), ActiveEnd: time.Now().UTC().Add(2 * time.Hour).Format(activeTimeLayout)}
+	s.expect(t, http.StatusOK, http.MethodPost, "/api/v1/intents", Intent{Name: "evening", Playlists: []string{"spotify:playlist:evening"}, IntentSettings: closed})
+	s.expect(t, http.StatusForbidden, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "evening", Location: "kitchen", PlaylistOverride: "spotify:playlist:oneoff"})
+
+	for _, body := range []IntentRequest{
+		{Location: "kitchen"},
+		{Location: "kitchen", PlaylistOverride: "  "},
+		{Location: "kitchen", PlaylistOverride: "spotify:playlist:a,spotify:playlist:b"},
+	} {
+		status, data := s.do(t, http.MethodPost, "/api/v1/play", body)
+		if status != http.StatusBadRequest || !strings.Contains(string(data), "playlist_override") {
+			t.Errorf("play with override %q = %d %s, want 400", body.PlaylistOverride, status, data)
+		}
+	}
+}
+
+func TestPlayRequestFromMQTT(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+
+	if !client.Deliver(mqttPlayTopic, []byte(`{"intent":"work","location":"office"}`)) {
+		t.Fatalf("nothing subscribed to %s", mqttPlayTopic)
+	}
+
+	commands := playMedia(t, client)
+	if len(commands) != 1 || commands[0]["entity_id"] != "media_player.office" {
+		t.Fatalf("play_media commands = %v, want one for media_player.office", commands)
+	}
+	played := client.PublishedTo(mqttPlayedTopic)
+	if len(played) != 1 {
+		t.Fatalf("published %d play confirmations, want 1", len(played))
+	}
+	var resp IntentResponse
+	if err := json.Unmarshal(played[0].Payload, &resp); err != nil {
+		t.Fatalf("decode confirmation: %v", err)
+	}
+	if !resp.Success || resp.Playlist != commands[0]["media_id"] {
+		t.Errorf("confirmation = %+v, want success with playlist %v", resp, commands[0]["media_id"])
+	}
+}
+
+func TestMQTTPlayRequestLogsCarryRequestID(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	client.Deliver(mqttPlayTopic, []byte(`{"intent":"missing","location":"office"}`))
+	client.Deliver(mqttPlayTopic, []byte(`{"intent":"missing","location":"kitchen"}`))
+
+	ids := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		_, rest, ok := strings.Cut(line, "[req=")
+		id, _, _ := strings.Cut(rest, "]")
+		if !ok || id == "" {
+			t.Errorf("log line %q has no request ID", line)
+			continue
+		}
+		ids[id] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("got request IDs %v, want one per message", ids)
+	}
+}
+
+func TestShutdownWaitsForPlaysAndGoesOffline(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+
+	// Stands in for a play still talking to the speaker
+	if !s.c.trackPlay() {
+		t.Fatal("trackPlay refused before shutdown")
+	}
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(released)
+		s.c.plays.Done()
+	}()
+
+	if err := s.c.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-released:
+	default:
+		t.Error("Shutdown returned before the in-flight play finished")
+	}
+	statuses := client.PublishedTo(mqttStatusTopic)
+	if len(statuses) != 1 || string(statuses[0].Payload) != mqttStatusOffline || !statuses[0].Retained {
+		t.Errorf("status messages = %+v, want one retained %q", statuses, mqttStatusOffline)
+	}
+	if client.IsConnected() {
+		t.Error("MQTT still connected after Shutdown")
+	}
+
+	status, data := s.do(t, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen"})
+	if status != http.StatusServiceUnavailable || !strings.Contains(string(data), "shutting down") {
+		t.Errorf("play after shutdown = %d %s, want 503 shutting down", status, data)
+	}
+}
+
+func TestShuttingDownRefusesQueueAddsAndChains(t *testing.T) {
+	s := newTestServer(t)
+	s.useMockMQTT(t)
+	if err := s.c.db.CreateChain("wake", []ChainStep{{Intent: "morning", Location: "kitchen"}}); err != nil {
+		t.Fatalf("CreateChain: %v", err)
+	}
+	// What Shutdown sets before it stops chains and closes the database
+	s.c.playsMu.Lock()
+	s.c.shuttingDown = true
+	s.c.playsMu.Unlock()
+
+	status, data := s.do(t, http.MethodPost, "/api/v1/locations/kitchen/queue", QueueRequest{Intent: "morning"})
+	if status != http.StatusServiceUnavailable || !strings.Contains(string(data), "shutting down") {
+		t.Errorf("queue add after shutdown = %d %s, want 503 shutting down", status, data)
+	}
+	status, data = s.do(t, http.MethodPost, "/api/v1/chains/wake/run", nil)
+	if status != http.StatusServiceUnavailable || !strings.Contains(string(data), "shutting down") {
+		t.Errorf("chain run after shutdown = %d %s, want 503 shutting down", status, data)
+	}
+	if s.c.chainRunning("wake") {
+		t.Error("chain registered as running after shutdown")
+	}
+}
+
+func TestShutdownGivesUpOnStuckPlays(t *testing.T) {
+	c := newTestCoordinator(t)
+	c.trackPlay()
+	defer c.plays.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want a deadline error", err)
+	}
+}
+
+func TestPlayFailsWhenPublishFails(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+	client.PublishErr = errors.New("broker unavailable")
+
+	if status, data := s.do(t, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen"}); status == http.StatusOK {
+		t.Errorf("play succeeded although the publish failed: %s", data)
+	}
+}
+
+func TestPlayTimesOutWhenPublishStalls(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+	client.PublishStalls = true
+	s.c.config.PlayTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	status, data := s.do(t, http.MethodPost, "/api/v1/play", IntentRequest{Intent: "morning", Location: "kitchen"})
+	if status == http.StatusOK {
+		t.Errorf("play succeeded although the publish never completed: %s", data)
+	}
+	if !strings.Contains(string(data), "timed out") {
+		t.Errorf("response = %s, want a timeout error", data)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("play took %v, want it bounded by PLAY_TIMEOUT", elapsed)
+	}
+}
+
+func TestMQTTWaitsAreBoundedWhenTheBrokerStalls(t *testing.T) {
+	s := newTestServer(t)
+	client := s.useMockMQTT(t)
+	client.PublishStalls = true
+	s.c.config.PlayTimeout = 50 * time.Millisecond
+
+	// Both the play_media and the confirmation on mqttPlayedTopic stall
+	start := time.Now()
+	client.Deliver(mqttPlayTopic, []byte(`{"intent":"morning","location":"kitchen"}`))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("MQTT play request took %v, want it bounded by PLAY_TIMEOUT", elapsed)
+	}
+
+	client.SubscribeStalls = true
+	start = time.Now()
+	if err := s.c.subscribeToPlayRequests(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("subscribeToPlayRequests = %v, want a timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("subscribe took %v, want it bounded by PLAY_TIMEOUT", elapsed)
+	}
+}
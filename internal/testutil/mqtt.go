@@ -0,0 +1,179 @@
+// Package testutil holds fakes for the coordinator's external dependencies
+package testutil
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Message is one Publish call recorded by MockMQTTClient
+type Message struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  []byte
+}
+
+// MockMQTTClient stands in for the paho client. It records every published
+// message and hands messages passed to Deliver to the subscribed handlers.
+type MockMQTTClient struct {
+	mu        sync.Mutex
+	published []Message
+	handlers  map[string]mqtt.MessageHandler // by topic filter
+	connected bool
+
+	// PublishErr, when set, is returned by every Publish
+	PublishErr error
+	// PublishStalls makes every Publish return a token that never completes,
+	// like a broker that stopped acknowledging
+	PublishStalls bool
+	// SubscribeStalls does the same for every Subscribe
+	SubscribeStalls bool
+}
+
+// NewMockMQTTClient returns a connected client with nothing published yet
+func NewMockMQTTClient() *MockMQTTClient {
+	return &MockMQTTClient{handlers: make(map[string]mqtt.MessageHandler), connected: true}
+}
+
+func (m *MockMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		return &token{err: fmt.Errorf("unknown payload type %T", payload)}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.PublishErr != nil {
+		return &token{err: m.PublishErr}
+	}
+	if m.PublishStalls {
+		return stalledToken{}
+	}
+	m.published = append(m.published, Message{Topic: topic, QoS: qos, Retained: retained, Payload: data})
+	return &token{}
+}
+
+func (m *MockMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.SubscribeStalls {
+		return stalledToken{}
+	}
+	m.handlers[topic] = callback
+	return &token{}
+}
+
+func (m *MockMQTTClient) IsConnected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connected
+}
+
+func (m *MockMQTTClient) Disconnect(quiesce uint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected = false
+}
+
+// Published returns the messages published so far, oldest first
+func (m *MockMQTTClient) Published() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.published...)
+}
+
+// PublishedTo returns the messages published to topic, oldest first
+func (m *MockMQTTClient) PublishedTo(topic string) []Message {
+	var messages []Message
+	for _, msg := range m.Published() {
+		if msg.Topic == topic {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// Deliver calls the handler subscribed to a filter matching topic, as the
+// broker would, and reports whether there was one
+func (m *MockMQTTClient) Deliver(topic string, payload []byte) bool {
+	m.mu.Lock()
+	var handler mqtt.MessageHandler
+	for filter, h := range m.handlers {
+		if matchTopic(filter, topic) {
+			handler = h
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if handler == nil {
+		return false
+	}
+	handler(nil, &message{topic: topic, payload: payload})
+	return true
+}
+
+// matchTopic reports whether topic matches an MQTT filter with + and # wildcards
+func matchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// token is an mqtt.Token that has already completed
+type token struct {
+	err error
+}
+
+func (t *token) Wait() bool                     { return true }
+func (t *token) WaitTimeout(time.Duration) bool { return true }
+func (t *token) Error() error                   { return t.err }
+
+func (t *token) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// stalledToken is an mqtt.Token that never completes
+type stalledToken struct{}
+
+func (stalledToken) Wait() bool { select {} }
+func (stalledToken) WaitTimeout(d time.Duration) bool {
+	time.Sleep(d)
+	return false
+}
+func (stalledToken) Error() error          { return nil }
+func (stalledToken) Done() <-chan struct{} { return nil }
+
+// message is a received mqtt.Message
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return 0 }
+func (m *message) Retained() bool    { return false }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
@@ -1,62 +1,660 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
+	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"log"
-	"math/rand"
+	"math"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	defaultPort         = "8080"
 	defaultDBPath       = "./music_coordinator.db"
-	defaultHAURL        = "http://homeassistant.local:8123"
+	defaultHAURL        = "" // Home Assistant features are off until HA_URL is set
 	defaultHAToken      = ""
-	defaultMAAPIURL     = "http://localhost:8097"
+	defaultMAAPIURL     = "" // Music Assistant is optional
 	defaultMQTTBroker   = "tcp://localhost:1883"
 	defaultMQTTUser     = ""
 	defaultMQTTPass     = ""
 	defaultMQTTClientID = "music-coordinator"
+	mqttFailoverTimeout = 10 * time.Second
+	defaultHTTPSPort    = "8443"
 	mqttPlayTopic       = "music-coordinator/play"
+	mqttPlayedTopic     = "music-coordinator/played"
+	mqttPlayRouteTopic  = mqttPlayTopic + "/+/+" // music-coordinator/play/{intent}/{location}
+	mqttControlTopic    = "music-coordinator/control"
+	mqttStatusTopic     = "music-coordinator/status" // retained online/offline, offline is also the will
 	mqttHATopic         = "homeassistant/service/mass/play_media"
 	mediaPlayerPrefix   = "media_player."
+	requestIDHeader     = "X-Request-ID"
+
+	playTransportMQTT   = "mqtt"
+	playTransportMAHTTP = "ma_http"
+	playTransportHAHTTP = "ha_http"
+
+	defaultHTTPReadTimeout       = 15 * time.Second
+	defaultHTTPWriteTimeout      = 30 * time.Second
+	defaultHTTPIdleTimeout       = 120 * time.Second
+	defaultHTTPReadHeaderTimeout = 5 * time.Second
+
+	defaultPlayTimeout = 5 * time.Second
+
+	defaultHAMediaPlayerCacheTTL = 60 * time.Second
+	defaultHAMaxRetries          = 3
+	haRetryBaseDelay             = 500 * time.Millisecond
+	haRequestTimeout             = 20 * time.Second
+	haWebhookRetryDelay          = 2 * time.Second
+	fanOutTimeout                = 20 * time.Second
+
+	defaultMQTTDedupWindowSeconds = 2
+	mqttDedupCacheSize            = 20
+
+	defaultFollowCooldownMs = 500
+
+	maSearchCacheTTL     = 30 * time.Second
+	maDurationTimeout    = 2 * time.Second
+	maDurationCacheTTL   = 10 * time.Minute
+	defaultMASearchLimit = 20
+
+	defaultRateLimitRPS   = 10.0
+	defaultRateLimitBurst = 20
+	rateLimitCleanupEvery = 5 * time.Minute
+	rateLimitStaleAfter   = 10 * time.Minute
+
+	gzipMinSize = 1024
+)
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.gitCommit=abc1234 -X main.buildTime=2024-01-01T00:00:00Z"
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildTime = "unknown"
 )
 
 type Config struct {
-	Port         string
-	DBPath       string
-	HAURL        string
-	HAToken      string
-	MAAPIURL     string
-	MQTTBroker   string
-	MQTTUser     string
-	MQTTPass     string
-	MQTTClientID string
+	Port    string
+	DBPath  string
+	HAURL   string
+	HAToken string
+	// HA webhook notified after every successful play; empty disables
+	HAPlayWebhookID string
+	MAAPIURL        string
+	MAToken         string
+	MQTTBroker      string
+	// Secondary broker tried when the primary doesn't connect within mqttFailoverTimeout
+	MQTTBrokerFallback string
+	MQTTUser           string
+	MQTTPass           string
+	MQTTClientID       string
+	AuthToken          string
+	// Ask HA for the speaker's state before playing and refuse if it is unavailable
+	CheckSpeakerAvailability bool
+	// Group multi-room speakers with media_player.join and play on the first one, instead of playing on each
+	UseHASpeakerGroups bool
+	// Trim and lowercase intent/location names on creation so "Morning" and "morning" can't coexist
+	NormalizeNames bool
+	// How play commands reach the speaker: mqtt, ma_http (MA player queue) or ha_http (HA service call)
+	PlayTransport string
+	UIDir         string // serve the UI from disk instead of the embedded copy; "none" serves no UI
+
+	// HTTPS: either a certificate/key pair or an autocert (Let's Encrypt) domain.
+	// While TLS is active, Port only redirects to HTTPSPort.
+	HTTPSPort      string
+	TLSCert        string
+	TLSKey         string
+	AutocertDomain string
+	AutocertCache  string
+
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	// Bounds each play-path call: the MQTT publish and every HA and MA HTTP request
+	PlayTimeout time.Duration
+
+	HAMediaPlayerCacheTTL time.Duration
+	HAMaxRetries          int
+
+	// Drop MQTT payloads identical to one received this many seconds ago; 0 disables
+	MQTTDedupWindowSeconds int
+
+	// Pause between stopping the old speaker and starting the new one on a
+	// follow, so HA has seen the stop before the play arrives
+	FollowCooldownMs int
+
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPReadHeaderTimeout time.Duration
+}
+
+// configFile mirrors Config for the optional YAML file named by CONFIG_FILE
+type configFile struct {
+	Port               string `yaml:"port"`
+	DBPath             string `yaml:"db_path"`
+	HAURL              string `yaml:"ha_url"`
+	HAToken            string `yaml:"ha_api_token"`
+	HAPlayWebhookID    string `yaml:"ha_play_webhook_id"`
+	MAAPIURL           string `yaml:"ma_api_url"`
+	MAToken            string `yaml:"ma_api_token"`
+	MQTTBroker         string `yaml:"mqtt_broker"`
+	MQTTBrokerFallback string `yaml:"mqtt_broker_fallback"`
+	MQTTUser           string `yaml:"mqtt_user"`
+	MQTTPass           string `yaml:"mqtt_pass"`
+	MQTTClientID       string `yaml:"mqtt_client_id"`
+	AuthToken          string `yaml:"auth_token"`
+
+	CheckSpeakerAvailability string `yaml:"check_speaker_availability"`
+	UseHASpeakerGroups       string `yaml:"use_ha_speaker_groups"`
+	NormalizeNames           string `yaml:"normalize_names"`
+	PlayTransport            string `yaml:"play_transport"`
+	UIDir                    string `yaml:"ui_dir"`
+
+	HTTPSPort      string `yaml:"https_port"`
+	TLSCert        string `yaml:"http_tls_cert"`
+	TLSKey         string `yaml:"http_tls_key"`
+	AutocertDomain string `yaml:"http_autocert_domain"`
+	AutocertCache  string `yaml:"http_autocert_cache_dir"`
+
+	RateLimitRPS   string `yaml:"rate_limit_rps"`
+	RateLimitBurst string `yaml:"rate_limit_burst"`
+
+	PlayTimeout string `yaml:"play_timeout"`
+
+	HAMediaPlayerCacheTTL string `yaml:"ha_media_player_cache_ttl"`
+	HAMaxRetries          string `yaml:"ha_max_retries"`
+
+	MQTTDedupWindowSeconds string `yaml:"mqtt_dedup_window_seconds"`
+
+	FollowCooldownMs string `yaml:"follow_cooldown_ms"`
+
+	HTTPReadTimeout       string `yaml:"http_read_timeout"`
+	HTTPWriteTimeout      string `yaml:"http_write_timeout"`
+	HTTPIdleTimeout       string `yaml:"http_idle_timeout"`
+	HTTPReadHeaderTimeout string `yaml:"http_read_header_timeout"`
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var file configFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// LoadConfig builds a Config from defaults, then the CONFIG_FILE YAML (if set),
+// then environment variables, each layer overriding the previous one
+func LoadConfig() (*Config, error) {
+	file := &configFile{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		var err error
+		if file, err = loadConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	config := &Config{
+		Port:               getEnv("PORT", orDefault(file.Port, defaultPort)),
+		DBPath:             getEnv("DB_PATH", orDefault(file.DBPath, defaultDBPath)),
+		HAURL:              getEnv("HA_URL", orDefault(file.HAURL, defaultHAURL)),
+		HAToken:            getEnv("HA_API_TOKEN", orDefault(file.HAToken, defaultHAToken)),
+		HAPlayWebhookID:    getEnv("HA_PLAY_WEBHOOK_ID", file.HAPlayWebhookID),
+		MAAPIURL:           getEnv("MA_API_URL", orDefault(file.MAAPIURL, defaultMAAPIURL)),
+		MAToken:            getEnv("MA_API_TOKEN", file.MAToken),
+		MQTTBroker:         getEnv("MQTT_BROKER", orDefault(file.MQTTBroker, defaultMQTTBroker)),
+		MQTTBrokerFallback: getEnv("MQTT_BROKER_FALLBACK", file.MQTTBrokerFallback),
+		MQTTUser:           getEnv("MQTT_USER", orDefault(file.MQTTUser, defaultMQTTUser)),
+		MQTTPass:           getEnv("MQTT_PASS", orDefault(file.MQTTPass, defaultMQTTPass)),
+		MQTTClientID:       getEnv("MQTT_CLIENT_ID", orDefault(file.MQTTClientID, defaultMQTTClientID)),
+		AuthToken:          getEnv("AUTH_TOKEN", file.AuthToken),
+		PlayTransport:      getEnv("PLAY_TRANSPORT", orDefault(file.PlayTransport, playTransportMQTT)),
+		UIDir:              getEnv("UI_DIR", file.UIDir),
+
+		HTTPSPort:      getEnv("HTTPS_PORT", orDefault(file.HTTPSPort, defaultHTTPSPort)),
+		TLSCert:        getEnv("HTTP_TLS_CERT", file.TLSCert),
+		TLSKey:         getEnv("HTTP_TLS_KEY", file.TLSKey),
+		AutocertDomain: getEnv("HTTP_AUTOCERT_DOMAIN", file.AutocertDomain),
+		AutocertCache:  getEnv("HTTP_AUTOCERT_CACHE_DIR", file.AutocertCache),
+	}
+	if config.AutocertCache == "" {
+		config.AutocertCache = filepath.Join(filepath.Dir(config.DBPath), "autocert")
+	}
+
+	durations := []struct {
+		env, fileValue string
+		fallback       time.Duration
+		dest           *time.Duration
+	}{
+		{"PLAY_TIMEOUT", file.PlayTimeout, defaultPlayTimeout, &config.PlayTimeout},
+		{"HA_MEDIA_PLAYER_CACHE_TTL", file.HAMediaPlayerCacheTTL, defaultHAMediaPlayerCacheTTL, &config.HAMediaPlayerCacheTTL},
+		{"HTTP_READ_TIMEOUT", file.HTTPReadTimeout, defaultHTTPReadTimeout, &config.HTTPReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", file.HTTPWriteTimeout, defaultHTTPWriteTimeout, &config.HTTPWriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", file.HTTPIdleTimeout, defaultHTTPIdleTimeout, &config.HTTPIdleTimeout},
+		{"HTTP_READ_HEADER_TIMEOUT", file.HTTPReadHeaderTimeout, defaultHTTPReadHeaderTimeout, &config.HTTPReadHeaderTimeout},
+	}
+	for _, d := range durations {
+		value, err := parseDuration(getEnv(d.env, d.fileValue), d.fallback)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", d.env, err)
+		}
+		*d.dest = value
+	}
+
+	var err error
+	if config.CheckSpeakerAvailability, err = parseBool(getEnv("CHECK_SPEAKER_AVAILABILITY", file.CheckSpeakerAvailability), false); err != nil {
+		return nil, fmt.Errorf("invalid CHECK_SPEAKER_AVAILABILITY: %w", err)
+	}
+	if config.UseHASpeakerGroups, err = parseBool(getEnv("USE_HA_SPEAKER_GROUPS", file.UseHASpeakerGroups), false); err != nil {
+		return nil, fmt.Errorf("invalid USE_HA_SPEAKER_GROUPS: %w", err)
+	}
+	if config.NormalizeNames, err = parseBool(getEnv("NORMALIZE_NAMES", file.NormalizeNames), true); err != nil {
+		return nil, fmt.Errorf("invalid NORMALIZE_NAMES: %w", err)
+	}
+	if config.RateLimitRPS, err = parseFloat(getEnv("RATE_LIMIT_RPS", file.RateLimitRPS), defaultRateLimitRPS); err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_RPS: %w", err)
+	}
+	if config.RateLimitBurst, err = parseInt(getEnv("RATE_LIMIT_BURST", file.RateLimitBurst), defaultRateLimitBurst); err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BURST: %w", err)
+	}
+	if config.HAMaxRetries, err = parseInt(getEnv("HA_MAX_RETRIES", file.HAMaxRetries), defaultHAMaxRetries); err != nil {
+		return nil, fmt.Errorf("invalid HA_MAX_RETRIES: %w", err)
+	}
+	if config.MQTTDedupWindowSeconds, err = parseInt(getEnv("MQTT_DEDUP_WINDOW_SECONDS", file.MQTTDedupWindowSeconds), defaultMQTTDedupWindowSeconds); err != nil {
+		return nil, fmt.Errorf("invalid MQTT_DEDUP_WINDOW_SECONDS: %w", err)
+	}
+	if config.FollowCooldownMs, err = parseInt(getEnv("FOLLOW_COOLDOWN_MS", file.FollowCooldownMs), defaultFollowCooldownMs); err != nil {
+		return nil, fmt.Errorf("invalid FOLLOW_COOLDOWN_MS: %w", err)
+	}
+
+	return config, nil
+}
+
+// parseFloat parses value as a float64, returning fallback when value is empty
+func parseFloat(value string, fallback float64) (float64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// parseBool parses value as a bool, returning fallback when value is empty
+func parseBool(value string, fallback bool) (bool, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// parseInt parses value as an int, returning fallback when value is empty
+func parseInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseDuration parses a Go duration string, returning fallback when value is empty
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Validate checks every setting and returns all problems found, so a misconfigured
+// deployment can be fixed in one pass
+func (c *Config) Validate() []error {
+	var errs []error
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT (config file key \"port\") must be a number between 1 and 65535, got %q", c.Port))
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("HTTP_TLS_CERT and HTTP_TLS_KEY must be set together"))
+	}
+	if c.AutocertDomain != "" && c.TLSCert != "" {
+		errs = append(errs, fmt.Errorf("HTTP_AUTOCERT_DOMAIN cannot be combined with HTTP_TLS_CERT/HTTP_TLS_KEY"))
+	}
+	if c.TLSEnabled() {
+		if port, err := strconv.Atoi(c.HTTPSPort); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("HTTPS_PORT must be a number between 1 and 65535, got %q", c.HTTPSPort))
+		} else if c.HTTPSPort == c.Port {
+			errs = append(errs, fmt.Errorf("HTTPS_PORT must differ from PORT while TLS is enabled"))
+		}
+	}
+
+	switch c.PlayTransport {
+	case playTransportMQTT, playTransportMAHTTP, playTransportHAHTTP:
+	default:
+		errs = append(errs, fmt.Errorf("PLAY_TRANSPORT must be one of %s, %s or %s, got %q", playTransportMQTT, playTransportMAHTTP, playTransportHAHTTP, c.PlayTransport))
+	}
+
+	// An empty MA_API_URL only disables the Music Assistant integration (main
+	// warns about it), unless plays are meant to go through MA
+	if c.MAAPIURL == "" {
+		if c.PlayTransport == playTransportMAHTTP {
+			errs = append(errs, fmt.Errorf("MA_API_URL (config file key \"ma_api_url\") is required with PLAY_TRANSPORT=%s", playTransportMAHTTP))
+		}
+	} else if u, err := url.Parse(c.MAAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("MA_API_URL %q must be a valid http:// or https:// URL", c.MAAPIURL))
+	}
+
+	if c.MQTTBroker == "" {
+		errs = append(errs, fmt.Errorf("MQTT_BROKER (config file key \"mqtt_broker\") is required"))
+	} else if err := validateBrokerAddress(c.MQTTBroker); err != nil {
+		errs = append(errs, fmt.Errorf("MQTT_BROKER %q is invalid: %w", c.MQTTBroker, err))
+	}
+	if c.MQTTBrokerFallback != "" {
+		if err := validateBrokerAddress(c.MQTTBrokerFallback); err != nil {
+			errs = append(errs, fmt.Errorf("MQTT_BROKER_FALLBACK %q is invalid: %w", c.MQTTBrokerFallback, err))
+		}
+	}
+
+	// Without HA_URL only the features that need Home Assistant are unavailable
+	// (main warns); the settings below can't work at all without it
+	if c.HAURL == "" {
+		for _, needsHA := range []struct {
+			enabled bool
+			setting string
+		}{
+			{c.PlayTransport == playTransportHAHTTP, "PLAY_TRANSPORT=" + playTransportHAHTTP},
+			{c.CheckSpeakerAvailability, "CHECK_SPEAKER_AVAILABILITY"},
+			{c.UseHASpeakerGroups, "USE_HA_SPEAKER_GROUPS"},
+			{c.HAPlayWebhookID != "", "HA_PLAY_WEBHOOK_ID"},
+		} {
+			if needsHA.enabled {
+				errs = append(errs, fmt.Errorf("HA_URL (config file key \"ha_url\") is required with %s", needsHA.setting))
+			}
+		}
+	} else if u, err := url.Parse(c.HAURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("HA_URL %q must be a valid http:// or https:// URL", c.HAURL))
+	}
+
+	if c.RateLimitRPS <= 0 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_RPS must be greater than 0, got %v", c.RateLimitRPS))
+	}
+	if c.RateLimitBurst < 1 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_BURST must be at least 1, got %d", c.RateLimitBurst))
+	}
+	if c.PlayTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("PLAY_TIMEOUT must be greater than 0, got %v", c.PlayTimeout))
+	}
+	if c.HAMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("HA_MAX_RETRIES must not be negative, got %d", c.HAMaxRetries))
+	}
+	if c.MQTTDedupWindowSeconds < 0 {
+		errs = append(errs, fmt.Errorf("MQTT_DEDUP_WINDOW_SECONDS must not be negative, got %d", c.MQTTDedupWindowSeconds))
+	}
+	if c.FollowCooldownMs < 0 {
+		errs = append(errs, fmt.Errorf("FOLLOW_COOLDOWN_MS must not be negative, got %d", c.FollowCooldownMs))
+	}
+
+	if c.DBPath == "" {
+		errs = append(errs, fmt.Errorf("DB_PATH (config file key \"db_path\") is required"))
+	} else if err := checkDirWritable(filepath.Dir(c.DBPath)); err != nil {
+		errs = append(errs, fmt.Errorf("DB_PATH directory is not writable: %w", err))
+	}
+
+	return errs
+}
+
+// TLSEnabled reports whether the API is served over HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.AutocertDomain != "" || (c.TLSCert != "" && c.TLSKey != "")
+}
+
+// validateBrokerAddress accepts "scheme://host:port" or a bare "host:port"
+func validateBrokerAddress(broker string) error {
+	hostPort := broker
+	if strings.Contains(broker, "://") {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return err
+		}
+		hostPort = u.Host
+		// WebSocket brokers may leave the port to the scheme and add a path
+		if port, ok := mqttWebsocketPorts[u.Scheme]; ok && u.Port() == "" {
+			hostPort = net.JoinHostPort(u.Hostname(), port)
+		}
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return fmt.Errorf("expected host:port: %w", err)
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// checkDirWritable verifies dir exists and a file can be created in it
+func checkDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// restartRequiredChanges lists settings that differ between prev and next but only
+// take effect on a fresh connection (and therefore a restart)
+func restartRequiredChanges(prev, next *Config) []string {
+	var changed []string
+	check := func(name string, a, b interface{}) {
+		if a != b {
+			changed = append(changed, name)
+		}
+	}
+	check("PORT", prev.Port, next.Port)
+	check("DB_PATH", prev.DBPath, next.DBPath)
+	check("HA_URL", prev.HAURL, next.HAURL)
+	check("MA_API_URL", prev.MAAPIURL, next.MAAPIURL)
+	check("MQTT_BROKER", prev.MQTTBroker, next.MQTTBroker)
+	check("MQTT_BROKER_FALLBACK", prev.MQTTBrokerFallback, next.MQTTBrokerFallback)
+	check("MQTT_USER", prev.MQTTUser, next.MQTTUser)
+	check("MQTT_PASS", prev.MQTTPass, next.MQTTPass)
+	check("MQTT_CLIENT_ID", prev.MQTTClientID, next.MQTTClientID)
+	check("UI_DIR", prev.UIDir, next.UIDir)
+	check("PLAY_TIMEOUT", prev.PlayTimeout, next.PlayTimeout)
+	check("HTTPS_PORT", prev.HTTPSPort, next.HTTPSPort)
+	check("HTTP_TLS_CERT", prev.TLSCert, next.TLSCert)
+	check("HTTP_TLS_KEY", prev.TLSKey, next.TLSKey)
+	check("HTTP_AUTOCERT_DOMAIN", prev.AutocertDomain, next.AutocertDomain)
+	check("HTTP_AUTOCERT_CACHE_DIR", prev.AutocertCache, next.AutocertCache)
+	check("HTTP_READ_TIMEOUT", prev.HTTPReadTimeout, next.HTTPReadTimeout)
+	check("HTTP_WRITE_TIMEOUT", prev.HTTPWriteTimeout, next.HTTPWriteTimeout)
+	check("HTTP_IDLE_TIMEOUT", prev.HTTPIdleTimeout, next.HTTPIdleTimeout)
+	check("HTTP_READ_HEADER_TIMEOUT", prev.HTTPReadHeaderTimeout, next.HTTPReadHeaderTimeout)
+	return changed
 }
 
 type IntentRequest struct {
-	Intent   string `json:"intent"`
-	Location string `json:"location"`
+	Intent    string   `json:"intent"`
+	Location  string   `json:"location"`
+	Locations []string `json:"locations,omitempty"` // multi-room play; takes precedence over Location
+	// Who asked for the play, stored on the intent as last_triggered_by. HTTP
+	// requests default to the client IP and MQTT requests to "mqtt".
+	TriggeredBy string `json:"triggered_by,omitempty"`
+	QueueMode   string `json:"queue_mode,omitempty"` // overrides the intent's queue_mode
+	// Playlist URI to play instead of one from the intent. Override plays are
+	// announced but not recorded in the intent's history.
+	PlaylistOverride string `json:"playlist_override,omitempty"`
+}
+
+// describe names what req plays, for messages and logs
+func (r IntentRequest) describe() string {
+	if r.Intent == "" {
+		return fmt.Sprintf("playlist '%s'", r.PlaylistOverride)
+	}
+	return fmt.Sprintf("intent '%s'", r.Intent)
+}
+
+// UnmarshalJSON also accepts "location" given as an array, treating it as Locations
+func (r *IntentRequest) UnmarshalJSON(data []byte) error {
+	// alias has IntentRequest's fields but not this method; the outer Location
+	// shadows its string one
+	type alias IntentRequest
+	*r = IntentRequest{}
+	raw := struct {
+		*alias
+		Location json.RawMessage `json:"location"`
+	}{alias: (*alias)(r)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw.Location) == 0 || string(raw.Location) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Location, &r.Location); err == nil {
+		return nil
+	}
+	var locations []string
+	if err := json.Unmarshal(raw.Location, &locations); err != nil {
+		return fmt.Errorf("location must be a string or an array of strings")
+	}
+	r.Locations = append(locations, r.Locations...)
+	return nil
 }
 
 type IntentResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Success       bool   `json:"success"`
+	Message       string `json:"message,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Playlist      string `json:"playlist,omitempty"`       // set on a successful play
+	SpeakerEntity string `json:"speaker_entity,omitempty"` // set on a successful play
+	// Playlist length according to Music Assistant, when it could tell
+	EstimatedDurationSeconds int `json:"estimated_duration_seconds,omitempty"`
+}
+
+// ValidationError is a problem with one field of a request
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every invalid field in a request, so clients can
+// flag them all at once rather than one per attempt
+type ValidationErrors []ValidationError
+
+func (v *ValidationErrors) add(field, message string) {
+	*v = append(*v, ValidationError{Field: field, Message: message})
+}
+
+func (v ValidationErrors) Error() string {
+	parts := make([]string, len(v))
+	for i, e := range v {
+		parts[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// err returns v as an error, or nil when nothing was added
+func (v ValidationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// ValidationResponse is the 400 body for a request with invalid fields; error
+// repeats them as one message for clients that don't read validation_errors
+type ValidationResponse struct {
+	Success          bool             `json:"success"`
+	Error            string           `json:"error"`
+	ValidationErrors ValidationErrors `json:"validation_errors"`
 }
 
 type Database struct {
 	db *sql.DB
+
+	// stmts caches statements for queries run on every play, keyed by name
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
+
+	// normalizeNames makes CreateIntent and CreateLocation store trimmed, lowercase names
+	normalizeNames atomic.Bool
+}
+
+// prepare returns the cached statement for key, preparing query the first time
+func (d *Database) prepare(key, query string) (*sql.Stmt, error) {
+	d.stmtsMu.Lock()
+	defer d.stmtsMu.Unlock()
+	if stmt, ok := d.stmts[key]; ok {
+		return stmt, nil
+	}
+	stmt, err := d.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare %s: %w", key, err)
+	}
+	d.stmts[key] = stmt
+	return stmt, nil
+}
+
+// SetNormalizeNames turns name normalization on creation on or off
+func (d *Database) SetNormalizeNames(enabled bool) {
+	d.normalizeNames.Store(enabled)
+}
+
+// normalizeName returns name as it will be stored, trimmed and lowercased when
+// normalization is enabled, and logs when that changes what was submitted
+func (d *Database) normalizeName(name string) string {
+	if !d.normalizeNames.Load() {
+		return name
+	}
+	normalized := strings.ToLower(strings.TrimSpace(name))
+	if normalized != name {
+		log.Printf("[DB] Warning: name %q normalized to %q", name, normalized)
+	}
+	return normalized
 }
 
 func NewDatabase(dbPath string) (*Database, error) {
@@ -65,6 +663,11 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	// Every connection to :memory: opens a separate, empty database, so keep to one
+	if dbPath == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
@@ -74,19 +677,37 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
 	}
 
-	database := &Database{db: db}
+	database := &Database{db: db, stmts: make(map[string]*sql.Stmt)}
 	if err := database.InitSchema(); err != nil {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
-	// Clean up orphaned playlist_group_item entries
-	if err := database.CleanupOrphanedPlaylistItems(); err != nil {
-		log.Printf("[DB] Warning: Failed to cleanup orphaned playlist items: %v", err)
-	}
+	// Clean up orphaned playlist_group_item entries and intent group references;
+	// the coordinator repeats this once a day (runOrphanCleanup)
+	database.cleanupOrphans()
 
 	return database, nil
 }
 
+// orphanCleanupInterval is how often playlist_group_item rows and intent group
+// references left behind by a missed CASCADE (e.g. an import with foreign keys
+// off) are swept
+const orphanCleanupInterval = 24 * time.Hour
+
+// cleanupOrphans runs both orphan cleanups, logging failures, and reports
+// whether either changed any rows
+func (d *Database) cleanupOrphans() bool {
+	removed, err := d.CleanupOrphanedPlaylistItems()
+	if err != nil {
+		log.Printf("[DB] Warning: Failed to cleanup orphaned playlist items: %v", err)
+	}
+	cleared, err := d.CleanupOrphanedIntentGroupRefs()
+	if err != nil {
+		log.Printf("[DB] Warning: Failed to cleanup orphaned intent group references: %v", err)
+	}
+	return removed > 0 || cleared > 0
+}
+
 func (d *Database) InitSchema() error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS intent (
@@ -117,10 +738,55 @@ func (d *Database) InitSchema() error {
 			FOREIGN KEY (group_name) REFERENCES playlist_group(name) ON DELETE CASCADE,
 			UNIQUE(group_name, playlist)
 		)`,
+		`CREATE TABLE IF NOT EXISTS play_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			intent_name TEXT NOT NULL,
+			location_name TEXT NOT NULL,
+			playlist TEXT NOT NULL,
+			triggered_via TEXT NOT NULL,
+			played_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS chains (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS chain_step (
+			chain_id INTEGER NOT NULL,
+			step_order INTEGER NOT NULL,
+			intent_name TEXT NOT NULL,
+			location_name TEXT NOT NULL,
+			delay_seconds INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (chain_id) REFERENCES chains(id) ON DELETE CASCADE,
+			PRIMARY KEY (chain_id, step_order)
+		)`,
+		`CREATE TABLE IF NOT EXISTS volume_profile (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			location_name TEXT NOT NULL,
+			start_time TIME NOT NULL,
+			end_time TIME NOT NULL,
+			volume REAL NOT NULL,
+			FOREIGN KEY (location_name) REFERENCES location(name) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			operation TEXT NOT NULL,
+			entity_type TEXT NOT NULL,
+			entity_name TEXT NOT NULL,
+			changed_by TEXT NOT NULL,
+			changed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			old_value JSON,
+			new_value JSON
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_intent_name ON intent(name)`,
 		`CREATE INDEX IF NOT EXISTS idx_location_name ON location(name)`,
 		`CREATE INDEX IF NOT EXISTS idx_playlist_group_name ON playlist_group(name)`,
 		`CREATE INDEX IF NOT EXISTS idx_playlist_group_item_group ON playlist_group_item(group_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_play_history_played_at ON play_history(played_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_play_history_intent ON play_history(intent_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_play_history_location ON play_history(location_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_volume_profile_location ON volume_profile(location_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_entity_type ON audit_log(entity_type)`,
 	}
 
 	for _, query := range queries {
@@ -132,29 +798,151 @@ func (d *Database) InitSchema() error {
 	return d.migrateSchema()
 }
 
+// migration is one versioned schema change. down undoes up, so the schema can
+// be rolled back to an earlier version.
+type migration struct {
+	version int
+	up      string
+	down    string
+}
+
+// migrations run in order on top of the tables InitSchema creates; the version
+// applied last is stored in PRAGMA user_version. Append new steps, never edit
+// or reorder existing ones.
+var migrations = []migration{
+	{1, `ALTER TABLE intent ADD COLUMN playlist_group TEXT`, `ALTER TABLE intent DROP COLUMN playlist_group`},
+	{2, `ALTER TABLE intent ADD COLUMN last_played_at DATETIME`, `ALTER TABLE intent DROP COLUMN last_played_at`},
+	{3, `ALTER TABLE intent ADD COLUMN play_count INTEGER DEFAULT 0`, `ALTER TABLE intent DROP COLUMN play_count`},
+	{4, `ALTER TABLE intent ADD COLUMN selection_mode TEXT DEFAULT '` + selectionModeRandom + `'`, `ALTER TABLE intent DROP COLUMN selection_mode`},
+	{5, `ALTER TABLE intent ADD COLUMN active_start TIME`, `ALTER TABLE intent DROP COLUMN active_start`},
+	{6, `ALTER TABLE intent ADD COLUMN active_end TIME`, `ALTER TABLE intent DROP COLUMN active_end`},
+	{7, `ALTER TABLE intent ADD COLUMN timezone TEXT DEFAULT '` + defaultIntentTimezone + `'`, `ALTER TABLE intent DROP COLUMN timezone`},
+	{8, `ALTER TABLE playlist_group_item ADD COLUMN cover_art_url TEXT`, `ALTER TABLE playlist_group_item DROP COLUMN cover_art_url`},
+	{9, `ALTER TABLE intent ADD COLUMN last_triggered_by TEXT`, `ALTER TABLE intent DROP COLUMN last_triggered_by`},
+	{10, `ALTER TABLE location ADD COLUMN ha_url TEXT`, `ALTER TABLE location DROP COLUMN ha_url`},
+	{11, `ALTER TABLE location ADD COLUMN ha_token TEXT`, `ALTER TABLE location DROP COLUMN ha_token`},
+	{12, `ALTER TABLE location ADD COLUMN display_name TEXT`, `ALTER TABLE location DROP COLUMN display_name`},
+	{13, `ALTER TABLE location ADD COLUMN description TEXT`, `ALTER TABLE location DROP COLUMN description`},
+	{14, `ALTER TABLE playlist_group ADD COLUMN tags TEXT`, `ALTER TABLE playlist_group DROP COLUMN tags`},
+	{15, `ALTER TABLE intent ADD COLUMN queue_mode TEXT DEFAULT '` + queueModeReplace + `'`, `ALTER TABLE intent DROP COLUMN queue_mode`},
+}
+
+// latestSchemaVersion is the version migrateSchema brings the database to
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
 func (d *Database) migrateSchema() error {
-	var count int
-	err := d.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('intent') WHERE name = 'playlist_group'`).Scan(&count)
-	if err == nil && count > 0 {
-		return nil
+	return d.MigrateToVersion(latestSchemaVersion())
+}
+
+// SchemaVersion returns the version of the last migration applied
+func (d *Database) SchemaVersion() (int, error) {
+	var version int
+	if err := d.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
 	}
+	return version, nil
+}
 
-	_, err = d.db.Exec(`ALTER TABLE intent ADD COLUMN playlist_group TEXT`)
+// MigrateToVersion applies up migrations until the schema is at targetVersion,
+// or rolls back to it if the schema is already newer
+func (d *Database) MigrateToVersion(targetVersion int) error {
+	if targetVersion < 0 || targetVersion > latestSchemaVersion() {
+		return fmt.Errorf("schema version must be between 0 and %d, got %d", latestSchemaVersion(), targetVersion)
+	}
+	current, err := d.SchemaVersion()
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate column") || strings.Contains(err.Error(), "already exists") {
-			return nil
+		return err
+	}
+	if targetVersion < current {
+		return d.RollbackToVersion(targetVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > targetVersion {
+			continue
 		}
-		return fmt.Errorf("failed to add playlist_group column: %w", err)
+		err := d.applyMigration(m.up, m.version)
+		if err != nil && strings.Contains(err.Error(), "duplicate column") {
+			// Databases from before versioning already have the column at version 0
+			_, err = d.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", m.version, err)
+		}
+		log.Printf("[DB] Migrated schema to version %d", m.version)
+	}
+	return nil
+}
+
+// RollbackToVersion applies down migrations in reverse order, newest first,
+// until the schema is at targetVersion
+func (d *Database) RollbackToVersion(targetVersion int) error {
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if targetVersion < 0 || targetVersion > current {
+		return fmt.Errorf("cannot roll back from version %d to %d", current, targetVersion)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= targetVersion {
+			continue
+		}
+		if err := d.applyMigration(m.down, m.version-1); err != nil {
+			return fmt.Errorf("failed to roll back migration %d: %w", m.version, err)
+		}
+		log.Printf("[DB] Rolled schema back to version %d", m.version-1)
+	}
+	return nil
+}
+
+// applyMigration runs query and records version in one transaction. Cached
+// statements are dropped since they may refer to columns that changed.
+func (d *Database) applyMigration(query string, version int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.resetStmts()
 	return nil
 }
 
-// GetIntentPlaylist returns a randomly selected playlist from the intent's playlist group
+// resetStmts closes and forgets every cached statement
+func (d *Database) resetStmts() {
+	d.stmtsMu.Lock()
+	defer d.stmtsMu.Unlock()
+	for key, stmt := range d.stmts {
+		stmt.Close()
+		delete(d.stmts, key)
+	}
+}
+
+// GetIntentPlaylist returns a playlist from the intent's playlists or group, chosen
+// by its selection mode. It doesn't check the active window; plays do that with
+// CheckIntentActive first.
 func (d *Database) GetIntentPlaylist(intentName string) (string, error) {
 	var playlistData string
-	var playlistGroup sql.NullString
-	err := d.db.QueryRow("SELECT playlist, playlist_group FROM intent WHERE name = ?", intentName).
-		Scan(&playlistData, &playlistGroup)
+	var playlistGroup, selectionMode sql.NullString
+	stmt, err := d.prepare("intent_playlist", "SELECT playlist, playlist_group, selection_mode FROM intent WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1")
+	if err != nil {
+		return "", err
+	}
+	err = stmt.QueryRow(intentName, intentName).Scan(&playlistData, &playlistGroup, &selectionMode)
 	if err == sql.ErrNoRows {
 		return "", fmt.Errorf("intent '%s' not found", intentName)
 	}
@@ -163,1003 +951,6983 @@ func (d *Database) GetIntentPlaylist(intentName string) (string, error) {
 	}
 
 	// Check if using a playlist group
+	var playlists []string
 	if playlistGroup.Valid && playlistGroup.String != "" {
-		playlists, err := d.GetGroupPlaylists(playlistGroup.String)
+		playlists, err = d.GetGroupPlaylists(playlistGroup.String)
 		if err != nil {
 			return "", fmt.Errorf("failed to get group playlists: %w", err)
 		}
-		return selectRandomPlaylist(playlists)
+	} else {
+		// Parse and select from direct playlists
+		playlists = parsePlaylists(playlistData)
 	}
 
-	// Parse and select from direct playlists
-	playlists := parsePlaylists(playlistData)
+	if selectionMode.String == selectionModeLeastRecentlyPlayed {
+		return d.selectLeastRecentlyPlayed(playlists)
+	}
 	return selectRandomPlaylist(playlists)
 }
 
-func (d *Database) GetLocationSpeaker(locationName string) (string, error) {
-	var speakerEntity string
-	err := d.db.QueryRow("SELECT speaker_entity FROM location WHERE name = ?", locationName).Scan(&speakerEntity)
+// CheckIntentActive returns an error wrapping ErrOutsideActiveWindow if now is
+// outside the intent's active window
+func (d *Database) CheckIntentActive(intentName string, now time.Time) error {
+	var activeStart, activeEnd, timezone sql.NullString
+	stmt, err := d.prepare("intent_window", "SELECT active_start, active_end, timezone FROM intent WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1")
+	if err != nil {
+		return err
+	}
+	err = stmt.QueryRow(intentName, intentName).Scan(&activeStart, &activeEnd, &timezone)
 	if err == sql.ErrNoRows {
-		return "", fmt.Errorf("location '%s' not found", locationName)
+		return fmt.Errorf("intent '%s' not found", intentName)
 	}
 	if err != nil {
-		return "", fmt.Errorf("failed to query location: %w", err)
+		return fmt.Errorf("failed to query intent: %w", err)
 	}
-	return speakerEntity, nil
-}
-
-// Intent CRUD methods
-type Intent struct {
-	ID            int      `json:"id"`
-	Name          string   `json:"name"`
-	Playlist      string   `json:"playlist"`       // For backward compatibility (single playlist)
-	Playlists     []string `json:"playlists"`      // New format (multiple playlists)
-	PlaylistGroup string   `json:"playlist_group"` // Reference to a playlist group
-}
-
-type PlaylistGroup struct {
-	ID        int      `json:"id"`
-	Name      string   `json:"name"`
-	Playlists []string `json:"playlists"`
+	window := IntentSettings{ActiveStart: activeStart.String, ActiveEnd: activeEnd.String, Timezone: timezone.String}
+	if err := window.checkActive(now); err != nil {
+		return fmt.Errorf("intent '%s' %w", intentName, err)
+	}
+	return nil
 }
 
-func (d *Database) GetAllIntents() ([]Intent, error) {
-	rows, err := d.db.Query("SELECT id, name, playlist, playlist_group FROM intent ORDER BY name")
+// GetIntentQueueMode returns how the intent's plays reach the speaker's queue
+func (d *Database) GetIntentQueueMode(intentName string) (string, error) {
+	var queueMode sql.NullString
+	stmt, err := d.prepare("intent_queue_mode", "SELECT queue_mode FROM intent WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1")
 	if err != nil {
-		return nil, fmt.Errorf("failed to query intents: %w", err)
+		return "", err
 	}
-	defer rows.Close()
-
-	var intents []Intent
-	for rows.Next() {
-		var intent Intent
-		var playlistData string
-		var playlistGroup sql.NullString
-		if err := rows.Scan(&intent.ID, &intent.Name, &playlistData, &playlistGroup); err != nil {
-			return nil, fmt.Errorf("failed to scan intent: %w", err)
-		}
-
-		if playlistGroup.Valid && playlistGroup.String != "" {
-			intent.PlaylistGroup = playlistGroup.String
-			groupPlaylists, _ := d.GetGroupPlaylists(playlistGroup.String)
-			intent.Playlists = groupPlaylists
-			if len(groupPlaylists) > 0 {
-				intent.Playlist = groupPlaylists[0]
-			}
-		} else {
-			playlists := parsePlaylists(playlistData)
-			intent.Playlists = playlists
-			if len(playlists) > 0 {
-				intent.Playlist = playlists[0]
-			}
-		}
-		intents = append(intents, intent)
-	}
-	return intents, nil
-}
-
-func (d *Database) GetIntent(name string) (*Intent, error) {
-	var intent Intent
-	var playlistData string
-	var playlistGroup sql.NullString
-	err := d.db.QueryRow("SELECT id, name, playlist, playlist_group FROM intent WHERE name = ?", name).
-		Scan(&intent.ID, &intent.Name, &playlistData, &playlistGroup)
+	err = stmt.QueryRow(intentName, intentName).Scan(&queueMode)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("intent '%s' not found", name)
+		return "", fmt.Errorf("intent '%s' not found", intentName)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to query intent: %w", err)
-	}
-
-	if playlistGroup.Valid && playlistGroup.String != "" {
-		intent.PlaylistGroup = playlistGroup.String
-		groupPlaylists, _ := d.GetGroupPlaylists(playlistGroup.String)
-		intent.Playlists = groupPlaylists
-		if len(groupPlaylists) > 0 {
-			intent.Playlist = groupPlaylists[0]
-		}
-	} else {
-		playlists := parsePlaylists(playlistData)
-		intent.Playlists = playlists
-		if len(playlists) > 0 {
-			intent.Playlist = playlists[0]
-		}
+		return "", fmt.Errorf("failed to query intent: %w", err)
 	}
-	return &intent, nil
+	return orDefault(queueMode.String, queueModeReplace), nil
 }
 
-func (d *Database) CreateIntent(name string, playlists []string, playlistGroup string) error {
-	if playlistGroup != "" {
-		_, err := d.db.Exec("INSERT INTO intent (name, playlist, playlist_group) VALUES (?, ?, ?)", name, "", playlistGroup)
-		return err
-	}
+// selectLeastRecentlyPlayed returns the playlist whose last play is oldest,
+// preferring ones that have never been played, in their configured order
+func (d *Database) selectLeastRecentlyPlayed(playlists []string) (string, error) {
 	if len(playlists) == 0 {
-		return fmt.Errorf("at least one playlist is required when not using a group")
+		return "", fmt.Errorf("no playlists available")
 	}
-	playlistData, err := json.Marshal(playlists)
+	order, err := d.LeastRecentlyPlayedOrder(playlists)
 	if err != nil {
-		return fmt.Errorf("failed to marshal playlists: %w", err)
+		return "", err
 	}
-	_, err = d.db.Exec("INSERT INTO intent (name, playlist) VALUES (?, ?)", name, string(playlistData))
-	return err
+	return order[0], nil
 }
 
-func (d *Database) UpdateIntent(name string, playlists []string, playlistGroup string) error {
-	if playlistGroup != "" {
-		result, err := d.db.Exec("UPDATE intent SET playlist = ?, playlist_group = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?", "", playlistGroup, name)
-		if err != nil {
-			return fmt.Errorf("failed to update intent: %w", err)
-		}
-		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
-			return fmt.Errorf("intent '%s' not found", name)
-		}
-		return nil
-	}
+// LeastRecentlyPlayedOrder sorts playlists the way least_recently_played would
+// pick them: never-played ones first in their configured order, then by oldest
+// last play
+func (d *Database) LeastRecentlyPlayedOrder(playlists []string) ([]string, error) {
 	if len(playlists) == 0 {
-		return fmt.Errorf("at least one playlist is required when not using a group")
+		return nil, nil
 	}
-	playlistData, err := json.Marshal(playlists)
-	if err != nil {
-		return fmt.Errorf("failed to marshal playlists: %w", err)
+
+	args := make([]interface{}, len(playlists))
+	for i, playlist := range playlists {
+		args[i] = playlist
 	}
-	result, err := d.db.Exec("UPDATE intent SET playlist = ?, playlist_group = NULL, updated_at = CURRENT_TIMESTAMP WHERE name = ?", string(playlistData), name)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(playlists)), ", ")
+	// play_history ids increase with every play, unlike played_at which only has second precision
+	rows, err := d.db.Query("SELECT playlist, MAX(id) FROM play_history WHERE playlist IN ("+placeholders+") GROUP BY playlist", args...)
 	if err != nil {
-		return fmt.Errorf("failed to update intent: %w", err)
+		return nil, fmt.Errorf("failed to query play history: %w", err)
 	}
-	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
-		return fmt.Errorf("intent '%s' not found", name)
+	defer rows.Close()
+
+	lastPlayed := make(map[string]int)
+	for rows.Next() {
+		var playlist string
+		var playedAt int
+		if err := rows.Scan(&playlist, &playedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan play history: %w", err)
+		}
+		lastPlayed[playlist] = playedAt
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read play history: %w", err)
+	}
+
+	// Never played sorts as 0, before any play_history id
+	order := slices.Clone(playlists)
+	slices.SortStableFunc(order, func(a, b string) int {
+		return lastPlayed[a] - lastPlayed[b]
+	})
+	return order, nil
 }
 
-func (d *Database) DeleteIntent(name string) error {
-	result, err := d.db.Exec("DELETE FROM intent WHERE name = ?", name)
+func (d *Database) GetLocationSpeaker(locationName string) (string, error) {
+	var speakerEntity string
+	stmt, err := d.prepare("location_speaker", "SELECT speaker_entity FROM location WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1")
 	if err != nil {
-		return fmt.Errorf("failed to delete intent: %w", err)
+		return "", err
 	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("intent '%s' not found", name)
+	err = stmt.QueryRow(locationName, locationName).Scan(&speakerEntity)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("location '%s' not found", locationName)
 	}
-	return nil
+	if err != nil {
+		return "", fmt.Errorf("failed to query location: %w", err)
+	}
+	return speakerEntity, nil
 }
 
-// Location CRUD methods
-type Location struct {
-	ID            int    `json:"id"`
-	Name          string `json:"name"`
-	SpeakerEntity string `json:"speaker_entity"`
+// LocationHA points a location at its own Home Assistant instance; an empty
+// field falls back to HA_URL / HA_TOKEN
+type LocationHA struct {
+	URL   string `json:"ha_url"`
+	Token string `json:"ha_token"`
 }
 
-func (d *Database) GetAllLocations() ([]Location, error) {
-	rows, err := d.db.Query("SELECT id, name, speaker_entity FROM location ORDER BY name")
-	if err != nil {
-		return nil, fmt.Errorf("failed to query locations: %w", err)
-	}
-	defer rows.Close()
+// LocationHAResponse is what the API shows of a LocationHA; the token is never
+// returned
+type LocationHAResponse struct {
+	HAURL      string `json:"ha_url"`
+	HATokenSet bool   `json:"ha_token_set"`
+}
 
-	var locations []Location
-	for rows.Next() {
-		var location Location
-		if err := rows.Scan(&location.ID, &location.Name, &location.SpeakerEntity); err != nil {
-			return nil, fmt.Errorf("failed to scan location: %w", err)
-		}
-		locations = append(locations, location)
-	}
-	return locations, nil
+func locationHAResponse(ha LocationHA) LocationHAResponse {
+	return LocationHAResponse{HAURL: ha.URL, HATokenSet: ha.Token != ""}
 }
 
-func (d *Database) GetLocation(name string) (*Location, error) {
-	var location Location
-	err := d.db.QueryRow("SELECT id, name, speaker_entity FROM location WHERE name = ?", name).Scan(&location.ID, &location.Name, &location.SpeakerEntity)
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("location '%s' not found", name)
-	}
+// GetLocationHA returns the location's Home Assistant overrides, empty when it
+// uses the global instance
+func (d *Database) GetLocationHA(locationName string) (LocationHA, error) {
+	var url, token sql.NullString
+	stmt, err := d.prepare("location_ha", "SELECT ha_url, ha_token FROM location WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1")
 	if err != nil {
-		return nil, fmt.Errorf("failed to query location: %w", err)
+		return LocationHA{}, err
+	}
+	err = stmt.QueryRow(locationName, locationName).Scan(&url, &token)
+	if err == sql.ErrNoRows {
+		return LocationHA{}, fmt.Errorf("location '%s' not found", locationName)
 	}
-	return &location, nil
-}
-
-func (d *Database) CreateLocation(name, speakerEntity string) error {
-	_, err := d.db.Exec("INSERT INTO location (name, speaker_entity) VALUES (?, ?)", name, speakerEntity)
 	if err != nil {
-		return fmt.Errorf("failed to create location: %w", err)
+		return LocationHA{}, fmt.Errorf("failed to query location: %w", err)
 	}
-	return nil
+	return LocationHA{URL: url.String, Token: token.String}, nil
 }
 
-func (d *Database) UpdateLocation(name, speakerEntity string) error {
-	result, err := d.db.Exec("UPDATE location SET speaker_entity = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?", speakerEntity, name)
+// SetLocationHA replaces the location's Home Assistant overrides
+func (d *Database) SetLocationHA(locationName string, ha LocationHA) error {
+	result, err := d.db.Exec("UPDATE location SET ha_url = ?, ha_token = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?",
+		nullIfEmpty(ha.URL), nullIfEmpty(ha.Token), locationName)
 	if err != nil {
 		return fmt.Errorf("failed to update location: %w", err)
 	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("location '%s' not found", name)
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("location '%s' not found", locationName)
 	}
 	return nil
 }
 
-func (d *Database) DeleteLocation(name string) error {
-	result, err := d.db.Exec("DELETE FROM location WHERE name = ?", name)
-	if err != nil {
-		return fmt.Errorf("failed to delete location: %w", err)
-	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("location '%s' not found", name)
-	}
-	return nil
+// Intent CRUD methods
+type Intent struct {
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	Playlist      string     `json:"playlist"`       // For backward compatibility (single playlist)
+	Playlists     []string   `json:"playlists"`      // New format (multiple playlists)
+	PlaylistGroup string     `json:"playlist_group"` // Reference to a playlist group
+	PlayCount     int        `json:"play_count"`
+	LastPlayedAt  *time.Time `json:"last_played_at,omitempty"`
+	// Client that triggered the last play: its own triggered_by, its IP, "mqtt"
+	// or "chain:<name>"
+	LastTriggeredBy string `json:"last_triggered_by,omitempty"`
+	IntentSettings
 }
 
-// Playlist Group CRUD methods
-func (d *Database) GetAllPlaylistGroups() ([]PlaylistGroup, error) {
-	rows, err := d.db.Query("SELECT id, name FROM playlist_group ORDER BY name")
-	if err != nil {
-		return nil, fmt.Errorf("failed to query playlist groups: %w", err)
-	}
-	defer rows.Close()
+const (
+	selectionModeRandom              = "random"
+	selectionModeLeastRecentlyPlayed = "least_recently_played"
+)
 
-	var groups []PlaylistGroup
-	for rows.Next() {
-		var group PlaylistGroup
-		if err := rows.Scan(&group.ID, &group.Name); err != nil {
-			return nil, fmt.Errorf("failed to scan playlist group: %w", err)
-		}
-		// Get playlists for this group
-		playlists, _ := d.GetGroupPlaylists(group.Name)
-		group.Playlists = playlists
-		groups = append(groups, group)
-	}
-	return groups, nil
-}
+const (
+	defaultIntentTimezone = "UTC"
+	activeTimeLayout      = "15:04"
+)
 
-func (d *Database) GetGroupPlaylists(groupName string) ([]string, error) {
-	rows, err := d.db.Query("SELECT playlist FROM playlist_group_item WHERE group_name = ? ORDER BY playlist", groupName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query group playlists: %w", err)
-	}
-	defer rows.Close()
+// ErrOutsideActiveWindow is returned when an intent is played outside its active hours
+var ErrOutsideActiveWindow = errors.New("intent is outside its active window")
+
+// IntentSettings are the optional intent fields that control how and when it plays
+type IntentSettings struct {
+	SelectionMode string `json:"selection_mode,omitempty"` // random (default) or least_recently_played
+	// Hours (HH:MM) the intent may play in, in Timezone; both empty means always.
+	// A window whose end is before its start spans midnight.
+	ActiveStart string `json:"active_start,omitempty"`
+	ActiveEnd   string `json:"active_end,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`   // IANA name, default UTC
+	QueueMode   string `json:"queue_mode,omitempty"` // replace (default), next or end
+}
 
-	var playlists []string
-	for rows.Next() {
-		var playlist string
-		if err := rows.Scan(&playlist); err != nil {
-			return nil, fmt.Errorf("failed to scan playlist: %w", err)
-		}
-		playlists = append(playlists, playlist)
-	}
-	return playlists, nil
+// Validate checks the settings and fills in defaults. The error is ValidationErrors.
+func (s *IntentSettings) Validate() error {
+	var errs ValidationErrors
+	s.validate(&errs)
+	return errs.err()
 }
 
-func (d *Database) CreatePlaylistGroup(name string, playlists []string) error {
-	tx, err := d.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+// validate adds a ValidationError to errs for each invalid setting
+func (s *IntentSettings) validate(errs *ValidationErrors) {
+	switch s.SelectionMode {
+	case "":
+		s.SelectionMode = selectionModeRandom
+	case selectionModeRandom, selectionModeLeastRecentlyPlayed:
+	default:
+		errs.add("selection_mode", fmt.Sprintf("must be %s or %s, got %q", selectionModeRandom, selectionModeLeastRecentlyPlayed, s.SelectionMode))
 	}
-	defer tx.Rollback()
 
-	if _, err = tx.Exec("INSERT INTO playlist_group (name) VALUES (?)", name); err != nil {
-		return fmt.Errorf("failed to create playlist group: %w", err)
+	if s.ActiveStart != "" && s.ActiveEnd == "" {
+		errs.add("active_end", "required when active_start is set")
 	}
-
-	for _, playlist := range playlists {
-		if playlist == "" {
-			continue
-		}
-		if _, err = tx.Exec("INSERT INTO playlist_group_item (group_name, playlist) VALUES (?, ?)", name, playlist); err != nil {
-			return fmt.Errorf("failed to add playlist to group: %w", err)
+	if s.ActiveEnd != "" && s.ActiveStart == "" {
+		errs.add("active_start", "required when active_end is set")
+	}
+	for _, f := range []struct{ field, value string }{{"active_start", s.ActiveStart}, {"active_end", s.ActiveEnd}} {
+		if _, err := time.Parse(activeTimeLayout, f.value); f.value != "" && err != nil {
+			errs.add(f.field, fmt.Sprintf("must be HH:MM, got %q", f.value))
 		}
 	}
-
-	return tx.Commit()
+	if s.Timezone == "" {
+		s.Timezone = defaultIntentTimezone
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		errs.add("timezone", fmt.Sprintf("unknown timezone %q", s.Timezone))
+	}
+	if s.QueueMode == "" {
+		s.QueueMode = queueModeReplace
+	}
+	validateQueueMode(errs, s.QueueMode)
 }
 
-func (d *Database) UpdatePlaylistGroup(name string, playlists []string) error {
-	tx, err := d.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
+const (
+	queueModeReplace = "replace" // interrupt whatever is playing
+	queueModeNext    = "next"    // play after the current track
+	queueModeEnd     = "end"     // add to the back of the speaker's queue
+)
 
-	if _, err = tx.Exec("DELETE FROM playlist_group_item WHERE group_name = ?", name); err != nil {
-		return fmt.Errorf("failed to delete existing playlists: %w", err)
+// validateQueueMode adds a ValidationError to errs unless mode is a queue_mode
+// value or empty (the default)
+func validateQueueMode(errs *ValidationErrors, mode string) {
+	switch mode {
+	case "", queueModeReplace, queueModeNext, queueModeEnd:
+	default:
+		errs.add("queue_mode", fmt.Sprintf("must be %s, %s or %s, got %q", queueModeReplace, queueModeNext, queueModeEnd, mode))
 	}
+}
 
-	for _, playlist := range playlists {
-		if playlist == "" {
-			continue
-		}
-		if _, err = tx.Exec("INSERT INTO playlist_group_item (group_name, playlist) VALUES (?, ?)", name, playlist); err != nil {
-			return fmt.Errorf("failed to add playlist to group: %w", err)
-		}
+// queueModeEnqueue maps a queue_mode to the enqueue option playMusic passes to
+// Music Assistant; replace is a plain play
+func queueModeEnqueue(mode string) string {
+	switch mode {
+	case queueModeNext:
+		return "next"
+	case queueModeEnd:
+		return enqueueAdd
 	}
+	return ""
+}
 
-	if _, err = tx.Exec("UPDATE playlist_group SET updated_at = CURRENT_TIMESTAMP WHERE name = ?", name); err != nil {
-		return fmt.Errorf("failed to update group: %w", err)
+// checkActive returns ErrOutsideActiveWindow (wrapped) if now is outside the
+// active window. Settings that fail to parse leave the intent always active.
+func (s IntentSettings) checkActive(now time.Time) error {
+	if s.ActiveStart == "" || s.ActiveEnd == "" {
+		return nil
 	}
-
-	return tx.Commit()
+	loc, err := time.LoadLocation(orDefault(s.Timezone, defaultIntentTimezone))
+	if err != nil {
+		return nil
+	}
+	active, err := inTimeWindow(now.In(loc), s.ActiveStart, s.ActiveEnd)
+	if err != nil || active {
+		return nil
+	}
+	return fmt.Errorf("only active %s-%s %s: %w", s.ActiveStart, s.ActiveEnd, loc, ErrOutsideActiveWindow)
 }
 
-func (d *Database) DeletePlaylistGroup(name string) error {
-	result, err := d.db.Exec("DELETE FROM playlist_group WHERE name = ?", name)
+// inTimeWindow reports whether the wall-clock time of t falls within [start, end),
+// both HH:MM. A window whose end is not after its start spans midnight.
+func inTimeWindow(t time.Time, start, end string) (bool, error) {
+	from, err := time.Parse(activeTimeLayout, start)
 	if err != nil {
-		return fmt.Errorf("failed to delete playlist group: %w", err)
+		return false, err
 	}
-	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
-		return fmt.Errorf("playlist group '%s' not found", name)
+	to, err := time.Parse(activeTimeLayout, end)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	minute := t.Hour()*60 + t.Minute()
+	fromMinute := from.Hour()*60 + from.Minute()
+	toMinute := to.Hour()*60 + to.Minute()
+	if toMinute <= fromMinute {
+		return minute >= fromMinute || minute < toMinute, nil
+	}
+	return minute >= fromMinute && minute < toMinute, nil
 }
 
-func (d *Database) GetAllAvailablePlaylists() ([]string, error) {
-	playlists := make(map[string]bool)
+// nullIfEmpty stores empty optional strings as NULL
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
 
-	rows, err := d.db.Query("SELECT playlist FROM intent WHERE playlist != '' AND playlist_group IS NULL")
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var playlistData string
-			if err := rows.Scan(&playlistData); err == nil {
-				for _, p := range parsePlaylists(playlistData) {
-					playlists[p] = true
-				}
-			}
-		}
-	}
+type PlaylistGroup struct {
+	ID            int               `json:"id"`
+	Name          string            `json:"name"`
+	ItemCount     int               `json:"item_count"`
+	UsedByIntents int               `json:"used_by_intents"`     // intents playing from the group
+	Tags          []string          `json:"tags"`                // lowercase and sorted; left out of a PUT to keep them
+	Playlists     []string          `json:"playlists,omitempty"` // left out of lists unless include_playlists=true
+	CoverArt      map[string]string `json:"cover_art,omitempty"` // playlist -> cover art URL, where known
+}
 
-	rows2, err := d.db.Query("SELECT DISTINCT playlist FROM playlist_group_item")
-	if err == nil {
-		defer rows2.Close()
-		for rows2.Next() {
-			var playlist string
-			if err := rows2.Scan(&playlist); err == nil && playlist != "" {
-				playlists[playlist] = true
-			}
-		}
-	}
+// AvailablePlaylist is one entry of GET /api/available-playlists?include_cover_art=true
+type AvailablePlaylist struct {
+	Playlist    string `json:"playlist"`
+	CoverArtURL string `json:"cover_art_url,omitempty"`
+}
 
-	result := make([]string, 0, len(playlists))
-	for p := range playlists {
-		result = append(result, p)
-	}
-	sort.Strings(result)
-	return result, nil
+// ListOptions narrows a list query; a zero Limit returns every row
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Search string // substring match, for lists that support ?q=
+	Tag    string // exact tag, for lists that support ?tag=
+	Sort   string // column from the list's sort whitelist; empty means name
+	Desc   bool
 }
 
-// CleanupOrphanedPlaylistItems removes playlist_group_item entries that reference non-existent groups
-func (d *Database) CleanupOrphanedPlaylistItems() error {
-	result, err := d.db.Exec(`
-		DELETE FROM playlist_group_item 
-		WHERE group_name NOT IN (SELECT name FROM playlist_group)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to cleanup orphaned playlist items: %w", err)
+// intentSortColumns whitelists the ?sort= values accepted by ListIntents
+var intentSortColumns = map[string]string{
+	"name":       "name",
+	"id":         "id",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// orderBy returns the ORDER BY clause for opts, validated against columns
+func (o ListOptions) orderBy(columns map[string]string) (string, error) {
+	column := "name"
+	if o.Sort != "" {
+		var ok bool
+		if column, ok = columns[o.Sort]; !ok {
+			return "", fmt.Errorf("unsupported sort field '%s'", o.Sort)
+		}
 	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected > 0 {
-		log.Printf("[DB] Cleaned up %d orphaned playlist_group_item entries", rowsAffected)
+	dir := "ASC"
+	if o.Desc {
+		dir = "DESC"
 	}
-	return nil
+	return " ORDER BY " + column + " " + dir, nil
 }
 
-func (d *Database) Close() error {
-	return d.db.Close()
+// likePattern wraps term for a LIKE ... ESCAPE '\' substring match
+func likePattern(term string) string {
+	term = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+	return "%" + term + "%"
 }
 
-// parsePlaylists parses playlist data from various formats (JSON array, comma-separated, or single)
-func parsePlaylists(data string) []string {
-	var playlists []string
-	if err := json.Unmarshal([]byte(data), &playlists); err == nil && len(playlists) > 0 {
-		return playlists
-	}
-	if strings.Contains(data, ",") {
-		parts := strings.Split(data, ",")
-		for _, p := range parts {
-			if trimmed := strings.TrimSpace(p); trimmed != "" {
-				playlists = append(playlists, trimmed)
-			}
-		}
-		return playlists
+// apply appends the LIMIT/OFFSET clause for opts to query
+func (o ListOptions) apply(query string, args []interface{}) (string, []interface{}) {
+	if o.Limit <= 0 {
+		return query, args
 	}
-	if data != "" {
-		return []string{data}
-	}
-	return []string{}
+	return query + " LIMIT ? OFFSET ?", append(args, o.Limit, o.Offset)
 }
 
-// selectRandomPlaylist returns a random playlist from the list
-func selectRandomPlaylist(playlists []string) (string, error) {
-	if len(playlists) == 0 {
-		return "", fmt.Errorf("no playlists available")
+func (d *Database) countRows(table string) (int, error) {
+	var count int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count %s rows: %w", table, err)
 	}
-	return playlists[rand.Intn(len(playlists))], nil
+	return count, nil
 }
 
-// setCORSHeaders sets common CORS headers
-func setCORSHeaders(w http.ResponseWriter, methods ...string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if len(methods) > 0 {
-		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	}
+func (d *Database) CountIntents() (int, error) {
+	return d.countRows("intent")
 }
 
-// handleOptions handles OPTIONS requests for CORS
-func handleOptions(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusOK)
+func (d *Database) CountLocations() (int, error) {
+	return d.countRows("location")
 }
 
-type Coordinator struct {
-	db         *Database
-	config     *Config
-	haClient   *HAClient
-	mqttClient mqtt.Client
+func (d *Database) CountPlaylistGroups() (int, error) {
+	return d.countRows("playlist_group")
 }
 
-func NewCoordinator(db *Database, config *Config) (*Coordinator, error) {
-	coordinator := &Coordinator{
-		db:       db,
-		config:   config,
-		haClient: NewHAClient(config.HAURL, config.HAToken),
-	}
+func (d *Database) CountChains() (int, error) {
+	return d.countRows("chains")
+}
 
-	// Initialize MQTT client
-	mqttClient, err := initMQTTClient(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize MQTT client: %w", err)
-	}
-	coordinator.mqttClient = mqttClient
+// intentColumns is the column list scanIntent expects
+const intentColumns = "id, name, playlist, playlist_group, play_count, last_played_at, last_triggered_by, selection_mode, active_start, active_end, timezone, queue_mode"
 
-	// Subscribe to play requests
-	if err := coordinator.subscribeToPlayRequests(); err != nil {
-		return nil, fmt.Errorf("failed to subscribe to MQTT topics: %w", err)
-	}
+// groupPlaylistsSep separates the playlists GROUP_CONCAT joins in intentListQuery;
+// playlist URIs never contain it
+const groupPlaylistsSep = "\x1f"
 
-	return coordinator, nil
-}
+// intentListQuery selects intentColumns plus each intent's group playlists, so
+// listing intents doesn't need a query per group
+const intentListQuery = "SELECT " + intentColumns + ", group_playlists FROM intent" +
+	" LEFT JOIN (SELECT group_name, GROUP_CONCAT(playlist, char(31) ORDER BY playlist) AS group_playlists" +
+	" FROM playlist_group_item GROUP BY group_name) ON playlist_group = group_name"
 
-func initMQTTClient(config *Config) (mqtt.Client, error) {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(config.MQTTBroker)
-	opts.SetClientID(config.MQTTClientID)
-	if config.MQTTUser != "" {
-		opts.SetUsername(config.MQTTUser)
-		opts.SetPassword(config.MQTTPass)
-	}
-	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(5 * time.Second)
-	opts.SetKeepAlive(60 * time.Second)
-	opts.SetPingTimeout(10 * time.Second)
-	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		log.Printf("[MQTT] Connection lost: %v", err)
-	})
-	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		log.Printf("[MQTT] Connected to broker")
-	})
+// scanIntent reads a row selected with intentColumns into intent and resolves
+// its playlists. Columns added by migrations are NULL on older rows.
+func (d *Database) scanIntent(row interface{ Scan(...interface{}) error }, intent *Intent) error {
+	return d.scanIntentRow(row, intent, nil)
+}
 
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	if token.Wait() && token.Error() != nil {
-		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+// scanIntentRow is scanIntent for rows that may carry the group_playlists
+// column; when groupPlaylists is nil the group's playlists are queried instead
+func (d *Database) scanIntentRow(row interface{ Scan(...interface{}) error }, intent *Intent, groupPlaylists *sql.NullString) error {
+	var playlistData string
+	var playlistGroup, lastTriggeredBy, selectionMode, activeStart, activeEnd, timezone, queueMode sql.NullString
+	var playCount sql.NullInt64
+	var lastPlayedAt sql.NullTime
+	dest := []interface{}{&intent.ID, &intent.Name, &playlistData, &playlistGroup, &playCount, &lastPlayedAt, &lastTriggeredBy,
+		&selectionMode, &activeStart, &activeEnd, &timezone, &queueMode}
+	if groupPlaylists != nil {
+		dest = append(dest, groupPlaylists)
 	}
-	return client, nil
-}
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	intent.PlayCount = int(playCount.Int64)
+	intent.LastTriggeredBy = lastTriggeredBy.String
+	if lastPlayedAt.Valid {
+		t := lastPlayedAt.Time
+		intent.LastPlayedAt = &t
+	}
+	intent.SelectionMode = orDefault(selectionMode.String, selectionModeRandom)
+	intent.ActiveStart = activeStart.String
+	intent.ActiveEnd = activeEnd.String
+	intent.Timezone = orDefault(timezone.String, defaultIntentTimezone)
+	intent.QueueMode = orDefault(queueMode.String, queueModeReplace)
 
-func (c *Coordinator) subscribeToPlayRequests() error {
-	token := c.mqttClient.Subscribe(mqttPlayTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		var req IntentRequest
-		if err := json.Unmarshal(msg.Payload(), &req); err != nil {
-			log.Printf("[MQTT] Failed to parse play request: %v", err)
-			return
+	if playlistGroup.Valid && playlistGroup.String != "" {
+		intent.PlaylistGroup = playlistGroup.String
+		var playlists []string
+		if groupPlaylists == nil {
+			playlists, _ = d.GetGroupPlaylists(playlistGroup.String)
+		} else if groupPlaylists.String != "" {
+			playlists = strings.Split(groupPlaylists.String, groupPlaylistsSep)
 		}
-		if err := c.processPlayRequest(req); err != nil {
-			log.Printf("[MQTT] Failed to process play request: %v", err)
+		intent.Playlists = playlists
+		if len(playlists) > 0 {
+			intent.Playlist = playlists[0]
+		}
+	} else {
+		playlists := parsePlaylists(playlistData)
+		intent.Playlists = playlists
+		if len(playlists) > 0 {
+			intent.Playlist = playlists[0]
 		}
-	})
-
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to %s: %w", mqttPlayTopic, token.Error())
 	}
 	return nil
 }
 
-func (c *Coordinator) processPlayRequest(req IntentRequest) error {
-	if req.Intent == "" || req.Location == "" {
-		return fmt.Errorf("intent and location are required")
-	}
-	playlist, err := c.db.GetIntentPlaylist(req.Intent)
-	if err != nil {
-		return fmt.Errorf("intent not found: %w", err)
+// GetLeastPlayedIntent returns the intent played longest ago, intents that have
+// never played coming first
+func (d *Database) GetLeastPlayedIntent() (*Intent, error) {
+	var name string
+	err := d.db.QueryRow("SELECT name FROM intent ORDER BY last_played_at IS NOT NULL, last_played_at, name LIMIT 1").Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no intents configured")
 	}
-	speakerEntity, err := c.db.GetLocationSpeaker(req.Location)
 	if err != nil {
-		return fmt.Errorf("location not found: %w", err)
+		return nil, fmt.Errorf("failed to query intent: %w", err)
 	}
-	return c.playMusicViaMQTT(speakerEntity, playlist)
+	return d.GetIntent(name)
 }
 
-func (c *Coordinator) HandlePlayIntent(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req IntentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-		return
-	}
+func (d *Database) GetAllIntents() ([]Intent, error) {
+	return d.ListIntents(ListOptions{})
+}
 
-	if req.Intent == "" || req.Location == "" {
-		c.sendError(w, http.StatusBadRequest, "intent and location are required")
-		return
+func (d *Database) ListIntents(opts ListOptions) ([]Intent, error) {
+	query := intentListQuery
+	var args []interface{}
+	if opts.Search != "" {
+		pattern := likePattern(opts.Search)
+		query += ` WHERE name LIKE ? ESCAPE '\' OR playlist_group LIKE ? ESCAPE '\'`
+		args = append(args, pattern, pattern)
 	}
-
-	playlist, err := c.db.GetIntentPlaylist(req.Intent)
+	order, err := opts.orderBy(intentSortColumns)
 	if err != nil {
-		c.sendError(w, http.StatusNotFound, err.Error())
-		return
+		return nil, err
 	}
-
-	speakerEntity, err := c.db.GetLocationSpeaker(req.Location)
+	query, args = opts.apply(query+order, args)
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
-		c.sendError(w, http.StatusNotFound, err.Error())
-		return
+		return nil, fmt.Errorf("failed to query intents: %w", err)
 	}
+	defer rows.Close()
 
-	if err := c.playMusicViaMQTT(speakerEntity, playlist); err != nil {
-		c.sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to play music: %v", err))
-		return
+	intents := []Intent{}
+	for rows.Next() {
+		var intent Intent
+		var groupPlaylists sql.NullString
+		if err := d.scanIntentRow(rows, &intent, &groupPlaylists); err != nil {
+			return nil, fmt.Errorf("failed to scan intent: %w", err)
+		}
+		intents = append(intents, intent)
 	}
-
-	c.sendSuccess(w, fmt.Sprintf("Playing intent '%s' on '%s'", req.Intent, req.Location))
+	return intents, nil
 }
 
-func (c *Coordinator) HandleIntents(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+func (d *Database) GetIntent(name string) (*Intent, error) {
+	var intent Intent
+	row := d.db.QueryRow("SELECT "+intentColumns+" FROM intent WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1", name, name)
+	err := d.scanIntent(row, &intent)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("intent '%s' not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query intent: %w", err)
+	}
+	return &intent, nil
+}
 
-	switch r.Method {
-	case http.MethodGet:
-		intents, err := c.db.GetAllIntents()
-		if err != nil {
-			c.sendError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		json.NewEncoder(w).Encode(intents)
+// ErrPlaylistGroupMissing is wrapped by checkGroupExists
+var ErrPlaylistGroupMissing = errors.New("does not exist")
+
+// checkGroupExists catches intents pointing at a group that isn't there, which
+// would otherwise only fail once they're played
+func checkGroupExists(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, group string) error {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM playlist_group WHERE name = ?)", group).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to query playlist group: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("playlist group '%s' %w", group, ErrPlaylistGroupMissing)
+	}
+	return nil
+}
 
-	case http.MethodPost:
-		var intent Intent
-		if err := json.NewDecoder(r.Body).Decode(&intent); err != nil {
-			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-			return
+func (d *Database) CreateIntent(name string, playlists []string, playlistGroup string, settings IntentSettings) error {
+	name = d.normalizeName(name)
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if playlistGroup != "" {
+		if err := checkGroupExists(d.db, playlistGroup); err != nil {
+			return err
 		}
+		_, err := d.db.Exec("INSERT INTO intent (name, playlist, playlist_group, selection_mode, active_start, active_end, timezone, queue_mode) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			name, "", playlistGroup, settings.SelectionMode, nullIfEmpty(settings.ActiveStart), nullIfEmpty(settings.ActiveEnd), settings.Timezone, settings.QueueMode)
+		return err
+	}
+	if len(playlists) == 0 {
+		return fmt.Errorf("at least one playlist is required when not using a group")
+	}
+	playlistData, err := json.Marshal(playlists)
+	if err != nil {
+		return fmt.Errorf("failed to marshal playlists: %w", err)
+	}
+	_, err = d.db.Exec("INSERT INTO intent (name, playlist, selection_mode, active_start, active_end, timezone, queue_mode) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		name, string(playlistData), settings.SelectionMode, nullIfEmpty(settings.ActiveStart), nullIfEmpty(settings.ActiveEnd), settings.Timezone, settings.QueueMode)
+	return err
+}
 
-		playlists := intent.Playlists
-		if len(playlists) == 0 && intent.Playlist != "" {
-			playlists = []string{intent.Playlist}
-		}
+// IntentInput is one intent in a bulk create: direct playlists or a playlist group
+type IntentInput struct {
+	Name          string   `json:"name"`
+	Playlists     []string `json:"playlists"`
+	PlaylistGroup string   `json:"playlist_group"`
+	IntentSettings
+}
 
-		if intent.Name == "" || len(playlists) == 0 {
-			c.sendError(w, http.StatusBadRequest, "name and at least one playlist are required")
-			return
-		}
+// IntentUpdate is the body of PUT /api/intents/{name}. Settings left out keep
+// their current values; an empty active_start and active_end clear the window.
+type IntentUpdate struct {
+	Playlist      string   `json:"playlist"` // accepted for backward compatibility
+	Playlists     []string `json:"playlists"`
+	PlaylistGroup string   `json:"playlist_group"`
+	SelectionMode *string  `json:"selection_mode"`
+	ActiveStart   *string  `json:"active_start"`
+	ActiveEnd     *string  `json:"active_end"`
+	Timezone      *string  `json:"timezone"`
+	QueueMode     *string  `json:"queue_mode"`
+}
 
-		if err := c.db.CreateIntent(intent.Name, playlists, ""); err != nil {
-			c.sendError(w, http.StatusBadRequest, err.Error())
-			return
+// apply overwrites the settings the update sets
+func (u IntentUpdate) apply(settings *IntentSettings) {
+	for _, f := range []struct {
+		value *string
+		dest  *string
+	}{
+		{u.SelectionMode, &settings.SelectionMode},
+		{u.ActiveStart, &settings.ActiveStart},
+		{u.ActiveEnd, &settings.ActiveEnd},
+		{u.Timezone, &settings.Timezone},
+		{u.QueueMode, &settings.QueueMode},
+	} {
+		if f.value != nil {
+			*f.dest = *f.value
 		}
-		c.sendSuccess(w, fmt.Sprintf("Intent '%s' created with %d playlist(s)", intent.Name, len(playlists)))
-
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (c *Coordinator) HandleIntent(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+// BulkError reports why the item at Index of a bulk request wasn't created
+type BulkError struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
 
-	name := r.URL.Path[len("/api/intents/"):]
-	if name == "" {
-		http.Error(w, "Intent name required", http.StatusBadRequest)
-		return
+// CreateIntentsBulk inserts intents in a single transaction. Invalid items and
+// names that already exist are reported in errors and skipped; the rest are still
+// committed. Only a failure of the transaction itself fails every item.
+func (d *Database) CreateIntentsBulk(ctx context.Context, intents []IntentInput) (created int, failures []BulkError) {
+	failAll := func(err error) (int, []BulkError) {
+		failures = failures[:0]
+		for i, intent := range intents {
+			failures = append(failures, BulkError{Index: i, Name: intent.Name, Error: err.Error()})
+		}
+		return 0, failures
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		intent, err := c.db.GetIntent(name)
-		if err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
-			return
-		}
-		json.NewEncoder(w).Encode(intent)
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return failAll(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
 
-	case http.MethodPut:
-		var intent Intent
-		if err := json.NewDecoder(r.Body).Decode(&intent); err != nil {
-			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-			return
-		}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO intent (name, playlist, playlist_group, selection_mode, active_start, active_end, timezone, queue_mode) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(name) DO NOTHING")
+	if err != nil {
+		return failAll(fmt.Errorf("failed to prepare insert: %w", err))
+	}
+	defer stmt.Close()
 
-		playlistGroup := intent.PlaylistGroup
-		playlists := intent.Playlists
-		if playlistGroup == "" && len(playlists) == 0 && intent.Playlist != "" {
-			playlists = []string{intent.Playlist}
+	for i, intent := range intents {
+		fail := func(err error) {
+			failures = append(failures, BulkError{Index: i, Name: intent.Name, Error: err.Error()})
 		}
 
-		if playlistGroup == "" && len(playlists) == 0 {
-			c.sendError(w, http.StatusBadRequest, "either playlists or playlist_group is required")
-			return
+		intent.Name = d.normalizeName(intent.Name)
+		if intent.Name == "" {
+			fail(fmt.Errorf("name is required"))
+			continue
 		}
-
-		if err := c.db.UpdateIntent(name, playlists, playlistGroup); err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
-			return
+		if err := intent.IntentSettings.Validate(); err != nil {
+			fail(err)
+			continue
 		}
-
-		if playlistGroup != "" {
-			c.sendSuccess(w, fmt.Sprintf("Intent '%s' updated with playlist group '%s'", name, playlistGroup))
+		playlistData := ""
+		if intent.PlaylistGroup != "" {
+			if err := checkGroupExists(tx, intent.PlaylistGroup); err != nil {
+				fail(err)
+				continue
+			}
 		} else {
-			c.sendSuccess(w, fmt.Sprintf("Intent '%s' updated with %d playlist(s)", name, len(playlists)))
+			playlists := normalizePlaylists(intent.Playlists)
+			if len(playlists) == 0 {
+				fail(fmt.Errorf("at least one playlist is required when not using a group"))
+				continue
+			}
+			data, err := json.Marshal(playlists)
+			if err != nil {
+				fail(fmt.Errorf("failed to marshal playlists: %w", err))
+				continue
+			}
+			playlistData = string(data)
 		}
 
-	case http.MethodDelete:
-		if err := c.db.DeleteIntent(name); err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
-			return
+		result, err := stmt.ExecContext(ctx, intent.Name, playlistData, nullIfEmpty(intent.PlaylistGroup),
+			intent.SelectionMode, nullIfEmpty(intent.ActiveStart), nullIfEmpty(intent.ActiveEnd), intent.Timezone, intent.QueueMode)
+		if err != nil {
+			fail(fmt.Errorf("failed to insert intent: %w", err))
+			continue
 		}
-		c.sendSuccess(w, fmt.Sprintf("Intent '%s' deleted", name))
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			fail(fmt.Errorf("intent '%s' already exists", intent.Name))
+			continue
+		}
+		created++
+	}
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if err := tx.Commit(); err != nil {
+		return failAll(fmt.Errorf("failed to commit: %w", err))
 	}
+	return created, failures
 }
 
-func (c *Coordinator) HandleLocations(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, "GET", "POST", "OPTIONS")
-
-	if r.Method == http.MethodOptions {
-		handleOptions(w)
-		return
+func (d *Database) UpdateIntent(name string, playlists []string, playlistGroup string, settings IntentSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
 	}
-
-	switch r.Method {
-	case http.MethodGet:
-		locations, err := c.db.GetAllLocations()
-		if err != nil {
-			c.sendError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		if locations == nil {
-			locations = []Location{}
-		}
-		json.NewEncoder(w).Encode(locations)
-
-	case http.MethodPost:
-		var location Location
-		if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
-			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-			return
+	if playlistGroup != "" {
+		if err := checkGroupExists(d.db, playlistGroup); err != nil {
+			return err
 		}
-		if location.Name == "" || location.SpeakerEntity == "" {
-			c.sendError(w, http.StatusBadRequest, "name and speaker_entity are required")
-			return
+		result, err := d.db.Exec("UPDATE intent SET playlist = ?, playlist_group = ?, selection_mode = ?, active_start = ?, active_end = ?, timezone = ?, queue_mode = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?",
+			"", playlistGroup, settings.SelectionMode, nullIfEmpty(settings.ActiveStart), nullIfEmpty(settings.ActiveEnd), settings.Timezone, settings.QueueMode, name)
+		if err != nil {
+			return fmt.Errorf("failed to update intent: %w", err)
 		}
-		if err := c.db.CreateLocation(location.Name, location.SpeakerEntity); err != nil {
-			c.sendError(w, http.StatusBadRequest, err.Error())
-			return
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return fmt.Errorf("intent '%s' not found", name)
 		}
-		c.sendSuccess(w, fmt.Sprintf("Location '%s' created", location.Name))
-
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if len(playlists) == 0 {
+		return fmt.Errorf("at least one playlist is required when not using a group")
+	}
+	playlistData, err := json.Marshal(playlists)
+	if err != nil {
+		return fmt.Errorf("failed to marshal playlists: %w", err)
 	}
+	result, err := d.db.Exec("UPDATE intent SET playlist = ?, playlist_group = NULL, selection_mode = ?, active_start = ?, active_end = ?, timezone = ?, queue_mode = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?",
+		string(playlistData), settings.SelectionMode, nullIfEmpty(settings.ActiveStart), nullIfEmpty(settings.ActiveEnd), settings.Timezone, settings.QueueMode, name)
+	if err != nil {
+		return fmt.Errorf("failed to update intent: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("intent '%s' not found", name)
+	}
+	return nil
 }
 
-func (c *Coordinator) HandleLocation(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-
-	name := r.URL.Path[len("/api/locations/"):]
-	if name == "" {
-		http.Error(w, "Location name required", http.StatusBadRequest)
-		return
+func (d *Database) DeleteIntent(name string) error {
+	result, err := d.db.Exec("DELETE FROM intent WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete intent: %w", err)
 	}
-
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("intent '%s' not found", name)
+	}
+	return nil
+}
+
+// Location CRUD methods
+type Location struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	SpeakerEntity string `json:"speaker_entity"`
+	DisplayName   string `json:"display_name"` // label for the UI; name when unset
+	Description   string `json:"description"`
+}
+
+// LocationUpdate is the body of PUT /api/locations/{name}; display_name and
+// description keep their current values when left out
+type LocationUpdate struct {
+	SpeakerEntity string  `json:"speaker_entity"`
+	DisplayName   *string `json:"display_name"`
+	Description   *string `json:"description"`
+}
+
+const locationColumns = "id, name, speaker_entity, display_name, description"
+
+func scanLocation(row interface{ Scan(...interface{}) error }, location *Location) error {
+	var displayName, description sql.NullString
+	if err := row.Scan(&location.ID, &location.Name, &location.SpeakerEntity, &displayName, &description); err != nil {
+		return err
+	}
+	location.DisplayName = orDefault(displayName.String, location.Name)
+	location.Description = description.String
+	return nil
+}
+
+// locationDisplayName stores a display name that only repeats the location's
+// name as unset, so it keeps following the name
+func locationDisplayName(name, displayName string) sql.NullString {
+	if displayName == name {
+		displayName = ""
+	}
+	return nullIfEmpty(displayName)
+}
+
+func (d *Database) GetAllLocations() ([]Location, error) {
+	return d.ListLocations(ListOptions{})
+}
+
+func (d *Database) ListLocations(opts ListOptions) ([]Location, error) {
+	query, args := opts.apply("SELECT "+locationColumns+" FROM location ORDER BY name", nil)
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query locations: %w", err)
+	}
+	defer rows.Close()
+
+	locations := []Location{}
+	for rows.Next() {
+		var location Location
+		if err := scanLocation(rows, &location); err != nil {
+			return nil, fmt.Errorf("failed to scan location: %w", err)
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+func (d *Database) GetLocation(name string) (*Location, error) {
+	var location Location
+	err := scanLocation(d.db.QueryRow("SELECT "+locationColumns+" FROM location WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1", name, name), &location)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("location '%s' not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query location: %w", err)
+	}
+	return &location, nil
+}
+
+func (d *Database) CreateLocation(name, speakerEntity, displayName, description string) error {
+	name = d.normalizeName(name)
+	_, err := d.db.Exec("INSERT INTO location (name, speaker_entity, display_name, description) VALUES (?, ?, ?, ?)",
+		name, speakerEntity, locationDisplayName(name, displayName), nullIfEmpty(description))
+	if err != nil {
+		return fmt.Errorf("failed to create location: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) UpdateLocation(name, speakerEntity, displayName, description string) error {
+	result, err := d.db.Exec("UPDATE location SET speaker_entity = ?, display_name = ?, description = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?",
+		speakerEntity, locationDisplayName(name, displayName), nullIfEmpty(description), name)
+	if err != nil {
+		return fmt.Errorf("failed to update location: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("location '%s' not found", name)
+	}
+	return nil
+}
+
+func (d *Database) DeleteLocation(name string) error {
+	result, err := d.db.Exec("DELETE FROM location WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete location: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("location '%s' not found", name)
+	}
+	return nil
+}
+
+// VolumeProfile sets a location's volume for plays started between StartTime and
+// EndTime (HH:MM, server local time)
+type VolumeProfile struct {
+	ID           int     `json:"id"`
+	LocationName string  `json:"location_name"`
+	StartTime    string  `json:"start_time"`
+	EndTime      string  `json:"end_time"`
+	Volume       float64 `json:"volume"`
+}
+
+// GetVolumeProfiles returns a location's profiles ordered by start time; never nil
+func (d *Database) GetVolumeProfiles(locationName string) ([]VolumeProfile, error) {
+	rows, err := d.db.Query("SELECT id, location_name, start_time, end_time, volume FROM volume_profile WHERE location_name = ? COLLATE NOCASE ORDER BY start_time, id", locationName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query volume profiles: %w", err)
+	}
+	defer rows.Close()
+
+	profiles := []VolumeProfile{}
+	for rows.Next() {
+		var p VolumeProfile
+		if err := rows.Scan(&p.ID, &p.LocationName, &p.StartTime, &p.EndTime, &p.Volume); err != nil {
+			return nil, fmt.Errorf("failed to scan volume profile: %w", err)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// ActiveVolume returns the volume of the first of the location's profiles that
+// covers now, if any
+func (d *Database) ActiveVolume(locationName string, now time.Time) (float64, bool, error) {
+	profiles, err := d.GetVolumeProfiles(locationName)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, p := range profiles {
+		if active, err := inTimeWindow(now, p.StartTime, p.EndTime); err == nil && active {
+			return p.Volume, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (d *Database) CreateVolumeProfile(p VolumeProfile) (int64, error) {
+	result, err := d.db.Exec("INSERT INTO volume_profile (location_name, start_time, end_time, volume) VALUES (?, ?, ?, ?)",
+		p.LocationName, p.StartTime, p.EndTime, p.Volume)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create volume profile: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+func (d *Database) DeleteVolumeProfile(locationName string, id int) error {
+	result, err := d.db.Exec("DELETE FROM volume_profile WHERE id = ? AND location_name = ? COLLATE NOCASE", id, locationName)
+	if err != nil {
+		return fmt.Errorf("failed to delete volume profile: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("volume profile %d not found for location '%s'", id, locationName)
+	}
+	return nil
+}
+
+// Playlist Group CRUD methods
+func (d *Database) GetAllPlaylistGroups() ([]PlaylistGroup, error) {
+	return d.ListPlaylistGroups(ListOptions{}, true)
+}
+
+// normalizeTags lowercases and trims tags, dropping empty and repeated ones, and
+// sorts them. The result is never nil.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// tagsColumn encodes tags as the JSON array stored in playlist_group.tags,
+// NULL when there are none
+func tagsColumn(tags []string) (sql.NullString, error) {
+	tags = normalizeTags(tags)
+	if len(tags) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode tags: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// parseTags decodes playlist_group.tags; a NULL or unreadable value is no tags
+func parseTags(column sql.NullString) []string {
+	tags := []string{}
+	if column.Valid {
+		json.Unmarshal([]byte(column.String), &tags)
+	}
+	return tags
+}
+
+// groupTagFilter returns the WHERE clause and args limiting the playlist_group
+// aliased pg to opts.Tag
+func groupTagFilter(opts ListOptions) (string, []interface{}) {
+	if opts.Tag == "" {
+		return "", nil
+	}
+	return " WHERE EXISTS (SELECT 1 FROM json_each(pg.tags) WHERE value = ?)", []interface{}{opts.Tag}
+}
+
+// ListPlaylistGroups returns a page of groups with their item counts. Their
+// playlists and cover art are only loaded when includePlaylists is set.
+func (d *Database) ListPlaylistGroups(opts ListOptions, includePlaylists bool) ([]PlaylistGroup, error) {
+	if !includePlaylists {
+		return d.listPlaylistGroupCounts(opts)
+	}
+
+	// Page over groups rather than joined rows, then fetch every page's items in
+	// the same query
+	where, args := groupTagFilter(opts)
+	page, args := opts.apply("SELECT id, name, tags, "+groupUsedByIntents+" FROM playlist_group pg"+where+" ORDER BY name", args)
+	query := "SELECT pg.id, pg.name, pg.tags, pg.used_by_intents, pgi.playlist, pgi.cover_art_url FROM (" + page + ") pg" +
+		" LEFT JOIN playlist_group_item pgi ON pg.name = pgi.group_name ORDER BY pg.name, pgi.playlist"
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlist groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := []PlaylistGroup{}
+	for rows.Next() {
+		var id, usedBy int
+		var name string
+		var tags, playlist, coverArtURL sql.NullString
+		if err := rows.Scan(&id, &name, &tags, &usedBy, &playlist, &coverArtURL); err != nil {
+			return nil, fmt.Errorf("failed to scan playlist group: %w", err)
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Name != name {
+			groups = append(groups, PlaylistGroup{ID: id, Name: name, UsedByIntents: usedBy, Tags: parseTags(tags)})
+		}
+		group := &groups[len(groups)-1]
+		if !playlist.Valid {
+			continue
+		}
+		group.ItemCount++
+		group.Playlists = append(group.Playlists, playlist.String)
+		if coverArtURL.String != "" {
+			if group.CoverArt == nil {
+				group.CoverArt = make(map[string]string)
+			}
+			group.CoverArt[playlist.String] = coverArtURL.String
+		}
+	}
+	return groups, nil
+}
+
+// groupUsedByIntents selects, for the playlist_group aliased pg, how many intents
+// play from it
+const groupUsedByIntents = "(SELECT COUNT(*) FROM intent WHERE playlist_group = pg.name) AS used_by_intents"
+
+// listPlaylistGroupCounts is ListPlaylistGroups without the playlists
+func (d *Database) listPlaylistGroupCounts(opts ListOptions) ([]PlaylistGroup, error) {
+	where, args := groupTagFilter(opts)
+	query, args := opts.apply("SELECT pg.id, pg.name, pg.tags, (SELECT COUNT(*) FROM playlist_group_item WHERE group_name = pg.name), "+
+		groupUsedByIntents+" FROM playlist_group pg"+where+" ORDER BY pg.name", args)
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlist groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := []PlaylistGroup{}
+	for rows.Next() {
+		var group PlaylistGroup
+		var tags sql.NullString
+		if err := rows.Scan(&group.ID, &group.Name, &tags, &group.ItemCount, &group.UsedByIntents); err != nil {
+			return nil, fmt.Errorf("failed to scan playlist group: %w", err)
+		}
+		group.Tags = parseTags(tags)
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// GetGroupTags returns the group's tags, sorted
+func (d *Database) GetGroupTags(groupName string) ([]string, error) {
+	var tags sql.NullString
+	err := d.db.QueryRow("SELECT tags FROM playlist_group WHERE name = ?", groupName).Scan(&tags)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("playlist group '%s' not found", groupName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlist group: %w", err)
+	}
+	return parseTags(tags), nil
+}
+
+// ListGroupTags returns every tag used by at least one playlist group, sorted
+func (d *Database) ListGroupTags() ([]string, error) {
+	rows, err := d.db.Query("SELECT DISTINCT tag.value FROM playlist_group, json_each(playlist_group.tags) tag ORDER BY tag.value")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlist group tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// PlaylistGroupExists reports whether a playlist group called name exists
+func (d *Database) PlaylistGroupExists(name string) (bool, error) {
+	err := checkGroupExists(d.db, name)
+	if errors.Is(err, ErrPlaylistGroupMissing) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Database) GetGroupPlaylists(groupName string) ([]string, error) {
+	playlists, _, err := d.GetGroupItems(groupName)
+	return playlists, err
+}
+
+// GetGroupItems returns a group's playlists along with the cover art stored for them
+func (d *Database) GetGroupItems(groupName string) ([]string, map[string]string, error) {
+	rows, err := d.db.Query("SELECT playlist, cover_art_url FROM playlist_group_item WHERE group_name = ? ORDER BY playlist", groupName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query group playlists: %w", err)
+	}
+	defer rows.Close()
+
+	var playlists []string
+	var coverArt map[string]string
+	for rows.Next() {
+		var playlist string
+		var coverArtURL sql.NullString
+		if err := rows.Scan(&playlist, &coverArtURL); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan playlist: %w", err)
+		}
+		playlists = append(playlists, playlist)
+		if coverArtURL.String != "" {
+			if coverArt == nil {
+				coverArt = make(map[string]string)
+			}
+			coverArt[playlist] = coverArtURL.String
+		}
+	}
+	return playlists, coverArt, nil
+}
+
+// insertGroupItems adds playlists to a group inside tx, storing cover art where given.
+// Playlist URIs are normalized, so duplicates collapse into one item, and
+// playlists already in the group are left alone.
+func insertGroupItems(tx *sql.Tx, name string, playlists []string, coverArt map[string]string) error {
+	normalizedArt := normalizeCoverArt(coverArt)
+	for _, playlist := range normalizePlaylists(playlists) {
+		if _, err := tx.Exec("INSERT INTO playlist_group_item (group_name, playlist, cover_art_url) VALUES (?, ?, ?) ON CONFLICT (group_name, playlist) DO NOTHING",
+			name, playlist, coverArtValue(normalizedArt[playlist])); err != nil {
+			return fmt.Errorf("failed to add playlist to group: %w", err)
+		}
+	}
+	return nil
+}
+
+// normalizeCoverArt keys coverArt by normalized playlist URI
+func normalizeCoverArt(coverArt map[string]string) map[string]string {
+	normalized := make(map[string]string, len(coverArt))
+	for playlist, art := range coverArt {
+		normalized[normalizePlaylistURI(playlist)] = art
+	}
+	return normalized
+}
+
+// coverArtValue stores an empty cover art URL as NULL
+func coverArtValue(art string) sql.NullString {
+	return sql.NullString{String: art, Valid: art != ""}
+}
+
+func (d *Database) CreatePlaylistGroup(name string, playlists []string, coverArt map[string]string, tags []string) error {
+	tagsValue, err := tagsColumn(tags)
+	if err != nil {
+		return err
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("INSERT INTO playlist_group (name, tags) VALUES (?, ?)", name, tagsValue); err != nil {
+		return fmt.Errorf("failed to create playlist group: %w", err)
+	}
+
+	if err = insertGroupItems(tx, name, playlists, coverArt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdatePlaylistGroup replaces the group's playlists and, unless tags is nil, its tags
+func (d *Database) UpdatePlaylistGroup(name string, playlists []string, coverArt map[string]string, tags []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Only the difference is written, so kept items keep their row and its data
+	existing := make(map[string]sql.NullString) // playlist -> cover_art_url
+	rows, err := tx.Query("SELECT playlist, cover_art_url FROM playlist_group_item WHERE group_name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to query group playlists: %w", err)
+	}
+	for rows.Next() {
+		var playlist string
+		var art sql.NullString
+		if err := rows.Scan(&playlist, &art); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan playlist: %w", err)
+		}
+		existing[playlist] = art
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query group playlists: %w", err)
+	}
+
+	wanted := normalizePlaylists(playlists)
+	normalizedArt := normalizeCoverArt(coverArt)
+	var added []string
+	for _, playlist := range wanted {
+		art, ok := existing[playlist]
+		if !ok {
+			added = append(added, playlist)
+			continue
+		}
+		delete(existing, playlist)
+		if art == coverArtValue(normalizedArt[playlist]) {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE playlist_group_item SET cover_art_url = ? WHERE group_name = ? AND playlist = ?",
+			coverArtValue(normalizedArt[playlist]), name, playlist); err != nil {
+			return fmt.Errorf("failed to update playlist cover art: %w", err)
+		}
+	}
+	if len(existing) > 0 {
+		args := []interface{}{name}
+		for playlist := range existing {
+			args = append(args, playlist)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(existing)), ", ")
+		if _, err := tx.Exec("DELETE FROM playlist_group_item WHERE group_name = ? AND playlist IN ("+placeholders+")", args...); err != nil {
+			return fmt.Errorf("failed to remove playlists from group: %w", err)
+		}
+	}
+	if err = insertGroupItems(tx, name, added, coverArt); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE playlist_group SET updated_at = CURRENT_TIMESTAMP WHERE name = ?", name); err != nil {
+		return fmt.Errorf("failed to update group: %w", err)
+	}
+	if tags != nil {
+		tagsValue, err := tagsColumn(tags)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec("UPDATE playlist_group SET tags = ? WHERE name = ?", tagsValue, name); err != nil {
+			return fmt.Errorf("failed to update group tags: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ErrPlaylistGroupExists is wrapped by RenamePlaylistGroup when the new name is taken
+var ErrPlaylistGroupExists = errors.New("already exists")
+
+// RenamePlaylistGroup renames the group and, in the same transaction, moves its
+// items and every intent that plays from it over to the new name
+func (d *Database) RenamePlaylistGroup(oldName, newName string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// playlist_group_item references the name, so check the keys at commit
+	// rather than after each statement
+	if _, err := tx.Exec("PRAGMA defer_foreign_keys = ON"); err != nil {
+		return fmt.Errorf("failed to defer foreign keys: %w", err)
+	}
+
+	var taken int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM playlist_group WHERE name = ?", newName).Scan(&taken); err != nil {
+		return fmt.Errorf("failed to query playlist group: %w", err)
+	}
+	if taken > 0 {
+		return fmt.Errorf("playlist group '%s' %w", newName, ErrPlaylistGroupExists)
+	}
+
+	result, err := tx.Exec("UPDATE playlist_group SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?", newName, oldName)
+	if err != nil {
+		return fmt.Errorf("failed to rename playlist group: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("playlist group '%s' not found", oldName)
+	}
+	if _, err := tx.Exec("UPDATE playlist_group_item SET group_name = ? WHERE group_name = ?", newName, oldName); err != nil {
+		return fmt.Errorf("failed to move playlists to renamed group: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE intent SET playlist_group = ?, updated_at = CURRENT_TIMESTAMP WHERE playlist_group = ?", newName, oldName); err != nil {
+		return fmt.Errorf("failed to update intents using group: %w", err)
+	}
+	return tx.Commit()
+}
+
+// GroupInUseError is returned by DeletePlaylistGroup when intents still play
+// from the group
+type GroupInUseError struct {
+	Group   string
+	Intents []string
+}
+
+func (e *GroupInUseError) Error() string {
+	return fmt.Sprintf("group '%s' is referenced by intents: [%s]", e.Group, strings.Join(e.Intents, ", "))
+}
+
+// IntentsUsingGroup returns the names of the intents that play from the group
+func (d *Database) IntentsUsingGroup(name string) ([]string, error) {
+	return intentsUsingGroup(d.db, name)
+}
+
+// CountIntentsUsingGroup returns how many intents play from the group
+func (d *Database) CountIntentsUsingGroup(name string) (int, error) {
+	var count int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM intent WHERE playlist_group = ?", name).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count intents using group: %w", err)
+	}
+	return count, nil
+}
+
+func intentsUsingGroup(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, name string) ([]string, error) {
+	rows, err := q.Query("SELECT name FROM intent WHERE playlist_group = ? ORDER BY name", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query intents using group: %w", err)
+	}
+	defer rows.Close()
+
+	var intents []string
+	for rows.Next() {
+		var intent string
+		if err := rows.Scan(&intent); err != nil {
+			return nil, fmt.Errorf("failed to scan intent: %w", err)
+		}
+		intents = append(intents, intent)
+	}
+	return intents, rows.Err()
+}
+
+// DeletePlaylistGroup deletes the group. If intents still use it, it fails with
+// a *GroupInUseError unless force is set, in which case those intents' group is
+// cleared in the same transaction.
+func (d *Database) DeletePlaylistGroup(name string, force bool) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	intents, err := intentsUsingGroup(tx, name)
+	if err != nil {
+		return err
+	}
+	if len(intents) > 0 {
+		if !force {
+			return &GroupInUseError{Group: name, Intents: intents}
+		}
+		if _, err := tx.Exec("UPDATE intent SET playlist_group = NULL, updated_at = CURRENT_TIMESTAMP WHERE playlist_group = ?", name); err != nil {
+			return fmt.Errorf("failed to clear group from intents: %w", err)
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM playlist_group WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete playlist group: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("playlist group '%s' not found", name)
+	}
+	return tx.Commit()
+}
+
+// Chain is a sequence of intents played one after another
+type Chain struct {
+	ID      int         `json:"id"`
+	Name    string      `json:"name"`
+	Steps   []ChainStep `json:"steps"`
+	Running bool        `json:"running,omitempty"`
+}
+
+// ChainStep plays Intent on Location, then waits DelaySeconds before the next step
+type ChainStep struct {
+	Order        int    `json:"step_order"`
+	Intent       string `json:"intent"`
+	Location     string `json:"location"`
+	DelaySeconds int    `json:"delay_seconds"`
+}
+
+func (d *Database) ListChains(opts ListOptions) ([]Chain, error) {
+	query, args := opts.apply("SELECT id, name FROM chains ORDER BY name", nil)
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chains: %w", err)
+	}
+	chains := []Chain{}
+	for rows.Next() {
+		var chain Chain
+		if err := rows.Scan(&chain.ID, &chain.Name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan chain: %w", err)
+		}
+		chains = append(chains, chain)
+	}
+	rows.Close()
+
+	for i := range chains {
+		if chains[i].Steps, err = d.getChainSteps(chains[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return chains, nil
+}
+
+func (d *Database) GetChain(name string) (*Chain, error) {
+	var chain Chain
+	err := d.db.QueryRow("SELECT id, name FROM chains WHERE name = ?", name).Scan(&chain.ID, &chain.Name)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("chain '%s' not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chain: %w", err)
+	}
+	if chain.Steps, err = d.getChainSteps(chain.ID); err != nil {
+		return nil, err
+	}
+	return &chain, nil
+}
+
+func (d *Database) getChainSteps(chainID int) ([]ChainStep, error) {
+	rows, err := d.db.Query("SELECT step_order, intent_name, location_name, delay_seconds FROM chain_step WHERE chain_id = ? ORDER BY step_order", chainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chain steps: %w", err)
+	}
+	defer rows.Close()
+
+	steps := []ChainStep{}
+	for rows.Next() {
+		var step ChainStep
+		if err := rows.Scan(&step.Order, &step.Intent, &step.Location, &step.DelaySeconds); err != nil {
+			return nil, fmt.Errorf("failed to scan chain step: %w", err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// insertChainSteps stores steps inside tx, numbering them in the order given
+func insertChainSteps(tx *sql.Tx, chainID int64, steps []ChainStep) error {
+	for i, step := range steps {
+		if _, err := tx.Exec("INSERT INTO chain_step (chain_id, step_order, intent_name, location_name, delay_seconds) VALUES (?, ?, ?, ?, ?)",
+			chainID, i+1, step.Intent, step.Location, step.DelaySeconds); err != nil {
+			return fmt.Errorf("failed to add chain step: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *Database) CreateChain(name string, steps []ChainStep) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO chains (name) VALUES (?)", name)
+	if err != nil {
+		return fmt.Errorf("failed to create chain: %w", err)
+	}
+	chainID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to create chain: %w", err)
+	}
+	if err = insertChainSteps(tx, chainID, steps); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *Database) UpdateChain(name string, steps []ChainStep) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var chainID int64
+	err = tx.QueryRow("SELECT id FROM chains WHERE name = ?", name).Scan(&chainID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("chain '%s' not found", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query chain: %w", err)
+	}
+	if _, err = tx.Exec("DELETE FROM chain_step WHERE chain_id = ?", chainID); err != nil {
+		return fmt.Errorf("failed to delete existing chain steps: %w", err)
+	}
+	if err = insertChainSteps(tx, chainID, steps); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *Database) DeleteChain(name string) error {
+	result, err := d.db.Exec("DELETE FROM chains WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete chain: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("chain '%s' not found", name)
+	}
+	return nil
+}
+
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+
+	auditEntityIntent        = "intent"
+	auditEntityLocation      = "location"
+	auditEntityPlaylistGroup = "playlist_group"
+	auditEntityChain         = "chain"
+	auditEntityVolumeProfile = "volume_profile"
+)
+
+// AuditEntry is one row of audit_log. OldValue is empty for creates and
+// NewValue for deletes.
+type AuditEntry struct {
+	ID         int             `json:"id"`
+	Operation  string          `json:"operation"`
+	EntityType string          `json:"entity_type"`
+	EntityName string          `json:"entity_name"`
+	ChangedBy  string          `json:"changed_by"`
+	ChangedAt  time.Time       `json:"changed_at"`
+	OldValue   json.RawMessage `json:"old_value,omitempty"`
+	NewValue   json.RawMessage `json:"new_value,omitempty"`
+}
+
+// RecordAudit appends entry to audit_log; ID and ChangedAt are assigned by the database
+func (d *Database) RecordAudit(entry AuditEntry) error {
+	rawOrNull := func(value json.RawMessage) interface{} {
+		if len(value) == 0 {
+			return nil
+		}
+		return string(value)
+	}
+	_, err := d.db.Exec("INSERT INTO audit_log (operation, entity_type, entity_name, changed_by, old_value, new_value) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.Operation, entry.EntityType, entry.EntityName, entry.ChangedBy, rawOrNull(entry.OldValue), rawOrNull(entry.NewValue))
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// ListAudit returns the newest audit entries first, only those for entityType
+// when it isn't empty
+func (d *Database) ListAudit(entityType string, limit, offset int) ([]AuditEntry, error) {
+	query := "SELECT id, operation, entity_type, entity_name, changed_by, changed_at, old_value, new_value FROM audit_log"
+	var args []interface{}
+	if entityType != "" {
+		query += " WHERE entity_type = ?"
+		args = append(args, entityType)
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var oldValue, newValue sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Operation, &entry.EntityType, &entry.EntityName, &entry.ChangedBy, &entry.ChangedAt, &oldValue, &newValue); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		if oldValue.Valid {
+			entry.OldValue = json.RawMessage(oldValue.String)
+		}
+		if newValue.Valid {
+			entry.NewValue = json.RawMessage(newValue.String)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// AuditLogger wraps Database's create, update and delete methods, recording
+// each successful call in audit_log with the entity as JSON before and after.
+// changedBy identifies the caller. A failure to write the audit entry is logged
+// and doesn't undo the change.
+type AuditLogger struct {
+	db *Database
+}
+
+func NewAuditLogger(db *Database) *AuditLogger {
+	return &AuditLogger{db: db}
+}
+
+// record stores one audit entry. oldValue and newValue are nil when the entity
+// didn't exist before or doesn't after.
+func (a *AuditLogger) record(changedBy, operation, entityType, entityName string, oldValue, newValue interface{}) {
+	entry := AuditEntry{Operation: operation, EntityType: entityType, EntityName: entityName, ChangedBy: changedBy}
+	var err error
+	if oldValue != nil {
+		if entry.OldValue, err = json.Marshal(oldValue); err != nil {
+			log.Printf("[Audit] Failed to marshal old %s '%s': %v", entityType, entityName, err)
+		}
+	}
+	if newValue != nil {
+		if entry.NewValue, err = json.Marshal(newValue); err != nil {
+			log.Printf("[Audit] Failed to marshal new %s '%s': %v", entityType, entityName, err)
+		}
+	}
+	if err := a.db.RecordAudit(entry); err != nil {
+		log.Printf("[Audit] Warning: %v", err)
+	}
+}
+
+// The snapshot helpers return the entity as stored, or nil if it can't be read
+
+func (a *AuditLogger) intent(name string) interface{} {
+	if intent, err := a.db.GetIntent(name); err == nil {
+		return intent
+	}
+	return nil
+}
+
+func (a *AuditLogger) location(name string) interface{} {
+	if location, err := a.db.GetLocation(name); err == nil {
+		return location
+	}
+	return nil
+}
+
+func (a *AuditLogger) playlistGroup(name string) interface{} {
+	playlists, coverArt, err := a.db.GetGroupItems(name)
+	if err != nil {
+		return nil
+	}
+	tags, _ := a.db.GetGroupTags(name)
+	return PlaylistGroup{Name: name, Playlists: playlists, CoverArt: coverArt, Tags: tags}
+}
+
+func (a *AuditLogger) chain(name string) interface{} {
+	if chain, err := a.db.GetChain(name); err == nil {
+		return chain
+	}
+	return nil
+}
+
+func (a *AuditLogger) CreateIntent(changedBy, name string, playlists []string, playlistGroup string, settings IntentSettings) error {
+	if err := a.db.CreateIntent(name, playlists, playlistGroup, settings); err != nil {
+		return err
+	}
+	name = a.db.normalizeName(name)
+	a.record(changedBy, auditCreate, auditEntityIntent, name, nil, a.intent(name))
+	return nil
+}
+
+// CreateIntentsBulk records an entry for every intent the batch created
+func (a *AuditLogger) CreateIntentsBulk(ctx context.Context, changedBy string, intents []IntentInput) (int, []BulkError) {
+	created, failures := a.db.CreateIntentsBulk(ctx, intents)
+	failed := make(map[int]bool, len(failures))
+	for _, failure := range failures {
+		failed[failure.Index] = true
+	}
+	for i, intent := range intents {
+		if !failed[i] {
+			name := a.db.normalizeName(intent.Name)
+			a.record(changedBy, auditCreate, auditEntityIntent, name, nil, a.intent(name))
+		}
+	}
+	return created, failures
+}
+
+func (a *AuditLogger) UpdateIntent(changedBy, name string, playlists []string, playlistGroup string, settings IntentSettings) error {
+	before := a.intent(name)
+	if err := a.db.UpdateIntent(name, playlists, playlistGroup, settings); err != nil {
+		return err
+	}
+	a.record(changedBy, auditUpdate, auditEntityIntent, name, before, a.intent(name))
+	return nil
+}
+
+func (a *AuditLogger) DeleteIntent(changedBy, name string) error {
+	before := a.intent(name)
+	if err := a.db.DeleteIntent(name); err != nil {
+		return err
+	}
+	a.record(changedBy, auditDelete, auditEntityIntent, name, before, nil)
+	return nil
+}
+
+func (a *AuditLogger) CreateLocation(changedBy, name, speakerEntity, displayName, description string) error {
+	if err := a.db.CreateLocation(name, speakerEntity, displayName, description); err != nil {
+		return err
+	}
+	name = a.db.normalizeName(name)
+	a.record(changedBy, auditCreate, auditEntityLocation, name, nil, a.location(name))
+	return nil
+}
+
+func (a *AuditLogger) UpdateLocation(changedBy, name, speakerEntity, displayName, description string) error {
+	before := a.location(name)
+	if err := a.db.UpdateLocation(name, speakerEntity, displayName, description); err != nil {
+		return err
+	}
+	a.record(changedBy, auditUpdate, auditEntityLocation, name, before, a.location(name))
+	return nil
+}
+
+// SetLocationHA records the change without the token itself, only whether one is set
+func (a *AuditLogger) SetLocationHA(changedBy, name string, ha LocationHA) error {
+	snapshot := func() interface{} {
+		current, err := a.db.GetLocationHA(name)
+		if err != nil {
+			return nil
+		}
+		return locationHAResponse(current)
+	}
+	before := snapshot()
+	if err := a.db.SetLocationHA(name, ha); err != nil {
+		return err
+	}
+	a.record(changedBy, auditUpdate, auditEntityLocation, name, before, snapshot())
+	return nil
+}
+
+func (a *AuditLogger) DeleteLocation(changedBy, name string) error {
+	before := a.location(name)
+	if err := a.db.DeleteLocation(name); err != nil {
+		return err
+	}
+	a.record(changedBy, auditDelete, auditEntityLocation, name, before, nil)
+	return nil
+}
+
+func (a *AuditLogger) CreateVolumeProfile(changedBy string, p VolumeProfile) (int64, error) {
+	id, err := a.db.CreateVolumeProfile(p)
+	if err != nil {
+		return 0, err
+	}
+	p.ID = int(id)
+	a.record(changedBy, auditCreate, auditEntityVolumeProfile, p.LocationName, nil, p)
+	return id, nil
+}
+
+func (a *AuditLogger) DeleteVolumeProfile(changedBy, locationName string, id int) error {
+	var before interface{}
+	if profiles, err := a.db.GetVolumeProfiles(locationName); err == nil {
+		for _, p := range profiles {
+			if p.ID == id {
+				before = p
+			}
+		}
+	}
+	if err := a.db.DeleteVolumeProfile(locationName, id); err != nil {
+		return err
+	}
+	a.record(changedBy, auditDelete, auditEntityVolumeProfile, locationName, before, nil)
+	return nil
+}
+
+func (a *AuditLogger) CreatePlaylistGroup(changedBy, name string, playlists []string, coverArt map[string]string, tags []string) error {
+	if err := a.db.CreatePlaylistGroup(name, playlists, coverArt, tags); err != nil {
+		return err
+	}
+	a.record(changedBy, auditCreate, auditEntityPlaylistGroup, name, nil, a.playlistGroup(name))
+	return nil
+}
+
+func (a *AuditLogger) UpdatePlaylistGroup(changedBy, name string, playlists []string, coverArt map[string]string, tags []string) error {
+	before := a.playlistGroup(name)
+	if err := a.db.UpdatePlaylistGroup(name, playlists, coverArt, tags); err != nil {
+		return err
+	}
+	a.record(changedBy, auditUpdate, auditEntityPlaylistGroup, name, before, a.playlistGroup(name))
+	return nil
+}
+
+// RenamePlaylistGroup records the rename under the new name, plus an update for
+// each intent that followed the group to it
+func (a *AuditLogger) RenamePlaylistGroup(changedBy, oldName, newName string) error {
+	before := a.playlistGroup(oldName)
+	intents, _ := a.db.IntentsUsingGroup(oldName)
+	var intentsBefore []interface{}
+	for _, intent := range intents {
+		intentsBefore = append(intentsBefore, a.intent(intent))
+	}
+	if err := a.db.RenamePlaylistGroup(oldName, newName); err != nil {
+		return err
+	}
+	a.record(changedBy, auditUpdate, auditEntityPlaylistGroup, newName, before, a.playlistGroup(newName))
+	for i, intent := range intents {
+		a.record(changedBy, auditUpdate, auditEntityIntent, intent, intentsBefore[i], a.intent(intent))
+	}
+	return nil
+}
+
+// DeletePlaylistGroup also records an update for each intent a forced delete
+// detaches from the group
+func (a *AuditLogger) DeletePlaylistGroup(changedBy, name string, force bool) error {
+	before := a.playlistGroup(name)
+	var intents []string
+	var intentsBefore []interface{}
+	if force {
+		intents, _ = a.db.IntentsUsingGroup(name)
+		for _, intent := range intents {
+			intentsBefore = append(intentsBefore, a.intent(intent))
+		}
+	}
+	if err := a.db.DeletePlaylistGroup(name, force); err != nil {
+		return err
+	}
+	a.record(changedBy, auditDelete, auditEntityPlaylistGroup, name, before, nil)
+	for i, intent := range intents {
+		a.record(changedBy, auditUpdate, auditEntityIntent, intent, intentsBefore[i], a.intent(intent))
+	}
+	return nil
+}
+
+func (a *AuditLogger) CreateChain(changedBy, name string, steps []ChainStep) error {
+	if err := a.db.CreateChain(name, steps); err != nil {
+		return err
+	}
+	a.record(changedBy, auditCreate, auditEntityChain, name, nil, a.chain(name))
+	return nil
+}
+
+func (a *AuditLogger) UpdateChain(changedBy, name string, steps []ChainStep) error {
+	before := a.chain(name)
+	if err := a.db.UpdateChain(name, steps); err != nil {
+		return err
+	}
+	a.record(changedBy, auditUpdate, auditEntityChain, name, before, a.chain(name))
+	return nil
+}
+
+func (a *AuditLogger) DeleteChain(changedBy, name string) error {
+	before := a.chain(name)
+	if err := a.db.DeleteChain(name); err != nil {
+		return err
+	}
+	a.record(changedBy, auditDelete, auditEntityChain, name, before, nil)
+	return nil
+}
+
+func (d *Database) GetAllAvailablePlaylists() ([]AvailablePlaylist, error) {
+	// playlist -> cover art URL ("" when unknown)
+	playlists := make(map[string]string)
+
+	rows, err := d.db.Query("SELECT playlist FROM intent WHERE playlist != '' AND playlist_group IS NULL")
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var playlistData string
+			if err := rows.Scan(&playlistData); err == nil {
+				for _, p := range parsePlaylists(playlistData) {
+					if _, ok := playlists[p]; !ok {
+						playlists[p] = ""
+					}
+				}
+			}
+		}
+	}
+
+	rows2, err := d.db.Query("SELECT playlist, MAX(COALESCE(cover_art_url, '')) FROM playlist_group_item GROUP BY playlist")
+	if err == nil {
+		defer rows2.Close()
+		for rows2.Next() {
+			var playlist, coverArtURL string
+			if err := rows2.Scan(&playlist, &coverArtURL); err == nil && playlist != "" {
+				if coverArtURL != "" || playlists[playlist] == "" {
+					playlists[playlist] = coverArtURL
+				}
+			}
+		}
+	}
+
+	result := make([]AvailablePlaylist, 0, len(playlists))
+	for p, coverArtURL := range playlists {
+		result = append(result, AvailablePlaylist{Playlist: p, CoverArtURL: coverArtURL})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Playlist < result[j].Playlist })
+	return result, nil
+}
+
+// FindDuplicatePlaylists returns the playlist URIs that belong to more than one group
+func (d *Database) FindDuplicatePlaylists() ([]string, error) {
+	rows, err := d.db.Query(`
+		SELECT playlist FROM playlist_group_item
+		GROUP BY playlist
+		HAVING COUNT(DISTINCT group_name) > 1
+		ORDER BY playlist`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query duplicate playlists: %w", err)
+	}
+	defer rows.Close()
+
+	duplicates := []string{}
+	for rows.Next() {
+		var playlist string
+		if err := rows.Scan(&playlist); err != nil {
+			return nil, fmt.Errorf("failed to scan playlist: %w", err)
+		}
+		duplicates = append(duplicates, playlist)
+	}
+	return duplicates, rows.Err()
+}
+
+// CleanupOrphanedPlaylistItems removes playlist_group_item entries that reference
+// non-existent groups and returns how many it removed
+func (d *Database) CleanupOrphanedPlaylistItems() (int64, error) {
+	result, err := d.db.Exec(`
+		DELETE FROM playlist_group_item 
+		WHERE group_name NOT IN (SELECT name FROM playlist_group)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cleanup orphaned playlist items: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected > 0 {
+		log.Printf("[DB] Cleaned up %d orphaned playlist_group_item entries", rowsAffected)
+	}
+	return rowsAffected, nil
+}
+
+// CleanupOrphanedIntentGroupRefs clears playlist_group on intents whose group no
+// longer exists and returns how many it cleared. Such intents fail to play
+// until given playlists or a group again.
+func (d *Database) CleanupOrphanedIntentGroupRefs() (int64, error) {
+	result, err := d.db.Exec(`
+		UPDATE intent SET playlist_group = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE playlist_group IS NOT NULL AND playlist_group NOT IN (SELECT name FROM playlist_group)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cleanup orphaned intent group references: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected > 0 {
+		log.Printf("[DB] Cleared %d intent references to missing playlist groups", rowsAffected)
+	}
+	return rowsAffected, nil
+}
+
+const (
+	triggeredViaHTTP  = "http"
+	triggeredViaMQTT  = "mqtt"
+	triggeredViaChain = "chain"
+)
+
+// RecordPlay appends a successful play to play_history and updates the intent's
+// play stats, including who triggered it. Plays look names up case-insensitively,
+// so the history stores the intent's and location's names as stored, not as
+// requested; names that match no row are kept as given.
+func (d *Database) RecordPlay(intentName, locationName, playlist, triggeredVia, triggeredBy string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO play_history (intent_name, location_name, playlist, triggered_via) VALUES ("+
+		"COALESCE((SELECT name FROM intent WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1), ?), "+
+		"COALESCE((SELECT name FROM location WHERE name = ? COLLATE NOCASE ORDER BY name = ? DESC LIMIT 1), ?), ?, ?)",
+		intentName, intentName, intentName, locationName, locationName, locationName, playlist, triggeredVia)
+	if err != nil {
+		return fmt.Errorf("failed to record play: %w", err)
+	}
+	_, err = tx.Exec("UPDATE intent SET play_count = COALESCE(play_count, 0) + 1, last_played_at = CURRENT_TIMESTAMP, last_triggered_by = ? WHERE name = ? COLLATE NOCASE",
+		nullIfEmpty(triggeredBy), intentName)
+	if err != nil {
+		return fmt.Errorf("failed to update intent play count: %w", err)
+	}
+	return tx.Commit()
+}
+
+type PlayHistoryEntry struct {
+	ID           int       `json:"id"`
+	IntentName   string    `json:"intent_name"`
+	LocationName string    `json:"location_name"`
+	Playlist     string    `json:"playlist"`
+	TriggeredVia string    `json:"triggered_via"`
+	PlayedAt     time.Time `json:"played_at"`
+}
+
+// getPlayHistory returns the most recent plays where column equals value
+func (d *Database) getPlayHistory(column, value string, limit, offset int) ([]PlayHistoryEntry, error) {
+	rows, err := d.db.Query("SELECT id, intent_name, location_name, playlist, triggered_via, played_at FROM play_history WHERE "+column+" = ? ORDER BY played_at DESC, id DESC LIMIT ? OFFSET ?",
+		value, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query play history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []PlayHistoryEntry{}
+	for rows.Next() {
+		var entry PlayHistoryEntry
+		if err := rows.Scan(&entry.ID, &entry.IntentName, &entry.LocationName, &entry.Playlist, &entry.TriggeredVia, &entry.PlayedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan play history: %w", err)
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+func (d *Database) GetIntentHistory(intentName string, limit, offset int) ([]PlayHistoryEntry, error) {
+	return d.getPlayHistory("intent_name", intentName, limit, offset)
+}
+
+func (d *Database) GetLocationHistory(locationName string, limit, offset int) ([]PlayHistoryEntry, error) {
+	return d.getPlayHistory("location_name", locationName, limit, offset)
+}
+
+type Stats struct {
+	TotalIntents        int        `json:"total_intents"`
+	TotalLocations      int        `json:"total_locations"`
+	TotalPlaylistGroups int        `json:"total_playlist_groups"`
+	TotalPlaysAllTime   int        `json:"total_plays_all_time"`
+	PlaysToday          int        `json:"plays_today"`
+	MostPlayedIntent    string     `json:"most_played_intent,omitempty"`
+	MostPlayedLocation  string     `json:"most_played_location,omitempty"`
+	LastPlayedAt        *time.Time `json:"last_played_at,omitempty"`
+}
+
+// sqliteTimeFormat matches how CURRENT_TIMESTAMP stores DATETIME values (UTC)
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// GetStats summarizes configuration counts and play history. When since is
+// non-zero the play totals, most-played and last-played fields only consider
+// plays at or after it.
+func (d *Database) GetStats(since time.Time) (*Stats, error) {
+	var stats Stats
+	var err error
+	if stats.TotalIntents, err = d.CountIntents(); err != nil {
+		return nil, err
+	}
+	if stats.TotalLocations, err = d.CountLocations(); err != nil {
+		return nil, err
+	}
+	if stats.TotalPlaylistGroups, err = d.CountPlaylistGroups(); err != nil {
+		return nil, err
+	}
+
+	where, args := "", []interface{}{}
+	if !since.IsZero() {
+		where, args = " WHERE played_at >= ?", []interface{}{since.UTC().Format(sqliteTimeFormat)}
+	}
+
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM play_history"+where, args...).Scan(&stats.TotalPlaysAllTime); err != nil {
+		return nil, fmt.Errorf("failed to count plays: %w", err)
+	}
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM play_history WHERE played_at >= date('now')").Scan(&stats.PlaysToday); err != nil {
+		return nil, fmt.Errorf("failed to count today's plays: %w", err)
+	}
+
+	mostPlayed := func(column string) (string, error) {
+		var name string
+		err := d.db.QueryRow("SELECT "+column+" FROM play_history"+where+" GROUP BY "+column+" ORDER BY COUNT(*) DESC, MAX(played_at) DESC LIMIT 1", args...).Scan(&name)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return name, err
+	}
+	if stats.MostPlayedIntent, err = mostPlayed("intent_name"); err != nil {
+		return nil, fmt.Errorf("failed to query most played intent: %w", err)
+	}
+	if stats.MostPlayedLocation, err = mostPlayed("location_name"); err != nil {
+		return nil, fmt.Errorf("failed to query most played location: %w", err)
+	}
+
+	var lastPlayed time.Time
+	err = d.db.QueryRow("SELECT played_at FROM play_history"+where+" ORDER BY played_at DESC, id DESC LIMIT 1", args...).Scan(&lastPlayed)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to query last play: %w", err)
+	}
+	if err == nil {
+		stats.LastPlayedAt = &lastPlayed
+	}
+
+	return &stats, nil
+}
+
+// Ping verifies the database connection is usable
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// Close closes the cached statements and then the database
+func (d *Database) Close() error {
+	d.resetStmts()
+	return d.db.Close()
+}
+
+// parsePlaylists parses playlist data from various formats (JSON array, comma-separated, one per line, or single)
+func parsePlaylists(data string) []string {
+	var playlists []string
+	if err := json.Unmarshal([]byte(data), &playlists); err == nil && len(playlists) > 0 {
+		return normalizePlaylists(playlists)
+	}
+	// Comma-separated, or one per line as pasted from a text file
+	if strings.ContainsAny(data, ",\n") {
+		return normalizePlaylists(strings.FieldsFunc(data, func(r rune) bool { return r == ',' || r == '\n' }))
+	}
+	if data != "" {
+		return normalizePlaylists([]string{data})
+	}
+	return []string{}
+}
+
+// normalizePlaylistURI trims uri and lowercases its scheme and service portion,
+// so "Spotify:Playlist:ABC " becomes "spotify:playlist:ABC". IDs are left alone
+// because providers such as Spotify treat them case-sensitively.
+func normalizePlaylistURI(uri string) string {
+	uri = strings.TrimSpace(uri)
+	if scheme, rest, ok := strings.Cut(uri, "://"); ok {
+		service, path, hasPath := strings.Cut(rest, "/")
+		uri = strings.ToLower(scheme) + "://" + strings.ToLower(service)
+		if hasPath {
+			uri += "/" + path
+		}
+		return uri
+	}
+	parts := strings.Split(uri, ":")
+	prefix := len(parts) - 1
+	if prefix > 2 {
+		prefix = 2
+	}
+	for i := 0; i < prefix; i++ {
+		parts[i] = strings.ToLower(parts[i])
+	}
+	return strings.Join(parts, ":")
+}
+
+// normalizePlaylists normalizes each URI, dropping blanks and duplicates while
+// keeping the original order. A playlist listed twice is therefore picked no
+// more often than the others.
+func normalizePlaylists(playlists []string) []string {
+	seen := make(map[string]bool, len(playlists))
+	result := make([]string, 0, len(playlists))
+	for _, p := range playlists {
+		p = normalizePlaylistURI(p)
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		result = append(result, p)
+	}
+	return result
+}
+
+// selectRandomPlaylist returns a random playlist from the list
+func selectRandomPlaylist(playlists []string) (string, error) {
+	if len(playlists) == 0 {
+		return "", fmt.Errorf("no playlists available")
+	}
+	return playlists[mathrand.Intn(len(playlists))], nil
+}
+
+// setCORSHeaders sets common CORS headers
+func setCORSHeaders(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-ID, X-Total-Count")
+	if len(methods) > 0 {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match")
+	}
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// parseListOptions reads ?page= and ?limit= (1-based page). When neither is given
+// the zero ListOptions is returned so callers get every row, as before pagination.
+func parseListOptions(r *http.Request) (ListOptions, error) {
+	query := r.URL.Query()
+	pageParam, limitParam := query.Get("page"), query.Get("limit")
+	if pageParam == "" && limitParam == "" {
+		return ListOptions{}, nil
+	}
+
+	page, limit := 1, defaultPageLimit
+	if pageParam != "" {
+		n, err := strconv.Atoi(pageParam)
+		if err != nil || n < 1 {
+			return ListOptions{}, fmt.Errorf("page must be a positive integer")
+		}
+		page = n
+	}
+	if limitParam != "" {
+		n, err := strconv.Atoi(limitParam)
+		if err != nil || n < 1 {
+			return ListOptions{}, fmt.Errorf("limit must be a positive integer")
+		}
+		limit = n
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return ListOptions{Limit: limit, Offset: (page - 1) * limit}, nil
+}
+
+// parseSearchSort adds ?q=, ?sort= and ?dir= to opts
+func parseSearchSort(r *http.Request, opts ListOptions) (ListOptions, error) {
+	query := r.URL.Query()
+	opts.Search = strings.TrimSpace(query.Get("q"))
+	opts.Sort = query.Get("sort")
+	switch strings.ToLower(query.Get("dir")) {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("dir must be 'asc' or 'desc'")
+	}
+	if opts.Sort != "" {
+		if _, ok := intentSortColumns[opts.Sort]; !ok {
+			return opts, fmt.Errorf("unsupported sort field '%s'", opts.Sort)
+		}
+	}
+	return opts, nil
+}
+
+const defaultHistoryLimit = 20
+
+// parseLimitOffset reads ?limit= and ?offset=, capping limit at maxPageLimit
+func parseLimitOffset(r *http.Request, defaultLimit int) (limit, offset int, err error) {
+	query := r.URL.Query()
+	limit = defaultLimit
+	if param := query.Get("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer")
+		}
+	}
+	if param := query.Get("offset"); param != "" {
+		if offset, err = strconv.Atoi(param); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, offset, nil
+}
+
+// setTotalCount reports the unpaginated row count in X-Total-Count
+func setTotalCount(w http.ResponseWriter, count func() (int, error)) error {
+	total, err := count()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	return nil
+}
+
+// handleOptions handles OPTIONS requests for CORS
+func handleOptions(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+}
+
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// withRequestID tags each request with an ID, taken from X-Request-ID or generated
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// newRequestID returns a random UUIDv4 string
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// requiresAuth reports whether path is an API route protected by AUTH_TOKEN.
+// Health checks, the API docs and the static UI stay open.
+func requiresAuth(path string) bool {
+	if isAPIDocsPath(path) {
+		return false
+	}
+	return strings.HasPrefix(path, "/api/") || path == "/play"
+}
+
+// clientIP returns the IP address r came from
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// changedBy identifies the caller of r in the audit log. AUTH_TOKEN is a single
+// shared token with no user behind it, so this is the client IP.
+func changedBy(r *http.Request) string {
+	return clientIP(r)
+}
+
+// withAuth rejects API requests lacking a matching "Authorization: Bearer <token>"
+// header. It is a no-op while no AUTH_TOKEN is configured.
+func (c *Coordinator) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := c.currentConfig().AuthToken
+		if token == "" || r.Method == http.MethodOptions || !requiresAuth(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logf(r.Context(), "[Auth] Rejected %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="music-coordinator"`)
+			c.sendError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipRateLimiter hands out a token bucket per client IP
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*ipLimiterEntry
+	rps      rate.Limit
+	burst    int
+}
+
+type ipLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPRateLimiter(rps float64, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		limiters: make(map[string]*ipLimiterEntry),
+		rps:      rate.Limit(rps),
+		burst:    burst,
+	}
+}
+
+func (l *ipRateLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiterEntry{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+// SetLimits changes the rate and burst for new and existing clients
+func (l *ipRateLimiter) SetLimits(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rps = rate.Limit(rps)
+	l.burst = burst
+	for _, entry := range l.limiters {
+		entry.limiter.SetLimit(l.rps)
+		entry.limiter.SetBurst(l.burst)
+	}
+}
+
+// cleanup drops clients that haven't been seen for maxAge
+func (l *ipRateLimiter) cleanup(maxAge time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-maxAge)
+	for ip, entry := range l.limiters {
+		if entry.lastSeen.Before(cutoff) {
+			delete(l.limiters, ip)
+		}
+	}
+}
+
+// runCleanup periodically evicts stale clients until done is closed
+func (l *ipRateLimiter) runCleanup(done <-chan struct{}) {
+	ticker := time.NewTicker(rateLimitCleanupEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.cleanup(rateLimitStaleAfter)
+		case <-done:
+			return
+		}
+	}
+}
+
+// Limit rejects mutating requests over the client's rate with 429 and Retry-After
+func (l *ipRateLimiter) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		reservation := l.get(ip).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			logf(r.Context(), "[RateLimit] Rejected %s %s from %s", r.Method, r.URL.Path, ip)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(IntentResponse{Success: false, Error: "rate limit exceeded"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipResponseWriter buffers the first gzipMinSize bytes of a response and only
+// switches to gzip once the body is known to be large enough to benefit
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start commits the headers and the buffered body, compressed or not
+func (g *gzipResponseWriter) start(compress bool) error {
+	g.decided = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if compress && g.Header().Get("Content-Encoding") == "" {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+		_, err := g.gz.Write(g.buf)
+		g.buf = nil
+		return err
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	_, err := g.ResponseWriter.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		g.start(false)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Close writes out anything still buffered and terminates the gzip stream
+func (g *gzipResponseWriter) Close() error {
+	if !g.decided {
+		if err := g.start(false); err != nil {
+			return err
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// withGzip compresses /api/ responses larger than gzipMinSize for clients that accept gzip
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logf logs like log.Printf, prefixed with the request ID carried by ctx (if any)
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDFromContext(ctx); id != "" {
+		format = "[req=" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// MQTTPublisher sends messages; the coordinator publishes play_media commands and
+// play confirmations through it
+type MQTTPublisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+}
+
+// MQTTSubscriber registers handlers for the play and control topics
+type MQTTSubscriber interface {
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+}
+
+// MQTTClient is the part of the paho client the coordinator uses, so tests can
+// swap in a fake
+type MQTTClient interface {
+	MQTTPublisher
+	MQTTSubscriber
+	IsConnected() bool
+	Disconnect(quiesce uint)
+}
+
+type Coordinator struct {
+	db          *Database
+	audit       *AuditLogger
+	config      *Config
+	configMu    sync.RWMutex
+	haClient    *HAClient
+	maClient    *MAClient
+	mqttClient  MQTTClient
+	playLimiter *ipRateLimiter
+	etags       *etagCache
+	events      *eventBus
+	hub         *websocketHub
+	mqttDedup   *mqttDedupCache
+
+	queueMu   sync.Mutex
+	playQueue map[string][]QueueEntry // keyed by queueKey(location name)
+
+	chainMu   sync.Mutex
+	chainRuns map[string]*chainRun // running chains by name
+
+	muteMu     sync.Mutex
+	muted      bool
+	mutedUntil time.Time // zero while muted means until unmuted
+
+	undoMu    sync.Mutex
+	undoStack []PlayRecord // most recent last, at most undoStackDepth entries
+
+	haClientsMu sync.Mutex
+	haClients   map[string]*HAClient // for locations with their own HA, by URL and token
+
+	// Totals reported on /metrics, refreshed by runCountRefresh
+	intentsTotal   atomic.Int64
+	locationsTotal atomic.Int64
+
+	done         chan struct{} // closed by Shutdown to stop background loops
+	shutdownOnce sync.Once
+	playsMu      sync.Mutex
+	shuttingDown bool
+	plays        sync.WaitGroup // in-flight plays, waited on by Shutdown
+}
+
+func NewCoordinator(db *Database, config *Config) (*Coordinator, error) {
+	coordinator := &Coordinator{
+		db:          db,
+		audit:       NewAuditLogger(db),
+		config:      config,
+		haClient:    NewHAClient(config.HAURL, config.HAToken, config.PlayTimeout, config.HAMediaPlayerCacheTTL, config.HAMaxRetries),
+		maClient:    NewMAClient(config.MAAPIURL, config.MAToken, config.PlayTimeout),
+		playLimiter: newIPRateLimiter(config.RateLimitRPS, config.RateLimitBurst),
+		etags:       newETagCache(),
+		events:      &eventBus{},
+		hub:         newWebsocketHub(),
+		mqttDedup:   newMQTTDedupCache(mqttDedupCacheSize, time.Duration(config.MQTTDedupWindowSeconds)*time.Second),
+		playQueue:   make(map[string][]QueueEntry),
+		chainRuns:   make(map[string]*chainRun),
+		done:        make(chan struct{}),
+	}
+	go coordinator.hub.run()
+	db.SetNormalizeNames(config.NormalizeNames)
+
+	// Initialize MQTT client
+	mqttClient, err := initMQTTClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize MQTT client: %w", err)
+	}
+	coordinator.mqttClient = mqttClient
+
+	// Subscribe to play requests
+	if err := coordinator.subscribeToPlayRequests(); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to MQTT topics: %w", err)
+	}
+	if err := coordinator.subscribeToControl(); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to MQTT topics: %w", err)
+	}
+
+	return coordinator, nil
+}
+
+const (
+	mqttStatusOnline      = "online"
+	mqttStatusOffline     = "offline"
+	mqttDisconnectQuiesce = 250 // ms
+	statusPublishTimeout  = time.Second
+)
+
+// ErrShuttingDown is returned for plays requested once Shutdown has started
+var ErrShuttingDown = errors.New("coordinator is shutting down")
+
+// trackPlay registers an in-flight play for Shutdown to wait on. It returns
+// false once shutdown has begun; otherwise the caller must call c.plays.Done.
+func (c *Coordinator) trackPlay() bool {
+	c.playsMu.Lock()
+	defer c.playsMu.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.plays.Add(1)
+	return true
+}
+
+// Shutdown stops background loops and running chains, waits for in-flight plays
+// until ctx is done, then marks the coordinator offline on mqttStatusTopic,
+// disconnects MQTT and closes the database. The HTTP server should be shut down
+// first so no new requests arrive.
+func (c *Coordinator) Shutdown(ctx context.Context) error {
+	c.shutdownOnce.Do(func() { close(c.done) })
+	c.playsMu.Lock()
+	c.shuttingDown = true
+	c.playsMu.Unlock()
+
+	// Chains started before shuttingDown was set are in chainRuns by now; they
+	// are cancelled here and awaited with the other plays below.
+	c.chainMu.Lock()
+	for name, run := range c.chainRuns {
+		run.cancel()
+		delete(c.chainRuns, name)
+	}
+	c.chainMu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		c.plays.Wait()
+		close(finished)
+	}()
+	var errs []error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("in-flight plays did not finish: %w", ctx.Err()))
+	}
+
+	if c.mqttClient != nil {
+		if c.mqttClient.IsConnected() {
+			token := c.mqttClient.Publish(mqttStatusTopic, 0, true, mqttStatusOffline)
+			if !token.WaitTimeout(statusPublishTimeout) {
+				log.Printf("[MQTT] Timed out publishing offline status")
+			} else if token.Error() != nil {
+				log.Printf("[MQTT] Failed to publish offline status: %v", token.Error())
+			}
+		}
+		c.mqttClient.Disconnect(mqttDisconnectQuiesce)
+	}
+	if err := c.db.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close database: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// currentConfig returns the active configuration; it may be swapped by ReloadConfig
+func (c *Coordinator) currentConfig() *Config {
+	c.configMu.RLock()
+	defer c.configMu.RUnlock()
+	return c.config
+}
+
+// ReloadConfig applies the settings from next that don't need a reconnect. Settings that
+// do are left as they were and logged so the operator knows to restart.
+func (c *Coordinator) ReloadConfig(next *Config) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	prev := c.config
+	for _, name := range restartRequiredChanges(prev, next) {
+		log.Printf("[Config] Warning: %s changed; restart required for it to take effect", name)
+	}
+
+	applied := *next
+	applied.Port = prev.Port
+	applied.DBPath = prev.DBPath
+	applied.HAURL = prev.HAURL
+	applied.MAAPIURL = prev.MAAPIURL
+	applied.MQTTBroker = prev.MQTTBroker
+	applied.MQTTBrokerFallback = prev.MQTTBrokerFallback
+	applied.MQTTUser = prev.MQTTUser
+	applied.MQTTPass = prev.MQTTPass
+	applied.MQTTClientID = prev.MQTTClientID
+	applied.UIDir = prev.UIDir
+	applied.PlayTimeout = prev.PlayTimeout
+	applied.HTTPSPort = prev.HTTPSPort
+	applied.TLSCert = prev.TLSCert
+	applied.TLSKey = prev.TLSKey
+	applied.AutocertDomain = prev.AutocertDomain
+	applied.AutocertCache = prev.AutocertCache
+	applied.HTTPReadTimeout = prev.HTTPReadTimeout
+	applied.HTTPWriteTimeout = prev.HTTPWriteTimeout
+	applied.HTTPIdleTimeout = prev.HTTPIdleTimeout
+	applied.HTTPReadHeaderTimeout = prev.HTTPReadHeaderTimeout
+	c.config = &applied
+
+	c.haClient.SetToken(applied.HAToken)
+	c.maClient.SetToken(applied.MAToken)
+	c.haClient.SetMediaPlayerCacheTTL(applied.HAMediaPlayerCacheTTL)
+	c.haClient.SetMaxRetries(applied.HAMaxRetries)
+	c.haClientsMu.Lock()
+	for _, client := range c.haClients {
+		client.SetMediaPlayerCacheTTL(applied.HAMediaPlayerCacheTTL)
+		client.SetMaxRetries(applied.HAMaxRetries)
+	}
+	c.haClientsMu.Unlock()
+	c.mqttDedup.SetWindow(time.Duration(applied.MQTTDedupWindowSeconds) * time.Second)
+	c.playLimiter.SetLimits(applied.RateLimitRPS, applied.RateLimitBurst)
+	c.db.SetNormalizeNames(applied.NormalizeNames)
+	log.Printf("[Config] Configuration reloaded")
+}
+
+// reloadFromEnvironment re-reads the config file and environment and applies the
+// result, keeping the current configuration if it fails to load or validate
+func (c *Coordinator) reloadFromEnvironment() {
+	next, err := LoadConfig()
+	if err != nil {
+		log.Printf("[Config] Reload failed: %v", err)
+		return
+	}
+	if errs := next.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("[Config] Reload rejected: %v", err)
+		}
+		return
+	}
+	c.ReloadConfig(next)
+}
+
+// mqttWebsocketPorts are the broker URL schemes paho dials over WebSocket
+// (e.g. wss://broker.example.com:8884/mqtt), with the port each defaults to
+var mqttWebsocketPorts = map[string]string{"ws": "80", "wss": "443"}
+
+func initMQTTClient(config *Config) (mqtt.Client, error) {
+	brokers := []string{config.MQTTBroker}
+	if config.MQTTBrokerFallback != "" {
+		brokers = append(brokers, config.MQTTBrokerFallback)
+	}
+	for _, broker := range brokers {
+		if u, err := url.Parse(broker); err == nil && mqttWebsocketPorts[u.Scheme] != "" {
+			log.Printf("[MQTT] Using WebSocket transport for %s", broker)
+		}
+	}
+	client, _, err := connectMQTT(config, brokers, mqttFailoverTimeout)
+	return client, err
+}
+
+// connectMQTT connects to the first reachable broker in order. Every broker
+// except the last gets timeout to connect before moving on; the last one is
+// retried until it answers, as a single broker always was. All brokers are
+// registered with each client so auto-reconnect can fail over later too.
+// Returns the client and the broker it connected to.
+func connectMQTT(config *Config, brokers []string, timeout time.Duration) (mqtt.Client, string, error) {
+	for i, broker := range brokers {
+		var (
+			mu        sync.Mutex
+			connected string
+		)
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(broker)
+		for j, other := range brokers {
+			if j != i {
+				opts.AddBroker(other)
+			}
+		}
+		opts.SetClientID(config.MQTTClientID)
+		if config.MQTTUser != "" {
+			opts.SetUsername(config.MQTTUser)
+			opts.SetPassword(config.MQTTPass)
+		}
+		opts.SetAutoReconnect(true)
+		opts.SetConnectRetry(true)
+		opts.SetConnectRetryInterval(5 * time.Second)
+		opts.SetKeepAlive(60 * time.Second)
+		opts.SetPingTimeout(10 * time.Second)
+		// Only used for wss://, ssl:// and tls:// brokers; certificates are
+		// checked against the system roots
+		opts.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+		opts.SetConnectionAttemptHandler(func(u *url.URL, tlsCfg *tls.Config) *tls.Config {
+			mu.Lock()
+			connected = u.String()
+			mu.Unlock()
+			return tlsCfg
+		})
+		opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Printf("[MQTT] Connection lost: %v", err)
+		})
+		opts.SetWill(mqttStatusTopic, mqttStatusOffline, 0, true)
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			mu.Lock()
+			defer mu.Unlock()
+			log.Printf("[MQTT] Connected to broker %s", connected)
+			client.Publish(mqttStatusTopic, 0, true, mqttStatusOnline)
+		})
+
+		client := mqtt.NewClient(opts)
+		token := client.Connect()
+		if i < len(brokers)-1 && !token.WaitTimeout(timeout) {
+			client.Disconnect(0)
+			log.Printf("[MQTT] Broker %s did not connect within %s, trying %s", broker, timeout, brokers[i+1])
+			continue
+		}
+		if token.Wait() && token.Error() != nil {
+			if i < len(brokers)-1 {
+				log.Printf("[MQTT] Failed to connect to broker %s: %v, trying %s", broker, token.Error(), brokers[i+1])
+				continue
+			}
+			return nil, "", fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return client, connected, nil
+	}
+	return nil, "", fmt.Errorf("failed to connect to MQTT broker: no brokers configured")
+}
+
+func (c *Coordinator) subscribeToPlayRequests() error {
+	token := c.mqttClient.Subscribe(mqttPlayTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+		ctx := mqttRequestContext()
+		if c.mqttDedup.seen(msg.Payload(), time.Now()) {
+			logf(ctx, "[MQTT] Ignoring duplicate play request on %s", msg.Topic())
+			return
+		}
+		var req IntentRequest
+		if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+			logf(ctx, "[MQTT] Failed to parse play request: %v", err)
+			return
+		}
+		if err := c.processPlayRequest(ctx, req); err != nil {
+			logf(ctx, "[MQTT] Failed to process play request: %v", err)
+		}
+	})
+	if err := waitToken(token, c.currentConfig().PlayTimeout); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", mqttPlayTopic, err)
+	}
+
+	// Intent and location encoded in the topic; the payload is ignored
+	token = c.mqttClient.Subscribe(mqttPlayRouteTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+		ctx := mqttRequestContext()
+		req, ok := parsePlayRouteTopic(msg.Topic())
+		if !ok {
+			logf(ctx, "[MQTT] Ignoring play request on malformed topic %s", msg.Topic())
+			return
+		}
+		if c.mqttDedup.seen([]byte(msg.Topic()), time.Now()) {
+			logf(ctx, "[MQTT] Ignoring duplicate play request on %s", msg.Topic())
+			return
+		}
+		if err := c.processPlayRequest(ctx, req); err != nil {
+			logf(ctx, "[MQTT] Failed to process play request: %v", err)
+		}
+	})
+	if err := waitToken(token, c.currentConfig().PlayTimeout); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", mqttPlayRouteTopic, err)
+	}
+	return nil
+}
+
+// mqttRequestContext returns a context carrying a fresh request ID, so the log
+// lines for one MQTT message can be told apart like those of an HTTP request
+func mqttRequestContext() context.Context {
+	return context.WithValue(context.Background(), requestIDKey, newRequestID())
+}
+
+// parsePlayRouteTopic extracts the intent and location from a
+// music-coordinator/play/{intent}/{location} topic
+func parsePlayRouteTopic(topic string) (IntentRequest, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return IntentRequest{}, false
+	}
+	return IntentRequest{Intent: parts[2], Location: parts[3]}, true
+}
+
+const (
+	controlReloadConfig = "reload_config"
+	controlMuteAll      = "mute_all"
+	controlUnmuteAll    = "unmute_all"
+)
+
+// ControlMessage is a command received on mqttControlTopic
+type ControlMessage struct {
+	Command         string `json:"command"`
+	DurationMinutes int    `json:"duration_minutes,omitempty"` // mute_all only; 0 mutes until unmute_all
+}
+
+func (c *Coordinator) subscribeToControl() error {
+	token := c.mqttClient.Subscribe(mqttControlTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+		c.handleControlMessage(msg.Payload())
+	})
+	if err := waitToken(token, c.currentConfig().PlayTimeout); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", mqttControlTopic, err)
+	}
+	return nil
+}
+
+func (c *Coordinator) handleControlMessage(payload []byte) {
+	var msg ControlMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("[MQTT] Failed to parse control message: %v", err)
+		return
+	}
+
+	switch msg.Command {
+	case controlReloadConfig:
+		log.Printf("[Config] Reload requested over MQTT, reloading configuration")
+		c.reloadFromEnvironment()
+	case controlMuteAll:
+		if msg.DurationMinutes < 0 {
+			log.Printf("[MQTT] Ignoring mute_all with negative duration_minutes %d", msg.DurationMinutes)
+			return
+		}
+		c.muteAll(time.Duration(msg.DurationMinutes) * time.Minute)
+	case controlUnmuteAll:
+		c.unmuteAll()
+	default:
+		log.Printf("[MQTT] Unknown control command '%s'", msg.Command)
+	}
+}
+
+// muteAll stops every location from starting playback for d, or until
+// unmuteAll when d is zero
+func (c *Coordinator) muteAll(d time.Duration) {
+	c.muteMu.Lock()
+	defer c.muteMu.Unlock()
+	c.muted = true
+	c.mutedUntil = time.Time{}
+	if d > 0 {
+		c.mutedUntil = time.Now().Add(d)
+		log.Printf("[Play] All locations muted until %s", c.mutedUntil.Format(time.RFC3339))
+		return
+	}
+	log.Printf("[Play] All locations muted until unmuted")
+}
+
+func (c *Coordinator) unmuteAll() {
+	c.muteMu.Lock()
+	c.muted = false
+	c.mutedUntil = time.Time{}
+	c.muteMu.Unlock()
+	log.Printf("[Play] All locations unmuted")
+}
+
+// checkMuted returns an error while a mute_all is in effect
+func (c *Coordinator) checkMuted() error {
+	c.muteMu.Lock()
+	defer c.muteMu.Unlock()
+	if !c.muted {
+		return nil
+	}
+	if c.mutedUntil.IsZero() {
+		return fmt.Errorf("all locations are muted")
+	}
+	if time.Now().Before(c.mutedUntil) {
+		return fmt.Errorf("all locations are muted until %s", c.mutedUntil.Format(time.RFC3339))
+	}
+	c.muted = false
+	return nil
+}
+
+// mqttDedupCache remembers the hashes of the most recent MQTT payloads so a
+// message redelivered by a QoS retry doesn't start playback twice
+type mqttDedupCache struct {
+	mu      sync.Mutex
+	size    int
+	window  time.Duration
+	entries []mqttDedupEntry // oldest first
+}
+
+type mqttDedupEntry struct {
+	hash [sha256.Size]byte
+	at   time.Time
+}
+
+func newMQTTDedupCache(size int, window time.Duration) *mqttDedupCache {
+	return &mqttDedupCache{size: size, window: window}
+}
+
+func (d *mqttDedupCache) SetWindow(window time.Duration) {
+	d.mu.Lock()
+	d.window = window
+	d.mu.Unlock()
+}
+
+// seen reports whether payload was already received within the window, and
+// records it as the most recent entry otherwise
+func (d *mqttDedupCache) seen(payload []byte, now time.Time) bool {
+	hash := sha256.Sum256(payload)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.window <= 0 {
+		return false
+	}
+	for i, e := range d.entries {
+		if e.hash != hash {
+			continue
+		}
+		if now.Sub(e.at) < d.window {
+			return true
+		}
+		d.entries = append(d.entries[:i], d.entries[i+1:]...)
+		break
+	}
+	d.entries = append(d.entries, mqttDedupEntry{hash: hash, at: now})
+	if len(d.entries) > d.size {
+		d.entries = d.entries[len(d.entries)-d.size:]
+	}
+	return false
+}
+
+// processPlayRequest handles a play request received over MQTT and publishes the
+// outcome to mqttPlayedTopic. MQTT 3.1.1 doesn't tell subscribers the
+// publisher's client ID, so publishers that want attribution set triggered_by
+// to it; other requests are recorded as triggered by "mqtt".
+func (c *Coordinator) processPlayRequest(ctx context.Context, req IntentRequest) error {
+	if req.TriggeredBy == "" {
+		req.TriggeredBy = triggeredViaMQTT
+	}
+	if len(req.Locations) > 0 {
+		fanOutCtx, cancel := context.WithTimeout(ctx, fanOutTimeout)
+		defer cancel()
+		report, err := c.playMulti(fanOutCtx, req, triggeredViaMQTT)
+		if err != nil {
+			c.publishPlayed(ctx, IntentResponse{Success: false, Error: err.Error()})
+			return err
+		}
+		c.publishPlayed(ctx, report)
+		if !report.Success {
+			return errors.New(report.Message)
+		}
+		return nil
+	}
+
+	playlist, speakerEntity, err := c.play(ctx, req, triggeredViaMQTT)
+	if err != nil {
+		c.publishPlayed(ctx, IntentResponse{Success: false, Error: err.Error()})
+		return err
+	}
+	c.publishPlayed(ctx, IntentResponse{
+		Success:                  true,
+		Message:                  fmt.Sprintf("Playing %s on '%s'", req.describe(), req.Location),
+		Playlist:                 playlist,
+		SpeakerEntity:            speakerEntity,
+		EstimatedDurationSeconds: c.estimateDuration(ctx, playlist),
+	})
+	return nil
+}
+
+// estimateDuration asks Music Assistant how long playlist runs, in whole seconds.
+// It's only a hint for automations, so failures are logged and give 0.
+func (c *Coordinator) estimateDuration(ctx context.Context, playlist string) int {
+	ctx, cancel := context.WithTimeout(ctx, maDurationTimeout)
+	defer cancel()
+	if !c.maClient.Enabled() {
+		return 0
+	}
+	duration, err := c.maClient.GetPlaylistDuration(ctx, playlist)
+	if err != nil {
+		logf(ctx, "[MA] No duration for %s: %v", playlist, err)
+		return 0
+	}
+	return int(duration.Round(time.Second) / time.Second)
+}
+
+// publishPlayed reports the outcome of an MQTT play request on mqttPlayedTopic so
+// automations can see what was selected
+func (c *Coordinator) publishPlayed(ctx context.Context, result interface{}) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		logf(ctx, "[MQTT] Failed to marshal play confirmation: %v", err)
+		return
+	}
+	token := c.mqttClient.Publish(mqttPlayedTopic, 0, false, payload)
+	if err := waitToken(token, c.currentConfig().PlayTimeout); err != nil {
+		logf(ctx, "[MQTT] Failed to publish to %s: %v", mqttPlayedTopic, err)
+	}
+}
+
+// waitToken waits up to timeout for token to complete and returns its error, or
+// a timeout error so an unresponsive broker can't block the caller
+func waitToken(token mqtt.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	return token.Error()
+}
+
+// playError is returned by play; status is the HTTP status the failure maps to
+type playError struct {
+	status int
+	err    error
+}
+
+func (e *playError) Error() string { return e.err.Error() }
+func (e *playError) Unwrap() error { return e.err }
+
+// playErrorStatus returns the HTTP status for an error from play
+func playErrorStatus(err error) int {
+	var pe *playError
+	if errors.As(err, &pe) {
+		return pe.status
+	}
+	return http.StatusInternalServerError
+}
+
+// applyVolumeProfile sets the speaker to the location's volume for the current
+// time of day, if a profile covers it. Failures are logged and don't stop the play.
+func (c *Coordinator) applyVolumeProfile(ctx context.Context, location, speakerEntity string) {
+	volume, ok, err := c.db.ActiveVolume(location, time.Now())
+	if err != nil {
+		logf(ctx, "[DB] Warning: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	data := map[string]interface{}{"entity_id": speakerEntity, "volume_level": volume}
+	if err := c.haFor(ctx, location).CallService(ctx, "media_player", "volume_set", data); err != nil {
+		logf(ctx, "[HA] Failed to apply volume profile on %s: %v", speakerEntity, err)
+		return
+	}
+	logf(ctx, "[HA] Set %s to volume %.2f from profile", speakerEntity, volume)
+}
+
+// intentPlaylistStatus returns the HTTP status for an error from GetIntentPlaylist
+func intentPlaylistStatus(err error) int {
+	if errors.Is(err, ErrOutsideActiveWindow) {
+		return http.StatusForbidden
+	}
+	return http.StatusNotFound
+}
+
+// play resolves req to a playlist and speaker, sends the play command and records
+// it. It is shared by the HTTP and MQTT entry points; errors are *playError.
+func (c *Coordinator) play(ctx context.Context, req IntentRequest, triggeredVia string) (playlist, speakerEntity string, err error) {
+	var errs ValidationErrors
+	if req.Intent == "" && req.PlaylistOverride == "" {
+		errs.add("intent", "required unless playlist_override is set")
+	}
+	if req.Location == "" {
+		errs.add("location", "required")
+	}
+	validateQueueMode(&errs, req.QueueMode)
+	validatePlaylistOverride(&errs, req.PlaylistOverride)
+	if len(errs) > 0 {
+		return "", "", &playError{http.StatusBadRequest, errs}
+	}
+	if !c.trackPlay() {
+		return "", "", &playError{http.StatusServiceUnavailable, ErrShuttingDown}
+	}
+	defer c.plays.Done()
+	if err := c.checkMuted(); err != nil {
+		return "", "", &playError{http.StatusServiceUnavailable, err}
+	}
+	playlist, err = c.resolvePlaylist(req)
+	if err != nil {
+		return "", "", err
+	}
+	enqueue, err := c.enqueueFor(req)
+	if err != nil {
+		return "", "", &playError{http.StatusInternalServerError, err}
+	}
+	speakerEntity, err = c.db.GetLocationSpeaker(req.Location)
+	if err != nil {
+		return "", "", &playError{http.StatusNotFound, err}
+	}
+	if c.currentConfig().CheckSpeakerAvailability {
+		if err := c.checkSpeakerAvailable(ctx, req.Location, speakerEntity); err != nil {
+			return "", "", &playError{http.StatusServiceUnavailable, err}
+		}
+	}
+	c.applyVolumeProfile(ctx, req.Location, speakerEntity)
+	if err := c.playMusic(ctx, req.Location, speakerEntity, playlist, enqueue); err != nil {
+		return "", "", &playError{http.StatusInternalServerError, fmt.Errorf("Failed to play music: %w", err)}
+	}
+	if enqueue == "" {
+		c.clearQueue(req.Location)
+	}
+	c.recordPlay(ctx, req, speakerEntity, playlist, triggeredVia)
+	return playlist, speakerEntity, nil
+}
+
+// validatePlaylistOverride adds a ValidationError to errs unless override is
+// empty or, by the rules intent playlists are parsed with, exactly one URI
+func validatePlaylistOverride(errs *ValidationErrors, override string) {
+	if override != "" && len(parsePlaylists(override)) != 1 {
+		errs.add("playlist_override", "must be a single playlist URI")
+	}
+}
+
+// resolvePlaylist returns the playlist req plays: its playlist_override, or
+// else one picked from its intent. A named intent must exist and be inside its
+// active window either way. Errors are *playError.
+func (c *Coordinator) resolvePlaylist(req IntentRequest) (string, error) {
+	if req.Intent != "" {
+		if err := c.db.CheckIntentActive(req.Intent, time.Now()); err != nil {
+			return "", &playError{intentPlaylistStatus(err), err}
+		}
+	}
+	if req.PlaylistOverride != "" {
+		return parsePlaylists(req.PlaylistOverride)[0], nil
+	}
+	playlist, err := c.db.GetIntentPlaylist(req.Intent)
+	if err != nil {
+		return "", &playError{intentPlaylistStatus(err), err}
+	}
+	return playlist, nil
+}
+
+// enqueueFor returns the enqueue option for req: its own queue_mode, or else
+// the intent's. A playlist_override without an intent replaces by default.
+func (c *Coordinator) enqueueFor(req IntentRequest) (string, error) {
+	if req.QueueMode != "" {
+		return queueModeEnqueue(req.QueueMode), nil
+	}
+	if req.Intent == "" {
+		return "", nil
+	}
+	mode, err := c.db.GetIntentQueueMode(req.Intent)
+	if err != nil {
+		return "", err
+	}
+	return queueModeEnqueue(mode), nil
+}
+
+// PlayResult is the outcome of playing on one location during a fan-out
+type PlayResult struct {
+	Location      string `json:"location"`
+	SpeakerEntity string `json:"speaker_entity,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// PlayReport is the response to a multi-location play: overall success only when
+// every location played, with per-location results either way
+type PlayReport struct {
+	Success  bool         `json:"success"`
+	Message  string       `json:"message"`
+	Playlist string       `json:"playlist,omitempty"`
+	Results  []PlayResult `json:"results"`
+}
+
+// playMulti resolves the intent's playlist once and plays it on every location in
+// req.Locations, recording each success. Errors are *playError and only cover
+// problems with the request itself; per-location failures are in the report.
+func (c *Coordinator) playMulti(ctx context.Context, req IntentRequest, triggeredVia string) (*PlayReport, error) {
+	var errs ValidationErrors
+	if req.Intent == "" && req.PlaylistOverride == "" {
+		errs.add("intent", "required unless playlist_override is set")
+	}
+	if len(req.Locations) == 0 {
+		errs.add("locations", "required")
+	}
+	validateQueueMode(&errs, req.QueueMode)
+	validatePlaylistOverride(&errs, req.PlaylistOverride)
+	if len(errs) > 0 {
+		return nil, &playError{http.StatusBadRequest, errs}
+	}
+	if !c.trackPlay() {
+		return nil, &playError{http.StatusServiceUnavailable, ErrShuttingDown}
+	}
+	defer c.plays.Done()
+	if err := c.checkMuted(); err != nil {
+		return nil, &playError{http.StatusServiceUnavailable, err}
+	}
+	playlist, err := c.resolvePlaylist(req)
+	if err != nil {
+		return nil, err
+	}
+	enqueue, err := c.enqueueFor(req)
+	if err != nil {
+		return nil, &playError{http.StatusInternalServerError, err}
+	}
+
+	var results []PlayResult
+	if c.currentConfig().UseHASpeakerGroups && len(req.Locations) > 1 {
+		results = c.playGrouped(ctx, req.Locations, playlist, enqueue)
+	} else {
+		results = c.fanOut(ctx, req.Locations, playlist, enqueue)
+	}
+	report := &PlayReport{Playlist: playlist, Results: results}
+	played := 0
+	for _, result := range report.Results {
+		if result.Error != "" {
+			logf(ctx, "[Play] Failed to play %s on '%s': %s", req.describe(), result.Location, result.Error)
+			continue
+		}
+		played++
+		c.recordPlay(ctx, IntentRequest{Intent: req.Intent, Location: result.Location, TriggeredBy: req.TriggeredBy, PlaylistOverride: req.PlaylistOverride}, result.SpeakerEntity, playlist, triggeredVia)
+	}
+	report.Success = played == len(report.Results)
+	report.Message = fmt.Sprintf("Playing %s on %d of %d location(s)", req.describe(), played, len(report.Results))
+	return report, nil
+}
+
+// playGrouped joins the locations' speakers into one HA group under the first
+// speaker and plays playlist on it, so the rooms stay in sync. The group stays
+// joined while it plays (unjoining a member stops its playback) and is only
+// unjoined again if the play fails. If HA refuses the join, it falls back to fanOut.
+func (c *Coordinator) playGrouped(ctx context.Context, locations []string, playlist, enqueue string) []PlayResult {
+	results := make([]PlayResult, len(locations))
+	var grouped []int // indexes of locations whose speaker joins the group
+	var speakers []string
+	checkAvailability := c.currentConfig().CheckSpeakerAvailability
+	for i, location := range locations {
+		results[i].Location = location
+		speakerEntity, err := c.db.GetLocationSpeaker(location)
+		if err == nil && checkAvailability {
+			err = c.checkSpeakerAvailable(ctx, location, speakerEntity)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].SpeakerEntity = speakerEntity
+		grouped = append(grouped, i)
+		if !slices.Contains(speakers, speakerEntity) {
+			speakers = append(speakers, speakerEntity)
+		}
+	}
+	if len(speakers) == 0 {
+		return results
+	}
+
+	// Speakers can only be grouped within one HA instance; joining fails across
+	// instances and falls back to playing on each
+	master, followers := speakers[0], speakers[1:]
+	masterLocation := locations[grouped[0]]
+	ha := c.haFor(ctx, masterLocation)
+	if len(followers) > 0 {
+		if err := ha.JoinSpeakers(ctx, master, followers); err != nil {
+			logf(ctx, "[HA] Failed to group speakers under %s, playing on each instead: %v", master, err)
+			return c.fanOut(ctx, locations, playlist, enqueue)
+		}
+		logf(ctx, "[HA] Grouped %s under %s", strings.Join(followers, ", "), master)
+	}
+
+	for _, i := range grouped {
+		c.applyVolumeProfile(ctx, locations[i], results[i].SpeakerEntity)
+	}
+	err := c.playMusic(ctx, masterLocation, master, playlist, enqueue)
+	if err != nil && len(followers) > 0 {
+		if unjoinErr := ha.UnjoinSpeakers(ctx, followers); unjoinErr != nil {
+			logf(ctx, "[HA] Failed to ungroup speakers: %v", unjoinErr)
+		}
+	}
+	for _, i := range grouped {
+		if err != nil {
+			results[i].Error = err.Error()
+		} else if enqueue == "" {
+			c.clearQueue(locations[i])
+		}
+	}
+	return results
+}
+
+// fanOut plays playlist on every location at once and returns one result per
+// location, in the order given. Locations still running when ctx is done are
+// reported with ctx's error.
+func (c *Coordinator) fanOut(ctx context.Context, locations []string, playlist, enqueue string) []PlayResult {
+	results := make([]PlayResult, len(locations))
+	finished := make([]bool, len(locations))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	checkAvailability := c.currentConfig().CheckSpeakerAvailability
+	for i, location := range locations {
+		wg.Add(1)
+		go func(i int, location string) {
+			defer wg.Done()
+			result := PlayResult{Location: location}
+			speakerEntity, err := c.db.GetLocationSpeaker(location)
+			if err == nil {
+				result.SpeakerEntity = speakerEntity
+				if checkAvailability {
+					err = c.checkSpeakerAvailable(ctx, location, speakerEntity)
+				}
+			}
+			if err == nil {
+				c.applyVolumeProfile(ctx, location, speakerEntity)
+				err = c.playMusic(ctx, location, speakerEntity, playlist, enqueue)
+			}
+			if err != nil {
+				result.Error = err.Error()
+			} else if enqueue == "" {
+				c.clearQueue(location)
+			}
+
+			mu.Lock()
+			results[i] = result
+			finished[i] = true
+			mu.Unlock()
+		}(i, location)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range results {
+		if !finished[i] {
+			results[i] = PlayResult{Location: locations[i], Error: ctx.Err().Error()}
+		}
+	}
+	return append([]PlayResult(nil), results...)
+}
+
+// haFor returns the client for the Home Assistant instance location's speaker
+// belongs to: the global one unless the location overrides its URL or token
+func (c *Coordinator) haFor(ctx context.Context, location string) *HAClient {
+	ha, err := c.db.GetLocationHA(location)
+	if err != nil {
+		logf(ctx, "[DB] Warning: %v; using the default Home Assistant", err)
+		return c.haClient
+	}
+	if ha.URL == "" && ha.Token == "" {
+		return c.haClient
+	}
+
+	config := c.currentConfig()
+	baseURL, token, key := haClientKey(ha, config)
+
+	c.haClientsMu.Lock()
+	defer c.haClientsMu.Unlock()
+	if client, ok := c.haClients[key]; ok {
+		return client
+	}
+	if c.haClients == nil {
+		c.haClients = make(map[string]*HAClient)
+	}
+	client := NewHAClient(baseURL, token, config.PlayTimeout, config.HAMediaPlayerCacheTTL, config.HAMaxRetries)
+	c.haClients[key] = client
+	return client
+}
+
+// haClientKey returns the effective URL and token for a location's overrides and
+// the haClients key they're cached under
+func haClientKey(ha LocationHA, config *Config) (baseURL, token, key string) {
+	baseURL = strings.TrimRight(orDefault(ha.URL, config.HAURL), "/")
+	token = orDefault(ha.Token, config.HAToken)
+	return baseURL, token, baseURL + "\x00" + token
+}
+
+// forgetHAClient drops the cached client for a location's previous overrides
+// once they've been changed or removed. Another location with the same
+// settings just gets a new client on its next play.
+func (c *Coordinator) forgetHAClient(previous LocationHA) {
+	if previous.URL == "" && previous.Token == "" {
+		return
+	}
+	_, _, key := haClientKey(previous, c.currentConfig())
+	c.haClientsMu.Lock()
+	delete(c.haClients, key)
+	c.haClientsMu.Unlock()
+}
+
+// checkSpeakerAvailable fails with a readable message when HA reports the speaker
+// as unavailable or unknown
+func (c *Coordinator) checkSpeakerAvailable(ctx context.Context, location, speakerEntity string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	state, err := c.haFor(ctx, location).GetEntityState(ctx, speakerEntity)
+	if err != nil {
+		return fmt.Errorf("could not check speaker '%s': %w", speakerEntity, err)
+	}
+	switch state.State {
+	case "unavailable", "unknown":
+		return fmt.Errorf("speaker '%s' is %s in Home Assistant; is it powered on and connected?", speakerEntity, state.State)
+	}
+	return nil
+}
+
+// recordPlay stores a successful play in the history and announces it to event
+// stream subscribers; failures are only logged since the music is already playing.
+// A playlist_override isn't one of the intent's playlists, so it stays out of the
+// history (and least_recently_played), but is still announced.
+func (c *Coordinator) recordPlay(ctx context.Context, req IntentRequest, speakerEntity, playlist, triggeredVia string) {
+	if req.Intent != "" && req.PlaylistOverride == "" {
+		if err := c.db.RecordPlay(req.Intent, req.Location, playlist, triggeredVia, req.TriggeredBy); err != nil {
+			logf(ctx, "[DB] Warning: %v", err)
+		}
+		c.etags.invalidate(resourceIntents)
+	}
+	c.pushUndo(PlayRecord{Intent: req.Intent, Location: req.Location, SpeakerEntity: speakerEntity, Playlist: playlist, PlayedAt: time.Now()})
+	if webhookID := c.currentConfig().HAPlayWebhookID; webhookID != "" {
+		go c.notifyPlayWebhook(context.WithoutCancel(ctx), webhookID, PlayWebhookPayload{Intent: req.Intent, Location: req.Location, Playlist: playlist})
+	}
+
+	data, err := json.Marshal(PlayEvent{
+		Intent:    req.Intent,
+		Location:  req.Location,
+		Playlist:  playlist,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		logf(ctx, "[Events] Failed to marshal play event: %v", err)
+		return
+	}
+	c.events.publish(string(data))
+}
+
+const (
+	undoWindow     = 5 * time.Minute
+	undoStackDepth = 1
+)
+
+// PlayRecord is a recent play kept in memory so POST /api/play/undo can stop it
+type PlayRecord struct {
+	Intent        string    `json:"intent"`
+	Location      string    `json:"location"`
+	SpeakerEntity string    `json:"speaker_entity"`
+	Playlist      string    `json:"playlist"`
+	PlayedAt      time.Time `json:"played_at"`
+}
+
+// pushUndo makes record the play that an undo will stop, dropping the oldest
+// entry once the stack is undoStackDepth deep
+func (c *Coordinator) pushUndo(record PlayRecord) {
+	c.undoMu.Lock()
+	defer c.undoMu.Unlock()
+	c.undoStack = append(c.undoStack, record)
+	if len(c.undoStack) > undoStackDepth {
+		c.undoStack = c.undoStack[len(c.undoStack)-undoStackDepth:]
+	}
+}
+
+// popUndo removes and returns the latest play if it started within undoWindow
+// of now. Older entries are discarded.
+func (c *Coordinator) popUndo(now time.Time) (PlayRecord, bool) {
+	c.undoMu.Lock()
+	defer c.undoMu.Unlock()
+	if len(c.undoStack) == 0 {
+		return PlayRecord{}, false
+	}
+	record := c.undoStack[len(c.undoStack)-1]
+	if now.Sub(record.PlayedAt) > undoWindow {
+		c.undoStack = nil
+		return PlayRecord{}, false
+	}
+	c.undoStack = c.undoStack[:len(c.undoStack)-1]
+	return record, true
+}
+
+// handlePlayUndo stops the most recent play if it started in the last five minutes
+func (c *Coordinator) handlePlayUndo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	record, ok := c.popUndo(time.Now())
+	if !ok {
+		c.sendError(w, http.StatusConflict, fmt.Sprintf("No play in the last %d minutes to undo", int(undoWindow.Minutes())))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), haRequestTimeout)
+	defer cancel()
+
+	data := map[string]interface{}{"entity_id": record.SpeakerEntity}
+	if err := c.haFor(ctx, record.Location).CallService(ctx, "media_player", "media_stop", data); err != nil {
+		// Put it back so the client can retry
+		c.pushUndo(record)
+		c.sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to stop '%s': %v", record.Location, err))
+		return
+	}
+	c.clearQueue(record.Location)
+	what := fmt.Sprintf("intent '%s'", record.Intent)
+	if record.Intent == "" {
+		what = fmt.Sprintf("playlist '%s'", record.Playlist)
+	}
+	logf(ctx, "[Play] Undid %s on '%s'", what, record.Location)
+	c.sendSuccess(w, fmt.Sprintf("Stopped %s on '%s'", what, record.Location))
+}
+
+// PlayWebhookPayload is POSTed to HA_PLAY_WEBHOOK_ID after a successful play
+type PlayWebhookPayload struct {
+	Intent   string `json:"intent"`
+	Location string `json:"location"`
+	Playlist string `json:"playlist"`
+}
+
+// notifyPlayWebhook calls the configured HA webhook, retrying once. It runs off
+// the play path, so failures are only logged; ctx only supplies the request ID.
+func (c *Coordinator) notifyPlayWebhook(ctx context.Context, webhookID string, payload PlayWebhookPayload) {
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, haRequestTimeout)
+		err := c.haClient.TriggerWebhook(callCtx, webhookID, payload)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt == 2 {
+			logf(ctx, "[HA] Play webhook failed: %v", err)
+			return
+		}
+		logf(ctx, "[HA] Play webhook failed, retrying in %s: %v", haWebhookRetryDelay, err)
+		time.Sleep(haWebhookRetryDelay)
+	}
+}
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 30 * time.Second
+)
+
+// ChangeEvent is broadcast to WebSocket clients after a successful create, update or delete
+type ChangeEvent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	OldName string `json:"old_name,omitempty"` // set on *_renamed events
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// The API already allows any origin via CORS
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan []byte
+}
+
+// websocketHub tracks connected WebSocket clients and broadcasts change events
+// to them; all client bookkeeping happens on the run goroutine
+type websocketHub struct {
+	clients    map[*wsClient]bool
+	broadcast  chan []byte
+	register   chan *wsClient
+	unregister chan *wsClient
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func newWebsocketHub() *websocketHub {
+	return &websocketHub{
+		clients:    make(map[*wsClient]bool),
+		broadcast:  make(chan []byte, 64),
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		done:       make(chan struct{}),
+	}
+}
+
+func (h *websocketHub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+		case client := <-h.unregister:
+			if h.clients[client] {
+				delete(h.clients, client)
+				close(client.send)
+			}
+		case msg := <-h.broadcast:
+			for client := range h.clients {
+				select {
+				case client.send <- msg:
+				default:
+					// Too slow to keep up; drop it
+					delete(h.clients, client)
+					close(client.send)
+				}
+			}
+		case <-h.done:
+			for client := range h.clients {
+				delete(h.clients, client)
+				close(client.send)
+			}
+			return
+		}
+	}
+}
+
+// close disconnects every client and stops the hub
+func (h *websocketHub) close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// publish queues msg for all clients without blocking the caller
+func (h *websocketHub) publish(msg []byte) {
+	select {
+	case h.broadcast <- msg:
+	case <-h.done:
+	default:
+		log.Printf("[WS] Broadcast queue full, dropping event")
+	}
+}
+
+// changed records a successful create, update or delete: cached list ETags for
+// the affected resources are dropped and WebSocket clients are notified
+func (c *Coordinator) changed(eventType, name string, resources ...string) {
+	c.etags.invalidate(resources...)
+	c.broadcastChange(ChangeEvent{Type: eventType, Name: name})
+}
+
+// broadcastChange tells WebSocket clients that a resource changed,
+// e.g. broadcastChange(ChangeEvent{Type: "intent_created", Name: "christmas"})
+func (c *Coordinator) broadcastChange(event ChangeEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[WS] Failed to marshal change event: %v", err)
+		return
+	}
+	c.hub.publish(data)
+}
+
+// HandleWebSocket upgrades the connection and streams change events to it
+func (c *Coordinator) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logf(r.Context(), "[WS] Upgrade failed: %v", err)
+		return
+	}
+
+	client := &wsClient{conn: conn, send: make(chan []byte, 16)}
+	select {
+	case c.hub.register <- client:
+	case <-c.hub.done:
+		conn.Close()
+		return
+	}
+
+	go client.writePump()
+	client.readPump(c.hub)
+}
+
+// readPump discards incoming messages but keeps the read deadline fresh on pongs,
+// unregistering the client once the connection fails
+func (wc *wsClient) readPump(hub *websocketHub) {
+	defer func() {
+		select {
+		case hub.unregister <- wc:
+		case <-hub.done:
+		}
+		wc.conn.Close()
+	}()
+
+	wc.conn.SetReadLimit(512)
+	wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	wc.conn.SetPongHandler(func(string) error {
+		return wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		if _, _, err := wc.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// writePump sends queued events and a ping every wsPingPeriod
+func (wc *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		wc.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-wc.send:
+			wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				wc.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := wc.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := wc.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type PlayEvent struct {
+	Intent    string    `json:"intent"`
+	Location  string    `json:"location"`
+	Playlist  string    `json:"playlist"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+const sseKeepAliveInterval = 30 * time.Second
+
+// eventBus fans play events out to connected SSE clients
+type eventBus struct {
+	mu      sync.RWMutex
+	clients []chan string
+	closed  bool
+}
+
+func (b *eventBus) subscribe() chan string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan string, 16)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.clients = append(b.clients, ch)
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, client := range b.clients {
+		if client == ch {
+			b.clients = append(b.clients[:i], b.clients[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// publish delivers msg to every client, dropping it for clients that are too far behind
+func (b *eventBus) publish(msg string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ch := range b.clients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// close disconnects all clients so their handlers return during shutdown
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.clients {
+		close(ch)
+	}
+	b.clients = nil
+	b.closed = true
+}
+
+// HandleEvents streams play events to the client as Server-Sent Events
+func (c *Coordinator) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's WriteTimeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logf(r.Context(), "[Events] Failed to clear write deadline: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logf(r.Context(), "[Events] Streaming unsupported: %v", err)
+		return
+	}
+
+	ch := c.events.subscribe()
+	defer c.events.unsubscribe(ch)
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: play\ndata: %s\n\n", msg)
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			logf(r.Context(), "[Events] Dropping client: %v", err)
+			return
+		}
+	}
+}
+
+func (c *Coordinator) HandlePlayIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req IntentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if req.TriggeredBy == "" {
+		req.TriggeredBy = clientIP(r)
+	}
+
+	if len(req.Locations) > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), fanOutTimeout)
+		defer cancel()
+		report, err := c.playMulti(ctx, req, triggeredViaHTTP)
+		if err != nil {
+			c.sendPlayError(w, err)
+			return
+		}
+		c.sendPlayReport(w, report)
+		return
+	}
+
+	playlist, speakerEntity, err := c.play(r.Context(), req, triggeredViaHTTP)
+	if err != nil {
+		c.sendPlayError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(IntentResponse{
+		Success:                  true,
+		Message:                  fmt.Sprintf("Playing %s on '%s'", req.describe(), req.Location),
+		Playlist:                 playlist,
+		SpeakerEntity:            speakerEntity,
+		EstimatedDurationSeconds: c.estimateDuration(r.Context(), playlist),
+	})
+}
+
+func (c *Coordinator) HandleIntents(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "POST", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if c.notModified(w, r, resourceIntents) {
+			return
+		}
+		opts, err := parseListOptions(r)
+		if err == nil {
+			opts, err = parseSearchSort(r, opts)
+		}
+		if err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := setTotalCount(w, c.db.CountIntents); err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		intents, err := c.db.ListIntents(opts)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.sendListJSON(w, r, resourceIntents, intents)
+
+	case http.MethodPost:
+		var intent Intent
+		if err := json.NewDecoder(r.Body).Decode(&intent); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+
+		playlists := intent.Playlists
+		if len(playlists) == 0 && intent.Playlist != "" {
+			playlists = parsePlaylists(intent.Playlist)
+		}
+
+		intent.Name = c.db.normalizeName(intent.Name)
+		var errs ValidationErrors
+		if intent.Name == "" {
+			errs.add("name", "required")
+		}
+		if len(playlists) == 0 {
+			errs.add("playlists", "required")
+		}
+		intent.IntentSettings.validate(&errs)
+		if len(errs) > 0 {
+			c.sendValidationErrors(w, errs)
+			return
+		}
+
+		if err := c.audit.CreateIntent(changedBy(r), intent.Name, playlists, "", intent.IntentSettings); err != nil {
+			c.sendCreateError(w, err, "intent.name", "intent", intent.Name)
+			return
+		}
+		c.changed("intent_created", intent.Name, resourceIntents, resourcePlaylistGroups)
+		c.sendSuccess(w, fmt.Sprintf("Intent '%s' created with %d playlist(s)", intent.Name, len(playlists)))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// BulkIntentsResponse is the result of POST /api/intents/bulk
+type BulkIntentsResponse struct {
+	Created int         `json:"created"`
+	Errors  []BulkError `json:"errors"`
+}
+
+// handleIntentsBulk creates every intent in a JSON array in one transaction,
+// reporting the ones that couldn't be created instead of failing the batch
+func (c *Coordinator) handleIntentsBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var intents []IntentInput
+	if err := json.NewDecoder(r.Body).Decode(&intents); err != nil {
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if len(intents) == 0 {
+		c.sendError(w, http.StatusBadRequest, "at least one intent is required")
+		return
+	}
+	for i := range intents {
+		intents[i].Name = c.db.normalizeName(intents[i].Name)
+	}
+
+	created, failures := c.audit.CreateIntentsBulk(r.Context(), changedBy(r), intents)
+	if failures == nil {
+		failures = []BulkError{}
+	}
+	failed := make(map[int]bool, len(failures))
+	for _, failure := range failures {
+		failed[failure.Index] = true
+	}
+	for i, intent := range intents {
+		if !failed[i] {
+			c.changed("intent_created", intent.Name, resourceIntents, resourcePlaylistGroups)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BulkIntentsResponse{Created: created, Errors: failures})
+}
+
+func (c *Coordinator) HandleIntent(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "PUT", "DELETE", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	name := r.PathValue("name")
+	// Lookups ignore case, so writes go to the stored name the lookup finds
+	var current *Intent
+	if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		var err error
+		if current, err = c.db.GetIntent(name); err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		name = current.Name
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		intent, err := c.db.GetIntent(name)
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(intent)
+
+	case http.MethodPut:
+		var update IntentUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+
+		playlistGroup := update.PlaylistGroup
+		playlists := update.Playlists
+		if playlistGroup == "" && len(playlists) == 0 && update.Playlist != "" {
+			playlists = parsePlaylists(update.Playlist)
+		}
+
+		var errs ValidationErrors
+		if playlistGroup == "" && len(playlists) == 0 {
+			errs.add("playlists", "required unless playlist_group is set")
+		}
+		settings := current.IntentSettings
+		update.apply(&settings)
+		settings.validate(&errs)
+		if len(errs) > 0 {
+			c.sendValidationErrors(w, errs)
+			return
+		}
+
+		err := c.audit.UpdateIntent(changedBy(r), name, playlists, playlistGroup, settings)
+		if errors.Is(err, ErrPlaylistGroupMissing) {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.changed("intent_updated", name, resourceIntents, resourcePlaylistGroups)
+
+		if playlistGroup != "" {
+			c.sendSuccess(w, fmt.Sprintf("Intent '%s' updated with playlist group '%s'", name, playlistGroup))
+		} else {
+			c.sendSuccess(w, fmt.Sprintf("Intent '%s' updated with %d playlist(s)", name, len(playlists)))
+		}
+
+	case http.MethodDelete:
+		if err := c.audit.DeleteIntent(changedBy(r), name); err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.changed("intent_deleted", name, resourceIntents, resourcePlaylistGroups)
+		c.sendSuccess(w, fmt.Sprintf("Intent '%s' deleted", name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// IntentValidation reports which of an intent's playlists are missing from the MA library
+type IntentValidation struct {
+	Valid            bool     `json:"valid"`
+	InvalidPlaylists []string `json:"invalid_playlists,omitempty"`
+}
+
+// haErrorStatus is the HTTP status for a failed Home Assistant read: 503 when no
+// HA_URL is set, 500 otherwise
+func haErrorStatus(err error) int {
+	if errors.Is(err, ErrHANotConfigured) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// maErrorStatus is the HTTP status for a failed Music Assistant call: 503 when
+// the integration is turned off, 502 when MA itself failed
+func maErrorStatus(err error) int {
+	if errors.Is(err, ErrMADisabled) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// maLibraryURIs returns the set of playlist URIs in the Music Assistant library
+func (c *Coordinator) maLibraryURIs(ctx context.Context) (map[string]bool, error) {
+	playlists, err := c.maClient.GetPlaylists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	uris := make(map[string]bool, len(playlists))
+	for _, p := range playlists {
+		uris[p.URI] = true
+	}
+	return uris, nil
+}
+
+func validateIntent(intent Intent, library map[string]bool) IntentValidation {
+	result := IntentValidation{Valid: true}
+	for _, playlist := range intent.Playlists {
+		if !library[playlist] {
+			result.Valid = false
+			result.InvalidPlaylists = append(result.InvalidPlaylists, playlist)
+		}
+	}
+	return result
+}
+
+func (c *Coordinator) handleIntentValidate(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	intent, err := c.db.GetIntent(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	library, err := c.maLibraryURIs(r.Context())
+	if err != nil {
+		c.sendError(w, maErrorStatus(err), fmt.Sprintf("Failed to fetch Music Assistant playlists: %v", err))
+		return
+	}
+	json.NewEncoder(w).Encode(validateIntent(*intent, library))
+}
+
+func (c *Coordinator) handleLeastPlayedIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	intent, err := c.db.GetLeastPlayedIntent()
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(intent)
+}
+
+// previewSamples is how many picks GET /api/intents/{name}/preview makes for a
+// random intent
+const previewSamples = 10
+
+// IntentPreview shows which playlists an intent would pick, without playing
+type IntentPreview struct {
+	Mode string `json:"mode"`
+	// random: how often each playlist came up in previewSamples picks
+	Selections map[string]int `json:"selections,omitempty"`
+	// least_recently_played: the order successive plays would pick playlists in
+	Order []string `json:"order,omitempty"`
+}
+
+func (c *Coordinator) handleIntentPreview(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	intent, err := c.db.GetIntent(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	preview := IntentPreview{Mode: intent.SelectionMode}
+	if intent.SelectionMode == selectionModeLeastRecentlyPlayed {
+		// Picks depend on play history, so repeating one without playing it
+		// would only show the same playlist
+		preview.Order, err = c.db.LeastRecentlyPlayedOrder(intent.Playlists)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(preview)
+		return
+	}
+
+	preview.Selections = make(map[string]int)
+	for i := 0; i < previewSamples; i++ {
+		playlist, err := c.db.GetIntentPlaylist(intent.Name)
+		if err != nil {
+			c.sendError(w, intentPlaylistStatus(err), err.Error())
+			return
+		}
+		preview.Selections[playlist]++
+	}
+	json.NewEncoder(w).Encode(preview)
+}
+
+func (c *Coordinator) handleValidateAllIntents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	intents, err := c.db.GetAllIntents()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	library, err := c.maLibraryURIs(r.Context())
+	if err != nil {
+		c.sendError(w, maErrorStatus(err), fmt.Sprintf("Failed to fetch Music Assistant playlists: %v", err))
+		return
+	}
+	results := make(map[string]IntentValidation, len(intents))
+	for _, intent := range intents {
+		results[intent.Name] = validateIntent(intent, library)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+func (c *Coordinator) handleIntentHistory(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, offset, err := parseLimitOffset(r, defaultHistoryLimit)
+	if err != nil {
+		c.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	intent, err := c.db.GetIntent(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	history, err := c.db.GetIntentHistory(intent.Name, limit, offset)
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+func (c *Coordinator) HandleLocations(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "POST", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if c.notModified(w, r, resourceLocations) {
+			return
+		}
+		opts, err := parseListOptions(r)
+		if err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := setTotalCount(w, c.db.CountLocations); err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		locations, err := c.db.ListLocations(opts)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.sendListJSON(w, r, resourceLocations, locations)
+
+	case http.MethodPost:
+		var location Location
+		if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		location.Name = c.db.normalizeName(location.Name)
+		if location.Name == "" || location.SpeakerEntity == "" {
+			c.sendError(w, http.StatusBadRequest, "name and speaker_entity are required")
+			return
+		}
+		if err := validateSpeakerEntity(location.SpeakerEntity); err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := c.audit.CreateLocation(changedBy(r), location.Name, location.SpeakerEntity, location.DisplayName, location.Description); err != nil {
+			c.sendCreateError(w, err, "location.name", "location", location.Name)
+			return
+		}
+		c.changed("location_created", location.Name, resourceLocations)
+		c.sendSuccess(w, fmt.Sprintf("Location '%s' created", location.Name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// speakerEntityPattern matches HA media player entity IDs such as media_player.kitchen
+var speakerEntityPattern = regexp.MustCompile(`^media_player\.[a-z0-9_]+$`)
+
+// validateSpeakerEntity rejects values that can't be a Home Assistant media player
+func validateSpeakerEntity(entity string) error {
+	if !speakerEntityPattern.MatchString(entity) {
+		return fmt.Errorf("speaker_entity must be a media_player entity (e.g. media_player.kitchen), got %q", entity)
+	}
+	return nil
+}
+
+func (c *Coordinator) HandleLocation(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "PUT", "DELETE", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		location, err := c.db.GetLocation(name)
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(location)
+
+	case http.MethodPut:
+		var update LocationUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if update.SpeakerEntity == "" {
+			c.sendError(w, http.StatusBadRequest, "speaker_entity is required")
+			return
+		}
+		if err := validateSpeakerEntity(update.SpeakerEntity); err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		location, err := c.db.GetLocation(name)
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		name = location.Name
+		if update.DisplayName != nil {
+			location.DisplayName = *update.DisplayName
+		}
+		if update.Description != nil {
+			location.Description = *update.Description
+		}
+		if err := c.audit.UpdateLocation(changedBy(r), name, update.SpeakerEntity, location.DisplayName, location.Description); err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.changed("location_updated", name, resourceLocations)
+		c.sendSuccess(w, fmt.Sprintf("Location '%s' updated", name))
+
+	case http.MethodDelete:
+		// Lookups ignore case, so delete the stored name the lookup finds
+		location, err := c.db.GetLocation(name)
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		name = location.Name
+		previous, err := c.db.GetLocationHA(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := c.audit.DeleteLocation(changedBy(r), name); err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.forgetHAClient(previous)
+		c.changed("location_deleted", name, resourceLocations)
+		c.sendSuccess(w, fmt.Sprintf("Location '%s' deleted", name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// LocationValidation reports whether a location's speaker entity exists in HA
+type LocationValidation struct {
+	Valid        bool   `json:"valid"`
+	State        string `json:"state,omitempty"`
+	FriendlyName string `json:"friendly_name,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func (c *Coordinator) validateLocation(ctx context.Context, location Location) LocationValidation {
+	state, err := c.haFor(ctx, location.Name).GetEntityState(ctx, location.SpeakerEntity)
+	if err != nil {
+		return LocationValidation{Error: err.Error()}
+	}
+	result := LocationValidation{Valid: true, State: state.State}
+	if name, ok := state.Attributes["friendly_name"].(string); ok {
+		result.FriendlyName = name
+	}
+	return result
+}
+
+func (c *Coordinator) handleLocationValidate(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	location, err := c.db.GetLocation(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), haRequestTimeout)
+	defer cancel()
+	json.NewEncoder(w).Encode(c.validateLocation(ctx, *location))
+}
+
+// handleLocationHA shows and changes which Home Assistant instance a location's
+// speaker is controlled through. Kept apart from PUT /locations/{name} so that
+// updating the speaker or syncing locations leaves these settings alone
+func (c *Coordinator) handleLocationHA(w http.ResponseWriter, r *http.Request, name string) {
+	location, err := c.db.GetLocation(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	name = location.Name
+
+	switch r.Method {
+	case http.MethodGet:
+		ha, err := c.db.GetLocationHA(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(locationHAResponse(ha))
+
+	case http.MethodPut:
+		previous, err := c.db.GetLocationHA(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var ha LocationHA
+		if err := json.NewDecoder(r.Body).Decode(&ha); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if ha.URL != "" {
+			if u, err := url.Parse(ha.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				c.sendError(w, http.StatusBadRequest, "ha_url must be an http(s) URL")
+				return
+			}
+		}
+		if err := c.audit.SetLocationHA(changedBy(r), name, ha); err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if ha != previous {
+			c.forgetHAClient(previous)
+		}
+		c.changed("location_updated", name, resourceLocations)
+		c.sendSuccess(w, fmt.Sprintf("Home Assistant settings for location '%s' updated", name))
+
+	case http.MethodDelete:
+		previous, err := c.db.GetLocationHA(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := c.audit.SetLocationHA(changedBy(r), name, LocationHA{}); err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.forgetHAClient(previous)
+		c.changed("location_updated", name, resourceLocations)
+		c.sendSuccess(w, fmt.Sprintf("Location '%s' now uses the default Home Assistant", name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *Coordinator) handleValidateAllLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	locations, err := c.db.GetAllLocations()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), haRequestTimeout)
+	defer cancel()
+	results := make(map[string]LocationValidation, len(locations))
+	for _, location := range locations {
+		results[location.Name] = c.validateLocation(ctx, location)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// locationControlServices maps a location control action to its media_player service
+var locationControlServices = map[string]string{
+	"pause":  "media_pause",
+	"resume": "media_play",
+	"stop":   "media_stop",
+	"volume": "volume_set",
+}
+
+// VolumeRequest is the body of POST /api/locations/{name}/volume
+type VolumeRequest struct {
+	VolumeLevel *float64 `json:"volume_level"`
+}
+
+// locationControl returns the handler for POST /api/locations/{name}/<action>
+func (c *Coordinator) locationControl(action string) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, name string) {
+		c.handleLocationControl(w, r, name, action)
+	}
+}
+
+func (c *Coordinator) handleLocationControl(w http.ResponseWriter, r *http.Request, name, action string) {
+	service := locationControlServices[action]
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	location, err := c.db.GetLocation(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	data := map[string]interface{}{"entity_id": location.SpeakerEntity}
+	if action == "volume" {
+		var req VolumeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if req.VolumeLevel == nil || *req.VolumeLevel < 0 || *req.VolumeLevel > 1 {
+			c.sendError(w, http.StatusBadRequest, "volume_level must be between 0 and 1")
+			return
+		}
+		data["volume_level"] = *req.VolumeLevel
+	}
+
+	if err := c.haFor(r.Context(), location.Name).CallService(r.Context(), "media_player", service, data); err != nil {
+		c.sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to %s '%s': %v", action, name, err))
+		return
+	}
+	logf(r.Context(), "[HA] Called media_player.%s on %s", service, location.SpeakerEntity)
+	c.sendSuccess(w, fmt.Sprintf("Location '%s': %s sent", name, action))
+}
+
+// FollowRequest is the body of POST /api/locations/{name}/follow
+type FollowRequest struct {
+	FromLocation string `json:"from_location"`
+	Intent       string `json:"intent"`
+}
+
+// FollowResponse reports where playback was stopped and where it started
+type FollowResponse struct {
+	Stopped  string `json:"stopped"`
+	Playing  string `json:"playing"`
+	Playlist string `json:"playlist"`
+}
+
+// handleLocationFollow moves an intent from one room to another: it stops the
+// from_location speaker and plays the intent on {name}. Everything is looked up
+// before the stop so a bad request doesn't leave the old room silent.
+func (c *Coordinator) handleLocationFollow(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req FollowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if req.FromLocation == "" || req.Intent == "" {
+		c.sendError(w, http.StatusBadRequest, "from_location and intent are required")
+		return
+	}
+	if strings.EqualFold(req.FromLocation, name) {
+		c.sendError(w, http.StatusBadRequest, "from_location must differ from the target location")
+		return
+	}
+
+	if err := c.checkMuted(); err != nil {
+		c.sendError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	from, err := c.db.GetLocation(req.FromLocation)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	to, err := c.db.GetLocation(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if _, err := c.db.GetIntent(req.Intent); err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), haRequestTimeout)
+	defer cancel()
+
+	data := map[string]interface{}{"entity_id": from.SpeakerEntity}
+	if err := c.haFor(ctx, from.Name).CallService(ctx, "media_player", "media_stop", data); err != nil {
+		c.sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to stop '%s': %v", from.Name, err))
+		return
+	}
+	c.clearQueue(from.Name)
+	logf(ctx, "[HA] Called media_player.media_stop on %s", from.SpeakerEntity)
+
+	if cooldown := c.currentConfig().FollowCooldownMs; cooldown > 0 {
+		time.Sleep(time.Duration(cooldown) * time.Millisecond)
+	}
+
+	playlist, _, err := c.play(ctx, IntentRequest{Intent: req.Intent, Location: to.Name, TriggeredBy: clientIP(r)}, triggeredViaHTTP)
+	if err != nil {
+		c.sendError(w, playErrorStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FollowResponse{Stopped: from.Name, Playing: to.Name, Playlist: playlist})
+}
+
+// defaultAnnounceDuration is how long an announcement plays before the speaker's
+// volume is restored when the request doesn't give duration_seconds
+const defaultAnnounceDuration = 5 * time.Second
+
+// AnnounceRequest is the body of POST /api/locations/{name}/announce
+type AnnounceRequest struct {
+	AudioURL        string   `json:"audio_url"`
+	Volume          *float64 `json:"volume"`
+	DurationSeconds int      `json:"duration_seconds"`
+}
+
+// handleLocationAnnounce plays a short clip at its own volume and then puts the
+// speaker back to the volume it had before. The restore runs in the background
+// unless ?wait=true is given.
+func (c *Coordinator) handleLocationAnnounce(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AnnounceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if u, err := url.Parse(req.AudioURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.sendError(w, http.StatusBadRequest, "audio_url must be an http(s) URL")
+		return
+	}
+	if req.Volume == nil || *req.Volume < 0 || *req.Volume > 1 {
+		c.sendError(w, http.StatusBadRequest, "volume must be between 0 and 1")
+		return
+	}
+	if req.DurationSeconds < 0 {
+		c.sendError(w, http.StatusBadRequest, "duration_seconds must not be negative")
+		return
+	}
+	duration := defaultAnnounceDuration
+	if req.DurationSeconds > 0 {
+		duration = time.Duration(req.DurationSeconds) * time.Second
+	}
+
+	if err := c.checkMuted(); err != nil {
+		c.sendError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	location, err := c.db.GetLocation(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), haRequestTimeout)
+	defer cancel()
+
+	ha := c.haFor(ctx, location.Name)
+	state, err := ha.GetEntityState(ctx, location.SpeakerEntity)
+	if err != nil {
+		c.sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to read volume of '%s': %v", location.SpeakerEntity, err))
+		return
+	}
+	// A speaker that's off reports no volume_level; there's nothing to restore then
+	previous, hasPrevious := state.Attributes["volume_level"].(float64)
+
+	data := map[string]interface{}{"entity_id": location.SpeakerEntity, "volume_level": *req.Volume}
+	if err := ha.CallService(ctx, "media_player", "volume_set", data); err != nil {
+		c.sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to set announcement volume on '%s': %v", location.SpeakerEntity, err))
+		return
+	}
+
+	restore := func(ctx context.Context) {
+		if !hasPrevious {
+			logf(ctx, "[HA] No previous volume for %s; leaving it at %.2f", location.SpeakerEntity, *req.Volume)
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, haRequestTimeout)
+		defer cancel()
+		data := map[string]interface{}{"entity_id": location.SpeakerEntity, "volume_level": previous}
+		if err := ha.CallService(ctx, "media_player", "volume_set", data); err != nil {
+			logf(ctx, "[HA] Failed to restore volume on %s: %v", location.SpeakerEntity, err)
+			return
+		}
+		logf(ctx, "[HA] Restored %s to volume %.2f", location.SpeakerEntity, previous)
+	}
+
+	if err := c.publishPlayMedia(ctx, location.SpeakerEntity, req.AudioURL, "music", ""); err != nil {
+		restore(context.WithoutCancel(r.Context()))
+		c.sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to play announcement: %v", err))
+		return
+	}
+
+	// The restore must outlive the request when it runs in the background
+	restoreCtx := context.WithoutCancel(r.Context())
+	if r.URL.Query().Get("wait") != "true" {
+		go func() {
+			time.Sleep(duration)
+			restore(restoreCtx)
+		}()
+		c.sendSuccess(w, fmt.Sprintf("Announcement playing on '%s'", location.Name))
+		return
+	}
+	time.Sleep(duration)
+	restore(restoreCtx)
+	c.sendSuccess(w, fmt.Sprintf("Announcement played on '%s'", location.Name))
+}
+
+func (c *Coordinator) handleVolumeProfiles(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	location, err := c.db.GetLocation(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		profiles, err := c.db.GetVolumeProfiles(location.Name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(profiles)
+
+	case http.MethodPost:
+		var profile VolumeProfile
+		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if _, err := inTimeWindow(time.Time{}, profile.StartTime, profile.EndTime); err != nil {
+			c.sendError(w, http.StatusBadRequest, "start_time and end_time must be HH:MM")
+			return
+		}
+		if profile.Volume < 0 || profile.Volume > 1 {
+			c.sendError(w, http.StatusBadRequest, "volume must be between 0 and 1")
+			return
+		}
+		profile.LocationName = location.Name
+		id, err := c.audit.CreateVolumeProfile(changedBy(r), profile)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.sendSuccess(w, fmt.Sprintf("Volume profile %d created for '%s'", id, location.Name))
+	}
+}
+
+func (c *Coordinator) handleVolumeProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		c.sendError(w, http.StatusBadRequest, "volume profile id must be an integer")
+		return
+	}
+	if err := c.audit.DeleteVolumeProfile(changedBy(r), name, id); err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	c.sendSuccess(w, fmt.Sprintf("Volume profile %d deleted", id))
+}
+
+// QueueEntry is a playlist queued on a location behind what's already playing
+type QueueEntry struct {
+	IntentName    string `json:"intent"`
+	Playlist      string `json:"playlist"`
+	SpeakerEntity string `json:"speaker_entity"`
+	Playing       bool   `json:"playing,omitempty"`
+}
+
+// QueueRequest is the body of POST /api/locations/{name}/queue
+type QueueRequest struct {
+	Intent string `json:"intent"`
+}
+
+const enqueueAdd = "add"
+
+// queueKey folds location names the way the database looks them up
+func queueKey(location string) string {
+	return strings.ToLower(strings.TrimSpace(location))
+}
+
+// queue returns a copy of the entries queued on location; never nil
+func (c *Coordinator) queue(location string) []QueueEntry {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return append([]QueueEntry{}, c.playQueue[queueKey(location)]...)
+}
+
+func (c *Coordinator) enqueue(location string, entry QueueEntry) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	key := queueKey(location)
+	c.playQueue[key] = append(c.playQueue[key], entry)
+}
+
+// pruneQueue drops the entries the speaker has finished with, going by its Home
+// Assistant state: an idle or off speaker has played everything, and one whose
+// media_content_id is a queued playlist has played the entries before it. That
+// entry is marked as playing. The queue is left as is when HA can't be asked.
+func (c *Coordinator) pruneQueue(ctx context.Context, location *Location) {
+	if len(c.queue(location.Name)) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	state, err := c.haFor(ctx, location.Name).GetEntityState(ctx, location.SpeakerEntity)
+	if err != nil {
+		if !errors.Is(err, ErrHANotConfigured) {
+			logf(ctx, "[HA] Could not check the queue on '%s': %v", location.Name, err)
+		}
+		return
+	}
+
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	key := queueKey(location.Name)
+	switch state.State {
+	case "idle", "off", "standby":
+		delete(c.playQueue, key)
+		return
+	}
+	current, _ := state.Attributes["media_content_id"].(string)
+	if current == "" {
+		return
+	}
+	entries := c.playQueue[key]
+	for i, entry := range entries {
+		if entry.Playlist == current {
+			entries = entries[i:]
+			entries[0].Playing = true
+			c.playQueue[key] = entries
+			return
+		}
+	}
+}
+
+// clearQueue forgets the queue of a location whose playback was just replaced
+func (c *Coordinator) clearQueue(location string) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	delete(c.playQueue, queueKey(location))
+}
+
+func (c *Coordinator) handleLocationQueue(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		location, err := c.db.GetLocation(name)
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.pruneQueue(r.Context(), location)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.queue(name))
+
+	case http.MethodPost:
+		var req QueueRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if req.Intent == "" {
+			c.sendError(w, http.StatusBadRequest, "intent is required")
+			return
+		}
+		if err := c.db.CheckIntentActive(req.Intent, time.Now()); err != nil {
+			c.sendError(w, intentPlaylistStatus(err), err.Error())
+			return
+		}
+		playlist, err := c.db.GetIntentPlaylist(req.Intent)
+		if err != nil {
+			c.sendError(w, intentPlaylistStatus(err), err.Error())
+			return
+		}
+		location, err := c.db.GetLocation(name)
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err := c.checkMuted(); err != nil {
+			c.sendError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		if !c.trackPlay() {
+			c.sendError(w, http.StatusServiceUnavailable, ErrShuttingDown.Error())
+			return
+		}
+		defer c.plays.Done()
+		if err := c.playMusic(r.Context(), location.Name, location.SpeakerEntity, playlist, enqueueAdd); err != nil {
+			c.sendError(w, http.StatusBadGateway, fmt.Sprintf("Failed to queue on '%s': %v", name, err))
+			return
+		}
+		c.enqueue(location.Name, QueueEntry{IntentName: req.Intent, Playlist: playlist, SpeakerEntity: location.SpeakerEntity})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(IntentResponse{
+			Success:       true,
+			Message:       fmt.Sprintf("Queued intent '%s' on '%s'", req.Intent, location.Name),
+			Playlist:      playlist,
+			SpeakerEntity: location.SpeakerEntity,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *Coordinator) handleLocationHistory(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, offset, err := parseLimitOffset(r, defaultHistoryLimit)
+	if err != nil {
+		c.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	location, err := c.db.GetLocation(name)
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	history, err := c.db.GetLocationHistory(location.Name, limit, offset)
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+const defaultAuditLimit = 50
+
+// handleAudit lists audit log entries, newest first (?entity_type=intent&limit=50&offset=0)
+func (c *Coordinator) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, offset, err := parseLimitOffset(r, defaultAuditLimit)
+	if err != nil {
+		c.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entityType := r.URL.Query().Get("entity_type")
+	switch entityType {
+	case "", auditEntityIntent, auditEntityLocation, auditEntityPlaylistGroup, auditEntityChain, auditEntityVolumeProfile:
+	default:
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("unknown entity_type %q", entityType))
+		return
+	}
+	entries, err := c.db.ListAudit(entityType, limit, offset)
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (c *Coordinator) HandleMediaPlayers(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), haRequestTimeout)
+	defer cancel()
+	mediaPlayers, err := c.haClient.GetMediaPlayers(ctx, r.URL.Query().Get("refresh") == "true")
+	if err != nil {
+		c.sendError(w, haErrorStatus(err), fmt.Sprintf("Failed to fetch media players: %v", err))
+		return
+	}
+
+	if states := r.URL.Query().Get("state"); states != "" {
+		mediaPlayers = filterMediaPlayersByState(mediaPlayers, strings.Split(states, ","))
+	}
+
+	if mediaPlayers == nil {
+		mediaPlayers = []MediaPlayer{}
+	}
+	json.NewEncoder(w).Encode(mediaPlayers)
+}
+
+// filterMediaPlayersByState keeps the players whose state is one of states
+func filterMediaPlayersByState(players []MediaPlayer, states []string) []MediaPlayer {
+	wanted := make(map[string]bool, len(states))
+	for _, s := range states {
+		if s = strings.TrimSpace(s); s != "" {
+			wanted[s] = true
+		}
+	}
+	filtered := make([]MediaPlayer, 0, len(players))
+	for _, mp := range players {
+		if wanted[mp.State] {
+			filtered = append(filtered, mp)
+		}
+	}
+	return filtered
+}
+
+// HandleMAPlaylists lists the playlists in the Music Assistant library
+func (c *Coordinator) HandleMAPlaylists(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playlists, err := c.maClient.GetPlaylists(r.Context())
+	if err != nil {
+		c.sendError(w, maErrorStatus(err), fmt.Sprintf("Failed to fetch Music Assistant playlists: %v", err))
+		return
+	}
+
+	if playlists == nil {
+		playlists = []MAPlaylist{}
+	}
+	json.NewEncoder(w).Encode(playlists)
+}
+
+// HandleMAPlaylistSearch searches the Music Assistant library for playlists
+func (c *Coordinator) HandleMAPlaylistSearch(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		c.sendError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	limit := defaultMASearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+			return
+		}
+		limit = n
+	}
+
+	playlists, err := c.maClient.SearchPlaylists(r.Context(), query, limit)
+	if err != nil {
+		c.sendError(w, maErrorStatus(err), fmt.Sprintf("Failed to search Music Assistant: %v", err))
+		return
+	}
+	json.NewEncoder(w).Encode(playlists)
+}
+
+// Sync modes for POST /api/sync-locations?mode=
+const (
+	syncModeCreateOnly     = "create_only"
+	syncModeUpdateExisting = "update_existing"
+	syncModeUpsert         = "upsert"
+)
+
+// SyncLocationsResponse is the result of POST /api/sync-locations
+type SyncLocationsResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Created int    `json:"created"`
+	Updated int    `json:"updated"`
+	Skipped int    `json:"skipped"`
+}
+
+func (c *Coordinator) HandleSyncLocations(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "POST", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = syncModeCreateOnly
+	case syncModeCreateOnly, syncModeUpdateExisting, syncModeUpsert:
+	default:
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("mode must be one of %s, %s or %s", syncModeCreateOnly, syncModeUpdateExisting, syncModeUpsert))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), haRequestTimeout)
+	defer cancel()
+	mediaPlayers, err := c.haClient.GetMediaPlayers(ctx, r.URL.Query().Get("refresh") == "true")
+	if err != nil {
+		c.sendError(w, haErrorStatus(err), fmt.Sprintf("Failed to fetch media players: %v", err))
+		return
+	}
+
+	if len(mediaPlayers) == 0 {
+		json.NewEncoder(w).Encode(SyncLocationsResponse{Success: true, Message: "No media players found in Home Assistant"})
+		return
+	}
+
+	existingLocations, err := c.db.GetAllLocations()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch existing locations: %v", err))
+		return
+	}
+
+	existingMap := make(map[string]Location, len(existingLocations))
+	for _, loc := range existingLocations {
+		existingMap[loc.Name] = loc
+	}
+
+	resp := SyncLocationsResponse{Success: true}
+	for _, mp := range mediaPlayers {
+		locationName := strings.TrimPrefix(mp.EntityID, mediaPlayerPrefix)
+		existing, exists := existingMap[locationName]
+		switch {
+		case exists && (mode == syncModeCreateOnly || existing.SpeakerEntity == mp.EntityID):
+			resp.Skipped++
+		case exists:
+			if err := c.audit.UpdateLocation(changedBy(r), locationName, mp.EntityID, existing.DisplayName, existing.Description); err != nil {
+				continue
+			}
+			c.changed("location_updated", locationName, resourceLocations)
+			resp.Updated++
+		case mode == syncModeUpdateExisting:
+			resp.Skipped++
+		default:
+			// HA's friendly name makes a better label than the entity-derived key
+			if err := c.audit.CreateLocation(changedBy(r), locationName, mp.EntityID, mp.Name, ""); err != nil {
+				continue
+			}
+			c.changed("location_created", locationName, resourceLocations)
+			resp.Created++
+		}
+	}
+
+	resp.Message = fmt.Sprintf("Synced locations: %d created, %d updated, %d skipped", resp.Created, resp.Updated, resp.Skipped)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (c *Coordinator) HandlePlaylistGroups(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "POST", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if c.notModified(w, r, resourcePlaylistGroups) {
+			return
+		}
+		opts, err := parseListOptions(r)
+		if err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := setTotalCount(w, c.db.CountPlaylistGroups); err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		opts.Tag = strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag")))
+		groups, err := c.db.ListPlaylistGroups(opts, r.URL.Query().Get("include_playlists") == "true")
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.sendListJSON(w, r, resourcePlaylistGroups, groups)
+
+	case http.MethodPost:
+		var group PlaylistGroup
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if group.Name == "" {
+			c.sendError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		if err := checkGroupNameFree(group.Name); err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(group.Playlists) == 0 {
+			c.sendError(w, http.StatusBadRequest, "at least one playlist is required")
+			return
+		}
+		c.fillCoverArt(r.Context(), &group)
+		if err := c.audit.CreatePlaylistGroup(changedBy(r), group.Name, group.Playlists, group.CoverArt, group.Tags); err != nil {
+			c.sendCreateError(w, err, "playlist_group.name", "playlist group", group.Name)
+			return
+		}
+		c.changed("playlist_group_created", group.Name, resourcePlaylistGroups)
+		c.sendSuccess(w, fmt.Sprintf("Playlist group '%s' created with %d playlist(s)", group.Name, len(group.Playlists)))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePlaylistGroupTags lists the tags in use, for filtering groups with ?tag=
+func (c *Coordinator) handlePlaylistGroupTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tags, err := c.db.ListGroupTags()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(tags)
+}
+
+// HandlePlaylistGroupDuplicates lists playlist URIs shared by several groups
+func (c *Coordinator) HandlePlaylistGroupDuplicates(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	duplicates, err := c.db.FindDuplicatePlaylists()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(duplicates)
+}
+
+func (c *Coordinator) HandlePlaylistGroup(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "PUT", "DELETE", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		// A missing group has no items either, so check it exists first
+		exists, err := c.db.PlaylistGroupExists(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			c.sendError(w, http.StatusNotFound, fmt.Sprintf("playlist group '%s' not found", name))
+			return
+		}
+		playlists, coverArt, err := c.db.GetGroupItems(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		usedBy, err := c.db.CountIntentsUsingGroup(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tags, err := c.db.GetGroupTags(name)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(PlaylistGroup{Name: name, ItemCount: len(playlists), UsedByIntents: usedBy, Tags: tags, Playlists: playlists, CoverArt: coverArt})
+
+	case http.MethodPut:
+		var group PlaylistGroup
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if len(group.Playlists) == 0 {
+			c.sendError(w, http.StatusBadRequest, "at least one playlist is required")
+			return
+		}
+		c.fillCoverArt(r.Context(), &group)
+		if err := c.audit.UpdatePlaylistGroup(changedBy(r), name, group.Playlists, group.CoverArt, group.Tags); err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		// Intents embed their group's playlists, so their lists change too
+		c.changed("playlist_group_updated", name, resourcePlaylistGroups, resourceIntents)
+		c.sendSuccess(w, fmt.Sprintf("Playlist group '%s' updated with %d playlist(s)", name, len(group.Playlists)))
+
+	case http.MethodDelete:
+		err := c.audit.DeletePlaylistGroup(changedBy(r), name, r.URL.Query().Get("force") == "true")
+		var inUse *GroupInUseError
+		if errors.As(err, &inUse) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(GroupInUseResponse{Error: err.Error(), Intents: inUse.Intents})
+			return
+		}
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.changed("playlist_group_deleted", name, resourcePlaylistGroups, resourceIntents)
+		c.sendSuccess(w, fmt.Sprintf("Playlist group '%s' deleted", name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RenameRequest is the body of POST /api/playlist-groups/{name}/rename
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+// handlePlaylistGroupRename renames a group; intents that use it keep working
+// since they're moved to the new name in the same transaction
+// reservedGroupNames are paths under /api/playlist-groups/ that would hide a
+// group of the same name
+var reservedGroupNames = []string{"duplicates"}
+
+// checkGroupNameFree refuses playlist group names the API routes elsewhere
+func checkGroupNameFree(name string) error {
+	for _, reserved := range reservedGroupNames {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("playlist group name '%s' is reserved", name)
+		}
+	}
+	return nil
+}
+
+func (c *Coordinator) handlePlaylistGroupRename(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.sendError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if req.Name == name {
+		c.sendError(w, http.StatusBadRequest, "new name must differ from the current one")
+		return
+	}
+	if err := checkGroupNameFree(req.Name); err != nil {
+		c.sendError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := c.audit.RenamePlaylistGroup(changedBy(r), name, req.Name)
+	if errors.Is(err, ErrPlaylistGroupExists) {
+		c.sendError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		c.sendError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	c.etags.invalidate(resourcePlaylistGroups, resourceIntents)
+	c.broadcastChange(ChangeEvent{Type: "playlist_group_renamed", Name: req.Name, OldName: name})
+	c.sendSuccess(w, fmt.Sprintf("Playlist group '%s' renamed to '%s'", name, req.Name))
+}
+
+// GroupInUseResponse is the 409 body of DELETE /api/playlist-groups/{name} while
+// intents still use the group
+type GroupInUseResponse struct {
+	Success bool     `json:"success"`
+	Error   string   `json:"error"`
+	Intents []string `json:"intents"`
+}
+
+// validateChainSteps checks the steps of a chain in a create or update request
+func validateChainSteps(steps []ChainStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("at least one step is required")
+	}
+	for i, step := range steps {
+		if step.Intent == "" || step.Location == "" {
+			return fmt.Errorf("step %d: intent and location are required", i+1)
+		}
+		if step.DelaySeconds < 0 {
+			return fmt.Errorf("step %d: delay_seconds must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+func (c *Coordinator) HandleChains(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "POST", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if c.notModified(w, r, resourceChains) {
+			return
+		}
+		opts, err := parseListOptions(r)
+		if err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := setTotalCount(w, c.db.CountChains); err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		chains, err := c.db.ListChains(opts)
+		if err != nil {
+			c.sendError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.sendListJSON(w, r, resourceChains, chains)
+
+	case http.MethodPost:
+		var chain Chain
+		if err := json.NewDecoder(r.Body).Decode(&chain); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if chain.Name == "" {
+			c.sendError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		if err := validateChainSteps(chain.Steps); err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := c.audit.CreateChain(changedBy(r), chain.Name, chain.Steps); err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.changed("chain_created", chain.Name, resourceChains)
+		c.sendSuccess(w, fmt.Sprintf("Chain '%s' created with %d step(s)", chain.Name, len(chain.Steps)))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *Coordinator) HandleChain(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, "GET", "PUT", "DELETE", "OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		handleOptions(w)
+		return
+	}
+
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		chain, err := c.db.GetChain(name)
+		if err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		chain.Running = c.chainRunning(chain.Name)
+		json.NewEncoder(w).Encode(chain)
+
+	case http.MethodPut:
+		var chain Chain
+		if err := json.NewDecoder(r.Body).Decode(&chain); err != nil {
+			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if err := validateChainSteps(chain.Steps); err != nil {
+			c.sendError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := c.audit.UpdateChain(changedBy(r), name, chain.Steps); err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.changed("chain_updated", name, resourceChains)
+		c.sendSuccess(w, fmt.Sprintf("Chain '%s' updated with %d step(s)", name, len(chain.Steps)))
+
+	case http.MethodDelete:
+		if err := c.audit.DeleteChain(changedBy(r), name); err != nil {
+			c.sendError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		c.stopChain(name)
+		c.changed("chain_deleted", name, resourceChains)
+		c.sendSuccess(w, fmt.Sprintf("Chain '%s' deleted", name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleChainRun starts (POST) or aborts (DELETE) a chain run
+func (c *Coordinator) handleChainRun(w http.ResponseWriter, r *http.Request, name string) {
 	switch r.Method {
-	case http.MethodGet:
-		location, err := c.db.GetLocation(name)
+	case http.MethodPost:
+		chain, err := c.db.GetChain(name)
 		if err != nil {
 			c.sendError(w, http.StatusNotFound, err.Error())
 			return
 		}
-		json.NewEncoder(w).Encode(location)
+		if err := c.startChain(chain); err != nil {
+			status := http.StatusConflict
+			if errors.Is(err, ErrShuttingDown) {
+				status = http.StatusServiceUnavailable
+			}
+			c.sendError(w, status, err.Error())
+			return
+		}
+		c.sendSuccess(w, fmt.Sprintf("Chain '%s' started with %d step(s)", chain.Name, len(chain.Steps)))
+
+	case http.MethodDelete:
+		if !c.stopChain(name) {
+			c.sendError(w, http.StatusNotFound, fmt.Sprintf("chain '%s' is not running", name))
+			return
+		}
+		c.sendSuccess(w, fmt.Sprintf("Chain '%s' aborted", name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// chainRun is a chain being played in the background
+type chainRun struct {
+	cancel context.CancelFunc
+}
+
+func (c *Coordinator) chainRunning(name string) bool {
+	c.chainMu.Lock()
+	defer c.chainMu.Unlock()
+	_, ok := c.chainRuns[name]
+	return ok
+}
+
+// startChain runs chain in a goroutine unless it is already running or the
+// coordinator is shutting down. The run counts as an in-flight play, so
+// Shutdown waits for it to return before closing the database.
+func (c *Coordinator) startChain(chain *Chain) error {
+	c.chainMu.Lock()
+	defer c.chainMu.Unlock()
+	if _, ok := c.chainRuns[chain.Name]; ok {
+		return fmt.Errorf("chain '%s' is already running", chain.Name)
+	}
+	if !c.trackPlay() {
+		return ErrShuttingDown
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &chainRun{cancel: cancel}
+	c.chainRuns[chain.Name] = run
+
+	go func() {
+		defer c.plays.Done()
+		defer func() {
+			cancel()
+			c.chainMu.Lock()
+			if c.chainRuns[chain.Name] == run {
+				delete(c.chainRuns, chain.Name)
+			}
+			c.chainMu.Unlock()
+		}()
+		c.runChain(ctx, chain)
+	}()
+	return nil
+}
+
+// stopChain aborts the chain if it is running, reporting whether it was
+func (c *Coordinator) stopChain(name string) bool {
+	c.chainMu.Lock()
+	defer c.chainMu.Unlock()
+	run, ok := c.chainRuns[name]
+	if !ok {
+		return false
+	}
+	run.cancel()
+	delete(c.chainRuns, name)
+	return true
+}
+
+// runChain plays each step in order, waiting its delay before the next one. A
+// step that fails to play is logged and skipped; cancelling ctx ends the run.
+func (c *Coordinator) runChain(ctx context.Context, chain *Chain) {
+	log.Printf("[Chain] Running '%s' (%d step(s))", chain.Name, len(chain.Steps))
+	for i, step := range chain.Steps {
+		if ctx.Err() != nil {
+			break
+		}
+		req := IntentRequest{Intent: step.Intent, Location: step.Location, TriggeredBy: triggeredViaChain + ":" + chain.Name}
+		playCtx, cancel := context.WithTimeout(ctx, haRequestTimeout)
+		playlist, _, err := c.play(playCtx, req, triggeredViaChain)
+		cancel()
+		if err != nil {
+			log.Printf("[Chain] '%s' step %d: failed to play '%s' on '%s': %v", chain.Name, i+1, step.Intent, step.Location, err)
+		} else {
+			log.Printf("[Chain] '%s' step %d: playing '%s' on '%s' (%s)", chain.Name, i+1, step.Intent, step.Location, playlist)
+		}
+
+		if i == len(chain.Steps)-1 || step.DelaySeconds == 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(step.DelaySeconds) * time.Second):
+		}
+	}
+	if ctx.Err() != nil {
+		log.Printf("[Chain] '%s' aborted", chain.Name)
+		return
+	}
+	log.Printf("[Chain] '%s' finished", chain.Name)
+}
+
+// fillCoverArt looks up cover art in Music Assistant for group playlists the client
+// didn't supply one for. MA being unreachable only costs the artwork.
+func (c *Coordinator) fillCoverArt(ctx context.Context, group *PlaylistGroup) {
+	missing := false
+	for _, playlist := range group.Playlists {
+		if group.CoverArt[playlist] == "" {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return
+	}
+
+	if !c.maClient.Enabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	maPlaylists, err := c.maClient.GetPlaylists(ctx)
+	if err != nil {
+		logf(ctx, "[MA] Could not fetch cover art for group '%s': %v", group.Name, err)
+		return
+	}
+	byURI := make(map[string]string, len(maPlaylists))
+	for _, p := range maPlaylists {
+		if p.CoverArtURL != "" {
+			byURI[p.URI] = p.CoverArtURL
+		}
+	}
+	for _, playlist := range group.Playlists {
+		if group.CoverArt[playlist] != "" {
+			continue
+		}
+		if coverArtURL, ok := byURI[playlist]; ok {
+			if group.CoverArt == nil {
+				group.CoverArt = make(map[string]string)
+			}
+			group.CoverArt[playlist] = coverArtURL
+		}
+	}
+}
+
+// handleDBMigrate moves the schema to ?version=N, rolling back if N is older
+// than the current version. Since a rollback can break the running build, it's
+// refused unless AUTH_TOKEN is set, which withAuth then requires on the call.
+// A rollback below latestSchemaVersion drops columns this build still selects,
+// so it also needs force=true: the caller is about to stop this instance and
+// start the release for version N.
+func (c *Coordinator) handleDBMigrate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.currentConfig().AuthToken == "" {
+		c.sendError(w, http.StatusForbidden, "schema migrations over the API require AUTH_TOKEN to be set")
+		return
+	}
+
+	target, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		c.sendError(w, http.StatusBadRequest, "version must be an integer")
+		return
+	}
+	previous, err := c.db.SchemaVersion()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if target < 0 || target > latestSchemaVersion() {
+		c.sendError(w, http.StatusBadRequest, fmt.Sprintf("version must be between 0 and %d", latestSchemaVersion()))
+		return
+	}
+	if target < latestSchemaVersion() && target < previous && r.URL.Query().Get("force") != "true" {
+		c.sendError(w, http.StatusConflict, fmt.Sprintf("this build needs schema version %d; rolling back to %d breaks it until it is stopped, so add force=true", latestSchemaVersion(), target))
+		return
+	}
+	if err := c.db.MigrateToVersion(target); err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	logf(r.Context(), "[DB] Schema moved from version %d to %d via API", previous, target)
+	c.sendSuccess(w, fmt.Sprintf("Database schema at version %d (was %d)", target, previous))
+}
+
+// runOrphanCleanup repeats the orphan cleanups every interval until done is
+// closed, invalidating the intent and playlist group ETags when rows changed
+func (c *Coordinator) runOrphanCleanup(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.db.cleanupOrphans() {
+				c.etags.invalidate(resourceIntents, resourcePlaylistGroups)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleDBCleanup runs the orphan cleanups now instead of waiting for the daily
+// sweep
+func (c *Coordinator) handleDBCleanup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	removed, err := c.db.CleanupOrphanedPlaylistItems()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.etags.invalidate(resourcePlaylistGroups)
+	cleared, err := c.db.CleanupOrphanedIntentGroupRefs()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.etags.invalidate(resourceIntents, resourcePlaylistGroups)
+	c.sendSuccess(w, fmt.Sprintf("Removed %d orphaned playlist group item(s) and cleared %d intent reference(s) to missing groups", removed, cleared))
+}
+
+func (c *Coordinator) HandleStats(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if param := r.URL.Query().Get("since"); param != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, param); err != nil {
+			c.sendError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp (e.g. 2024-01-01T00:00:00Z)")
+			return
+		}
+	}
+
+	stats, err := c.db.GetStats(since)
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func (c *Coordinator) HandleVersion(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(VersionInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	})
+}
+
+func (c *Coordinator) HandleAvailablePlaylists(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playlists, err := c.db.GetAllAvailablePlaylists()
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.URL.Query().Get("include_ma") == "true" && c.maClient.Enabled() {
+		maPlaylists, err := c.maClient.GetPlaylists(r.Context())
+		if err != nil {
+			c.sendError(w, maErrorStatus(err), fmt.Sprintf("Failed to fetch Music Assistant playlists: %v", err))
+			return
+		}
+		playlists = mergeMAPlaylists(playlists, maPlaylists)
+	}
+	if r.URL.Query().Get("include_cover_art") == "true" {
+		json.NewEncoder(w).Encode(playlists)
+		return
+	}
+	// Plain URIs by default, the shape existing clients expect
+	uris := make([]string, len(playlists))
+	for i, p := range playlists {
+		uris[i] = p.Playlist
+	}
+	json.NewEncoder(w).Encode(uris)
+}
+
+// mergeMAPlaylists adds MA library playlists missing from playlists, deduplicating
+// by normalized URI and filling in cover art the database doesn't have
+func mergeMAPlaylists(playlists []AvailablePlaylist, maPlaylists []MAPlaylist) []AvailablePlaylist {
+	index := make(map[string]int, len(playlists))
+	for i, p := range playlists {
+		index[p.Playlist] = i
+	}
+	for _, mp := range maPlaylists {
+		uri := normalizePlaylistURI(mp.URI)
+		if uri == "" {
+			continue
+		}
+		if i, ok := index[uri]; ok {
+			if playlists[i].CoverArtURL == "" {
+				playlists[i].CoverArtURL = mp.CoverArtURL
+			}
+			continue
+		}
+		index[uri] = len(playlists)
+		playlists = append(playlists, AvailablePlaylist{Playlist: uri, CoverArtURL: mp.CoverArtURL})
+	}
+	sort.Slice(playlists, func(i, j int) bool { return playlists[i].Playlist < playlists[j].Playlist })
+	return playlists
+}
+
+const (
+	resourceIntents        = "intents"
+	resourceLocations      = "locations"
+	resourcePlaylistGroups = "playlist-groups"
+	resourceChains         = "chains"
+)
+
+// etagCache remembers the ETag last served for each list resource so unchanged
+// lists can be answered with 304 without touching the database
+type etagCache struct {
+	mu    sync.RWMutex
+	etags map[string]string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{etags: make(map[string]string)}
+}
+
+func (e *etagCache) get(key string) string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.etags[key]
+}
+
+func (e *etagCache) set(key, etag string) {
+	e.mu.Lock()
+	e.etags[key] = etag
+	e.mu.Unlock()
+}
+
+// invalidate forgets every cached ETag for the given resources
+func (e *etagCache) invalidate(resources ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key := range e.etags {
+		for _, resource := range resources {
+			if key == resource || strings.HasPrefix(key, resource+"?") {
+				delete(e.etags, key)
+			}
+		}
+	}
+}
+
+// etagKey identifies a cached list response by resource and query string
+func etagKey(resource string, r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return resource
+	}
+	return resource + "?" + r.URL.RawQuery
+}
+
+// notModified answers 304 if the client already holds the current ETag for this list
+func (c *Coordinator) notModified(w http.ResponseWriter, r *http.Request, resource string) bool {
+	etag := c.etags.get(etagKey(resource, r))
+	if etag == "" || r.Header.Get("If-None-Match") != etag {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// sendListJSON writes v with an ETag derived from its serialized form, remembering
+// the tag for later conditional requests
+func (c *Coordinator) sendListJSON(w http.ResponseWriter, r *http.Request, resource string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		c.sendError(w, http.StatusInternalServerError, fmt.Sprintf("failed to encode response: %v", err))
+		return
+	}
+	data = append(data, '\n')
+
+	hash := fnv.New64a()
+	hash.Write(data)
+	etag := fmt.Sprintf(`"%x"`, hash.Sum64())
+	c.etags.set(etagKey(resource, r), etag)
+
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(data)
+}
+
+const (
+	apiPrefix         = "/api"
+	currentAPIVersion = "v1"
+)
+
+type apiRoute struct {
+	path    string // relative to the API prefix, e.g. "/intents/"
+	handler http.Handler
+}
+
+// apiRoutes lists every API route once; Handler registers each under
+// /api/<version> and under the deprecated unversioned /api prefix
+func (c *Coordinator) apiRoutes() []apiRoute {
+	routes := []apiRoute{
+		{"/play", c.playLimiter.Limit(http.HandlerFunc(c.HandlePlayIntent))},
+		{"/play/undo", withCORS(c.handlePlayUndo, "POST", "OPTIONS")},
+		{"/intents", http.HandlerFunc(c.HandleIntents)},
+		{"/intents/bulk", withCORS(c.handleIntentsBulk, "POST", "OPTIONS")},
+		{"/intents/least-played", withCORS(c.handleLeastPlayedIntent, "GET", "OPTIONS")},
+		{"/intents/validate-all", withCORS(c.handleValidateAllIntents, "POST", "OPTIONS")},
+		{"/intents/{name}", http.HandlerFunc(c.HandleIntent)},
+		{"/intents/{name}/history", withName(c.handleIntentHistory, "GET", "OPTIONS")},
+		{"/intents/{name}/preview", withName(c.handleIntentPreview, "GET", "OPTIONS")},
+		{"/intents/{name}/validate", withName(c.handleIntentValidate, "POST", "OPTIONS")},
+		{"/locations", http.HandlerFunc(c.HandleLocations)},
+		{"/locations/validate-all", withCORS(c.handleValidateAllLocations, "POST", "OPTIONS")},
+		{"/locations/{name}", http.HandlerFunc(c.HandleLocation)},
+		{"/locations/{name}/history", withName(c.handleLocationHistory, "GET", "OPTIONS")},
+		{"/locations/{name}/queue", withName(c.handleLocationQueue, "GET", "POST", "OPTIONS")},
+		{"/locations/{name}/volume-profile", withName(c.handleVolumeProfiles, "GET", "POST", "OPTIONS")},
+		{"/locations/{name}/volume-profile/{id}", withCORS(c.handleVolumeProfile, "DELETE", "OPTIONS")},
+		{"/locations/{name}/announce", withName(c.handleLocationAnnounce, "POST", "OPTIONS")},
+		{"/locations/{name}/follow", withName(c.handleLocationFollow, "POST", "OPTIONS")},
+		{"/locations/{name}/validate", withName(c.handleLocationValidate, "POST", "OPTIONS")},
+		{"/locations/{name}/ha", withName(c.handleLocationHA, "GET", "PUT", "DELETE", "OPTIONS")},
+		{"/playlist-groups", http.HandlerFunc(c.HandlePlaylistGroups)},
+		{"/playlist-groups/duplicates", http.HandlerFunc(c.HandlePlaylistGroupDuplicates)},
+		{"/playlist-groups/{name}", http.HandlerFunc(c.HandlePlaylistGroup)},
+		{"/playlist-groups/{name}/rename", withName(c.handlePlaylistGroupRename, "POST", "OPTIONS")},
+		{"/playlist-group-tags", withCORS(c.handlePlaylistGroupTags, "GET", "OPTIONS")},
+		{"/chains", http.HandlerFunc(c.HandleChains)},
+		{"/chains/{name}", http.HandlerFunc(c.HandleChain)},
+		{"/chains/{name}/run", withName(c.handleChainRun, "POST", "DELETE", "OPTIONS")},
+		{"/available-playlists", http.HandlerFunc(c.HandleAvailablePlaylists)},
+		{"/media-players", http.HandlerFunc(c.HandleMediaPlayers)},
+		{"/ma/playlists", http.HandlerFunc(c.HandleMAPlaylists)},
+		{"/ma/playlists/search", http.HandlerFunc(c.HandleMAPlaylistSearch)},
+		{"/sync-locations", http.HandlerFunc(c.HandleSyncLocations)},
+		{"/stats", http.HandlerFunc(c.HandleStats)},
+		{"/audit", withCORS(c.handleAudit, "GET", "OPTIONS")},
+		{"/db/cleanup", withCORS(c.handleDBCleanup, "POST", "OPTIONS")},
+		{"/db/migrate", withCORS(c.handleDBMigrate, "POST", "OPTIONS")},
+		{"/version", http.HandlerFunc(c.HandleVersion)},
+		{"/events", http.HandlerFunc(c.HandleEvents)},
+		{"/ws", http.HandlerFunc(c.HandleWebSocket)},
+		{"/openapi.yaml", http.HandlerFunc(c.HandleOpenAPIYAML)},
+		{"/openapi.json", http.HandlerFunc(c.HandleOpenAPIJSON)},
+		{"/docs", http.HandlerFunc(c.HandleAPIDocs)},
+	}
+	for action := range locationControlServices {
+		routes = append(routes, apiRoute{"/locations/{name}/" + action, withName(c.locationControl(action), "POST", "OPTIONS")})
+	}
+	return routes
+}
+
+// withCORS sets the CORS headers for methods and answers preflight requests
+// before handing over to h
+func withCORS(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setCORSHeaders(w, methods...)
+		if r.Method == http.MethodOptions {
+			handleOptions(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withName is withCORS for {name} sub-routes, passing the unescaped name to h
+func withName(h func(http.ResponseWriter, *http.Request, string), methods ...string) http.HandlerFunc {
+	return withCORS(func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, r.PathValue("name"))
+	}, methods...)
+}
+
+// versioned serves a route registered under /api/<version> by presenting the
+// request to the handler with its unversioned /api path. Path values matched by
+// the mux are carried over by Clone.
+func versioned(version string, next http.Handler) http.Handler {
+	prefix := apiPrefix + "/" + version
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = apiPrefix + strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// deprecated marks responses from the unversioned /api routes and points
+// clients at the current version
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := apiPrefix + "/" + currentAPIVersion + strings.TrimPrefix(r.URL.Path, apiPrefix)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next.ServeHTTP(w, r)
+	})
+}
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+var apiDocsPaths = map[string]bool{
+	"/openapi.yaml": true,
+	"/openapi.json": true,
+	"/docs":         true,
+}
+
+// isAPIDocsPath reports whether path serves the spec or Swagger UI under any API prefix
+func isAPIDocsPath(path string) bool {
+	rest := strings.TrimPrefix(path, apiPrefix)
+	if rest == path {
+		return false
+	}
+	rest = strings.TrimPrefix(rest, "/"+currentAPIVersion)
+	return apiDocsPaths[rest]
+}
+
+func (c *Coordinator) HandleOpenAPIYAML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(openAPISpec)
+}
+
+func (c *Coordinator) HandleOpenAPIJSON(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	var spec interface{}
+	if err := yaml.Unmarshal(openAPISpec, &spec); err != nil {
+		c.sendError(w, http.StatusInternalServerError, fmt.Sprintf("failed to parse OpenAPI spec: %v", err))
+		return
+	}
+	json.NewEncoder(w).Encode(spec)
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at the embedded spec
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Music Coordinator API</title>
+    <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+    <div id="swagger-ui"></div>
+    <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+    <script>
+        SwaggerUIBundle({ url: 'openapi.yaml', dom_id: '#swagger-ui' });
+    </script>
+</body>
+</html>
+`
+
+func (c *Coordinator) HandleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, swaggerUIPage)
+}
+
+//go:embed ui
+var embeddedUI embed.FS
+
+// uiDirNone as UI_DIR turns the web UI off, e.g. when it's hosted elsewhere
+const uiDirNone = "none"
+
+// uiHandler serves the web UI compiled into the binary, or from UI_DIR when set
+// so the UI can be edited without rebuilding. It returns nil for UI_DIR=none.
+func (c *Coordinator) uiHandler() http.Handler {
+	switch dir := c.currentConfig().UIDir; dir {
+	case "":
+	case uiDirNone:
+		log.Printf("Not serving a UI (UI_DIR=%s)", uiDirNone)
+		return nil
+	default:
+		log.Printf("Serving UI from %s", dir)
+		return spaHandler(os.DirFS(dir))
+	}
+	uiFS, err := fs.Sub(embeddedUI, "ui")
+	if err != nil {
+		// Only possible if the embed directive and the path above disagree
+		panic(fmt.Sprintf("embedded UI missing: %v", err))
+	}
+	return spaHandler(uiFS)
+}
 
-	case http.MethodPut:
-		var location Location
-		if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
-			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-			return
+// spaHandler serves files from fsys and answers any path that isn't a file
+// with index.html, so client-side routes like /locations/kitchen load the app
+// instead of a 404. Missing assets (paths with an extension) and unknown paths
+// under /api still get a 404.
+func spaHandler(fsys fs.FS) http.Handler {
+	files := http.FileServer(http.FS(fsys))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" {
+			name = "."
 		}
-		if location.SpeakerEntity == "" {
-			c.sendError(w, http.StatusBadRequest, "speaker_entity is required")
+		_, err := fs.Stat(fsys, name)
+		if err != nil && path.Ext(name) == "" && !strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+			http.ServeFileFS(w, r, fsys, "index.html")
 			return
 		}
-		if err := c.db.UpdateLocation(name, location.SpeakerEntity); err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
+		files.ServeHTTP(w, r)
+	})
+}
+
+// Handler builds the coordinator's HTTP handler: versioned and legacy API
+// routes, health checks and the web UI, wrapped in the shared middleware
+func (c *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, route := range c.apiRoutes() {
+		mux.Handle(apiPrefix+"/"+currentAPIVersion+route.path, versioned(currentAPIVersion, route.handler))
+		mux.Handle(apiPrefix+route.path, deprecated(route.handler))
+	}
+	mux.Handle("/play", c.playLimiter.Limit(http.HandlerFunc(c.HandlePlayIntent)))
+	mux.HandleFunc("/health", c.HandleHealth)
+	mux.HandleFunc("/metrics", c.HandleMetrics)
+	mux.HandleFunc("/health/live", c.HandleLiveness)
+	mux.HandleFunc("/health/ready", c.HandleReadiness)
+
+	if ui := c.uiHandler(); ui != nil {
+		mux.Handle("/", ui)
+	}
+
+	return withRequestID(c.withAuth(withGzip(trimTrailingSlash(mux))))
+}
+
+// trimTrailingSlash serves /api/.../ as the same path without the slash. The
+// request is rewritten rather than redirected so POST bodies aren't lost.
+func trimTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if !strings.HasPrefix(path, apiPrefix+"/") || !strings.HasSuffix(path, "/") {
+			next.ServeHTTP(w, r)
 			return
 		}
-		c.sendSuccess(w, fmt.Sprintf("Location '%s' updated", name))
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = strings.TrimRight(path, "/")
+		r2.URL.RawPath = strings.TrimRight(r.URL.RawPath, "/")
+		next.ServeHTTP(w, r2)
+	})
+}
 
-	case http.MethodDelete:
-		if err := c.db.DeleteLocation(name); err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+type ComponentHealth struct {
+	Status    string `json:"status"`
+	Connected *bool  `json:"connected,omitempty"` // set for MQTT
+	LatencyMS *int64 `json:"latency_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+// checkComponent runs check with the given timeout and reports its outcome and latency
+func checkComponent(parent context.Context, timeout time.Duration, check func(context.Context) error) ComponentHealth {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	latency := time.Since(start).Milliseconds()
+
+	health := ComponentHealth{Status: healthOK, LatencyMS: &latency}
+	if err != nil {
+		health.Status = healthDegraded
+		health.Error = err.Error()
+	}
+	return health
+}
+
+func (c *Coordinator) mqttConnected() bool {
+	return c.mqttClient != nil && c.mqttClient.IsConnected()
+}
+
+func (c *Coordinator) mqttHealth() ComponentHealth {
+	connected := c.mqttConnected()
+	if !connected {
+		return ComponentHealth{Status: healthDegraded, Connected: &connected, Error: "not connected to broker"}
+	}
+	return ComponentHealth{Status: healthOK, Connected: &connected}
+}
+
+// mqttWatchInterval is how often watchMQTT warns while the broker is unreachable
+const mqttWatchInterval = 30 * time.Second
+
+// watchMQTT logs a warning every interval while the client is disconnected, as
+// paho's auto-reconnect otherwise retries without a word until done is closed
+func (c *Coordinator) watchMQTT(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !c.mqttConnected() {
+				log.Printf("[MQTT] Warning: still not connected to broker; auto-reconnect may be failing")
+			}
+		case <-done:
 			return
 		}
-		c.sendSuccess(w, fmt.Sprintf("Location '%s' deleted", name))
+	}
+}
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// HandleHealth reports per-component status, answering 503 if any component is unhealthy
+func (c *Coordinator) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	components := map[string]ComponentHealth{
+		"database": checkComponent(r.Context(), time.Second, c.db.Ping),
+		"mqtt":     c.mqttHealth(),
+	}
+	if c.haClient.Configured() {
+		components["ha"] = checkComponent(r.Context(), 2*time.Second, c.haClient.Ping)
 	}
+	sendHealth(w, components)
 }
 
-func (c *Coordinator) HandleMediaPlayers(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, "GET", "OPTIONS")
+// countRefreshInterval is how often the /metrics totals are recounted
+const countRefreshInterval = 60 * time.Second
 
-	if r.Method == http.MethodOptions {
-		handleOptions(w)
-		return
+// refreshCounts recounts intents and locations for /metrics, keeping the last
+// values if the database can't be read
+func (c *Coordinator) refreshCounts() {
+	if n, err := c.db.CountIntents(); err != nil {
+		log.Printf("[DB] Warning: failed to count intents: %v", err)
+	} else {
+		c.intentsTotal.Store(int64(n))
+	}
+	if n, err := c.db.CountLocations(); err != nil {
+		log.Printf("[DB] Warning: failed to count locations: %v", err)
+	} else {
+		c.locationsTotal.Store(int64(n))
+	}
+}
+
+// runCountRefresh refreshes the /metrics totals now and every interval until
+// done is closed, so scrapes never scan the tables
+func (c *Coordinator) runCountRefresh(interval time.Duration, done <-chan struct{}) {
+	c.refreshCounts()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refreshCounts()
+		case <-done:
+			return
+		}
 	}
+}
 
+// HandleMetrics serves gauges in the Prometheus text exposition format
+func (c *Coordinator) HandleMetrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintf(w, "# HELP intents_total Number of configured intents.\n# TYPE intents_total gauge\nintents_total %d\n", c.intentsTotal.Load())
+	fmt.Fprintf(w, "# HELP locations_total Number of configured locations.\n# TYPE locations_total gauge\nlocations_total %d\n", c.locationsTotal.Load())
+}
 
-	mediaPlayers, err := c.haClient.GetMediaPlayers()
-	if err != nil {
-		c.sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch media players: %v", err))
-		return
-	}
+// HandleLiveness answers 200 while the process is running, without external checks
+func (c *Coordinator) HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	sendHealth(w, map[string]ComponentHealth{})
+}
 
-	if mediaPlayers == nil {
-		mediaPlayers = []MediaPlayer{}
+// HandleReadiness answers 200 only when the database and MQTT broker are usable,
+// so a transient outage takes the instance out of rotation without restarting it
+func (c *Coordinator) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	components := map[string]ComponentHealth{
+		"database": checkComponent(r.Context(), time.Second, c.db.Ping),
+		"mqtt":     c.mqttHealth(),
 	}
-	json.NewEncoder(w).Encode(mediaPlayers)
+	if c.maClient.Enabled() {
+		components["music_assistant"] = checkComponent(r.Context(), 2*time.Second, c.maClient.Ping)
+	}
+	sendHealth(w, components)
 }
 
-func (c *Coordinator) HandleSyncLocations(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, "POST", "OPTIONS")
-
-	if r.Method == http.MethodOptions {
-		handleOptions(w)
-		return
+func sendHealth(w http.ResponseWriter, components map[string]ComponentHealth) {
+	resp := HealthResponse{Status: healthOK, Components: components}
+	statusCode := http.StatusOK
+	for _, component := range components {
+		if component.Status != healthOK {
+			resp.Status = healthDegraded
+			statusCode = http.StatusServiceUnavailable
+		}
 	}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
 
-	mediaPlayers, err := c.haClient.GetMediaPlayers()
-	if err != nil {
-		c.sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch media players: %v", err))
-		return
+// sendPlayReport writes a multi-location play report: 200 when every location
+// played, 207 when only some did and 502 when none did
+func (c *Coordinator) sendPlayReport(w http.ResponseWriter, report *PlayReport) {
+	statusCode := http.StatusOK
+	if !report.Success {
+		statusCode = http.StatusBadGateway
+		for _, result := range report.Results {
+			if result.Error == "" {
+				statusCode = http.StatusMultiStatus
+				break
+			}
+		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(report)
+}
 
-	if len(mediaPlayers) == 0 {
-		c.sendSuccess(w, "No media players found in Home Assistant")
+func (c *Coordinator) sendSuccess(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(IntentResponse{
+		Success: true,
+		Message: message,
+	})
+}
+
+func (c *Coordinator) sendError(w http.ResponseWriter, statusCode int, errorMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(IntentResponse{
+		Success: false,
+		Error:   errorMsg,
+	})
+}
+
+// sendValidationErrors answers 400 with each invalid field
+func (c *Coordinator) sendValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ValidationResponse{Error: errs.Error(), ValidationErrors: errs})
+}
+
+// sendPlayError answers a failed play with its playError status, listing the
+// invalid fields when the request itself was the problem
+func (c *Coordinator) sendPlayError(w http.ResponseWriter, err error) {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		c.sendValidationErrors(w, errs)
 		return
 	}
+	c.sendError(w, playErrorStatus(err), err.Error())
+}
 
-	existingLocations, err := c.db.GetAllLocations()
-	if err != nil {
-		c.sendError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch existing locations: %v", err))
+// sendCreateError answers a failed create with 409 when SQLite rejected the name
+// as a duplicate of column (e.g. "intent.name"), and 400 otherwise
+func (c *Coordinator) sendCreateError(w http.ResponseWriter, err error, column, kind, name string) {
+	if strings.Contains(err.Error(), "UNIQUE constraint failed: "+column) {
+		c.sendError(w, http.StatusConflict, fmt.Sprintf("%s '%s' already exists", kind, name))
 		return
 	}
+	c.sendError(w, http.StatusBadRequest, err.Error())
+}
 
-	existingMap := make(map[string]bool, len(existingLocations))
-	for _, loc := range existingLocations {
-		existingMap[loc.Name] = true
-	}
+type HAClient struct {
+	baseURL string
+	token   string
+	tokenMu sync.RWMutex
+	client  *http.Client
 
-	created, skipped := 0, 0
-	for _, mp := range mediaPlayers {
-		locationName := strings.TrimPrefix(mp.EntityID, mediaPlayerPrefix)
-		if existingMap[locationName] {
-			skipped++
-			continue
-		}
-		if err := c.db.CreateLocation(locationName, mp.EntityID); err != nil {
-			continue
-		}
-		created++
-	}
+	maxRetries atomic.Int32
 
-	c.sendSuccess(w, fmt.Sprintf("Synced locations: %d created, %d skipped", created, skipped))
+	mediaPlayerCache mediaPlayerCache
 }
 
-func (c *Coordinator) HandlePlaylistGroups(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, "GET", "POST", "OPTIONS")
+// mediaPlayerCache holds the last GetMediaPlayers result so frequent polling
+// doesn't hit /api/states every time
+type mediaPlayerCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	players   []MediaPlayer
+	fetchedAt time.Time
+}
 
-	if r.Method == http.MethodOptions {
-		handleOptions(w)
-		return
+// NewHAClient returns a client whose requests each time out after timeout
+func NewHAClient(baseURL, token string, timeout, mediaPlayerCacheTTL time.Duration, maxRetries int) *HAClient {
+	c := &HAClient{
+		baseURL: baseURL,
+		token:   token,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		mediaPlayerCache: mediaPlayerCache{ttl: mediaPlayerCacheTTL},
 	}
+	c.maxRetries.Store(int32(maxRetries))
+	return c
+}
 
-	switch r.Method {
-	case http.MethodGet:
-		groups, err := c.db.GetAllPlaylistGroups()
-		if err != nil {
-			c.sendError(w, http.StatusInternalServerError, err.Error())
-			return
+// ErrHANotConfigured is returned by every HAClient call when it has no base URL,
+// rather than sending the request to whatever host a default would point at
+var ErrHANotConfigured = errors.New("Home Assistant is not configured (HA_URL not set)")
+
+// Configured reports whether the client has a Home Assistant URL to talk to
+func (c *HAClient) Configured() bool {
+	return c.baseURL != ""
+}
+
+// SetMaxRetries changes how many times idempotent HA requests are retried
+func (c *HAClient) SetMaxRetries(maxRetries int) {
+	c.maxRetries.Store(int32(maxRetries))
+}
+
+// doWithRetry sends req, retrying network errors and 5xx responses up to maxRetries
+// times with exponential backoff (500ms, 1s, 2s, ... ±25% jitter). The overall
+// deadline comes from req's context.
+func (c *HAClient) doWithRetry(req *http.Request, maxRetries int) (*http.Response, error) {
+	ctx := req.Context()
+	delay := haRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+			req.Body = body
 		}
-		json.NewEncoder(w).Encode(groups)
 
-	case http.MethodPost:
-		var group PlaylistGroup
-		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
-			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-			return
+		resp, err := c.client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
 		}
-		if group.Name == "" {
-			c.sendError(w, http.StatusBadRequest, "name is required")
-			return
+		if attempt >= maxRetries || ctx.Err() != nil {
+			return resp, err
 		}
-		if len(group.Playlists) == 0 {
-			c.sendError(w, http.StatusBadRequest, "at least one playlist is required")
-			return
+		if err != nil {
+			logf(ctx, "[HA] %s %s failed (attempt %d/%d): %v", req.Method, req.URL.Path, attempt+1, maxRetries+1, err)
+		} else {
+			logf(ctx, "[HA] %s %s returned %d (attempt %d/%d)", req.Method, req.URL.Path, resp.StatusCode, attempt+1, maxRetries+1)
+			resp.Body.Close()
 		}
-		if err := c.db.CreatePlaylistGroup(group.Name, group.Playlists); err != nil {
-			c.sendError(w, http.StatusBadRequest, err.Error())
-			return
+
+		jittered := time.Duration(float64(delay) * (0.75 + mathrand.Float64()*0.5))
+		select {
+		case <-time.After(jittered):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		c.sendSuccess(w, fmt.Sprintf("Playlist group '%s' created with %d playlist(s)", group.Name, len(group.Playlists)))
+		delay *= 2
+	}
+}
+
+// SetMediaPlayerCacheTTL changes how long GetMediaPlayers results are reused
+func (c *HAClient) SetMediaPlayerCacheTTL(ttl time.Duration) {
+	c.mediaPlayerCache.mu.Lock()
+	c.mediaPlayerCache.ttl = ttl
+	c.mediaPlayerCache.mu.Unlock()
+}
+
+// SetToken replaces the bearer token used for subsequent requests
+func (c *HAClient) SetToken(token string) {
+	c.tokenMu.Lock()
+	c.token = token
+	c.tokenMu.Unlock()
+}
 
+func (c *HAClient) getToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.token
+}
+
+// playMusic starts playlist on speakerEntity over the configured transport. A
+// non-empty enqueue ("add", "next", …) is passed through to MA so the playlist
+// is queued instead of replacing what's playing.
+func (c *Coordinator) playMusic(ctx context.Context, location, speakerEntity, playlist, enqueue string) error {
+	switch transport := c.currentConfig().PlayTransport; transport {
+	case playTransportMAHTTP:
+		if err := c.maClient.PlayMedia(ctx, speakerEntity, playlist, "playlist", false, enqueue); err != nil {
+			logf(ctx, "[MA] Failed to play %s on %s: %v", playlist, speakerEntity, err)
+			return err
+		}
+		logf(ctx, "[MA] Sent play_media: %s -> %s", playlist, speakerEntity)
+		return nil
+	case playTransportHAHTTP:
+		data := map[string]interface{}{
+			"entity_id":  speakerEntity,
+			"media_id":   playlist,
+			"media_type": "playlist",
+		}
+		if enqueue != "" {
+			data["enqueue"] = enqueue
+		}
+		if err := c.haFor(ctx, location).CallService(ctx, "mass", "play_media", data); err != nil {
+			logf(ctx, "[HA] Failed to call mass.play_media: %v", err)
+			return err
+		}
+		logf(ctx, "[HA] Called mass.play_media: %s -> %s", playlist, speakerEntity)
+		return nil
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return c.playMusicViaMQTT(ctx, speakerEntity, playlist, enqueue)
 	}
 }
 
-func (c *Coordinator) HandlePlaylistGroup(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, "GET", "PUT", "DELETE", "OPTIONS")
+func (c *Coordinator) playMusicViaMQTT(ctx context.Context, speakerEntity, playlist, enqueue string) error {
+	return c.publishPlayMedia(ctx, speakerEntity, playlist, "playlist", enqueue)
+}
 
-	if r.Method == http.MethodOptions {
-		handleOptions(w)
-		return
+// publishPlayMedia publishes a play_media command for mediaID to the HA MQTT topic
+func (c *Coordinator) publishPlayMedia(ctx context.Context, speakerEntity, mediaID, mediaType, enqueue string) error {
+	payload := map[string]interface{}{
+		"entity_id":  speakerEntity,
+		"media_id":   mediaID,
+		"media_type": mediaType,
+	}
+	if enqueue != "" {
+		payload["enqueue"] = enqueue
 	}
 
-	name := r.URL.Path[len("/api/playlist-groups/"):]
-	if name == "" {
-		http.Error(w, "Playlist group name required", http.StatusBadRequest)
-		return
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		playlists, err := c.db.GetGroupPlaylists(name)
-		if err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
-			return
-		}
-		json.NewEncoder(w).Encode(PlaylistGroup{Name: name, Playlists: playlists})
+	timeout := c.currentConfig().PlayTimeout
+	token := c.mqttClient.Publish(mqttHATopic, 0, false, jsonData)
+	if !token.WaitTimeout(timeout) {
+		logf(ctx, "[MQTT] Publish to %s timed out after %v", mqttHATopic, timeout)
+		return fmt.Errorf("MQTT publish timed out after %v", timeout)
+	}
+	if token.Error() != nil {
+		logf(ctx, "[MQTT] Failed to publish to %s: %v", mqttHATopic, token.Error())
+		return fmt.Errorf("failed to publish MQTT message: %w", token.Error())
+	}
+	logf(ctx, "[MQTT] Published play_media to %s: %s -> %s", mqttHATopic, mediaID, speakerEntity)
+	return nil
+}
 
-	case http.MethodPut:
-		var group PlaylistGroup
-		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
-			c.sendError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-			return
-		}
-		if len(group.Playlists) == 0 {
-			c.sendError(w, http.StatusBadRequest, "at least one playlist is required")
-			return
-		}
-		if err := c.db.UpdatePlaylistGroup(name, group.Playlists); err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
-			return
-		}
-		c.sendSuccess(w, fmt.Sprintf("Playlist group '%s' updated with %d playlist(s)", name, len(group.Playlists)))
+// MediaPlayer represents a Home Assistant media player entity
+type MediaPlayer struct {
+	EntityID   string `json:"entity_id"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	DeviceName string `json:"device_name,omitempty"`
+}
 
-	case http.MethodDelete:
-		if err := c.db.DeletePlaylistGroup(name); err != nil {
-			c.sendError(w, http.StatusNotFound, err.Error())
-			return
-		}
-		c.sendSuccess(w, fmt.Sprintf("Playlist group '%s' deleted", name))
+// HAEntityState is the subset of GET /api/states/{entity_id} the coordinator uses
+type HAEntityState struct {
+	EntityID   string                 `json:"entity_id"`
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// GetEntityState fetches the current state of a single entity
+func (c *HAClient) GetEntityState(ctx context.Context, entityID string) (*HAEntityState, error) {
+	if !c.Configured() {
+		return nil, ErrHANotConfigured
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/states/%s", c.baseURL, url.PathEscape(entityID)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.getToken()))
+
+	resp, err := c.doWithRetry(req, int(c.maxRetries.Load()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("entity '%s' not found in Home Assistant", entityID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("HA API returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var state HAEntityState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
+	return &state, nil
 }
 
-func (c *Coordinator) HandleAvailablePlaylists(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// CallService invokes a Home Assistant service such as media_player.media_pause
+func (c *HAClient) CallService(ctx context.Context, domain, service string, data map[string]interface{}) error {
+	if !c.Configured() {
+		return ErrHANotConfigured
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode service data: %w", err)
 	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/services/%s/%s", c.baseURL, domain, service), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.getToken()))
+	req.Header.Set("Content-Type", "application/json")
 
-	playlists, err := c.db.GetAllAvailablePlaylists()
+	resp, err := c.client.Do(req)
 	if err != nil {
-		c.sendError(w, http.StatusInternalServerError, err.Error())
-		return
+		return fmt.Errorf("failed to execute request: %w", err)
 	}
-	json.NewEncoder(w).Encode(playlists)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("HA API returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
 }
 
-func (c *Coordinator) sendSuccess(w http.ResponseWriter, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(IntentResponse{
-		Success: true,
-		Message: message,
+// JoinSpeakers groups followerEntities with masterEntity via media_player.join so
+// they play in sync
+func (c *HAClient) JoinSpeakers(ctx context.Context, masterEntity string, followerEntities []string) error {
+	return c.CallService(ctx, "media_player", "join", map[string]interface{}{
+		"entity_id":     masterEntity,
+		"group_members": followerEntities,
 	})
 }
 
-func (c *Coordinator) sendError(w http.ResponseWriter, statusCode int, errorMsg string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(IntentResponse{
-		Success: false,
-		Error:   errorMsg,
+// UnjoinSpeakers removes each speaker from whatever group it is in
+func (c *HAClient) UnjoinSpeakers(ctx context.Context, speakerEntities []string) error {
+	return c.CallService(ctx, "media_player", "unjoin", map[string]interface{}{
+		"entity_id": speakerEntities,
 	})
 }
 
-type HAClient struct {
-	baseURL string
-	token   string
-	client  *http.Client
-}
+// TriggerWebhook POSTs payload as JSON to the HA webhook with the given ID.
+// Webhooks are unauthenticated, so no token is sent.
+func (c *HAClient) TriggerWebhook(ctx context.Context, webhookID string, payload interface{}) error {
+	if !c.Configured() {
+		return ErrHANotConfigured
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/webhook/%s", c.baseURL, url.PathEscape(webhookID)), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-func NewHAClient(baseURL, token string) *HAClient {
-	return &HAClient{
-		baseURL: baseURL,
-		token:   token,
-		client: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("HA API returned status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
+	return nil
 }
 
-func (c *Coordinator) playMusicViaMQTT(speakerEntity, playlist string) error {
-	payload := map[string]interface{}{
-		"entity_id":  speakerEntity,
-		"media_id":   playlist,
-		"media_type": "playlist",
+// Ping checks that Home Assistant is reachable and accepts the token
+func (c *HAClient) Ping(ctx context.Context) error {
+	if !c.Configured() {
+		return ErrHANotConfigured
 	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/", c.baseURL), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.getToken()))
 
-	jsonData, err := json.Marshal(payload)
+	resp, err := c.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return fmt.Errorf("failed to execute request: %w", err)
 	}
+	defer resp.Body.Close()
 
-	token := c.mqttClient.Publish(mqttHATopic, 0, false, jsonData)
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to publish MQTT message: %w", token.Error())
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HA API returned status %d", resp.StatusCode)
 	}
 	return nil
 }
 
-// MediaPlayer represents a Home Assistant media player entity
-type MediaPlayer struct {
-	EntityID   string `json:"entity_id"`
-	Name       string `json:"name"`
-	State      string `json:"state"`
-	DeviceName string `json:"device_name,omitempty"`
+// GetMediaPlayers returns HA's media players, reusing the previous result while it
+// is younger than the cache TTL unless refresh is set
+func (c *HAClient) GetMediaPlayers(ctx context.Context, refresh bool) ([]MediaPlayer, error) {
+	if !c.Configured() {
+		return nil, ErrHANotConfigured
+	}
+	cache := &c.mediaPlayerCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if !refresh && cache.ttl > 0 && !cache.fetchedAt.IsZero() && time.Since(cache.fetchedAt) < cache.ttl {
+		return cache.players, nil
+	}
+
+	players, err := c.fetchMediaPlayers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache.players = players
+	cache.fetchedAt = time.Now()
+	return players, nil
 }
 
-func (c *HAClient) GetMediaPlayers() ([]MediaPlayer, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/states", c.baseURL), nil)
+func (c *HAClient) fetchMediaPlayers(ctx context.Context) ([]MediaPlayer, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/states", c.baseURL), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.getToken()))
 
-	resp, err := c.client.Do(req)
+	resp, err := c.doWithRetry(req, int(c.maxRetries.Load()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
@@ -1201,59 +7969,460 @@ func (c *HAClient) GetMediaPlayers() ([]MediaPlayer, error) {
 	return mediaPlayers, nil
 }
 
+// MAClient talks to the Music Assistant HTTP API
+type MAClient struct {
+	baseURL string
+	token   string
+	tokenMu sync.RWMutex
+	client  *http.Client
+
+	searchCache   maSearchCache
+	durationCache maDurationCache
+}
+
+// maSearchCache keeps SearchPlaylists results per query for maSearchCacheTTL so
+// search-as-you-type doesn't send MA a request per keystroke
+type maSearchCache struct {
+	mu      sync.Mutex
+	entries map[string]maSearchEntry
+}
+
+type maSearchEntry struct {
+	playlists []MAPlaylist
+	fetchedAt time.Time
+}
+
+// maDurationCache keeps GetPlaylistDuration results, failures included, per URI
+// for maDurationCacheTTL so plays don't wait on MA for a hint every time
+type maDurationCache struct {
+	mu      sync.Mutex
+	entries map[string]maDurationEntry
+}
+
+type maDurationEntry struct {
+	duration  time.Duration
+	err       error
+	fetchedAt time.Time
+}
+
+// MAPlaylist is a playlist in the Music Assistant library
+type MAPlaylist struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	URI         string `json:"uri"`
+	MediaType   string `json:"media_type"`
+	CoverArtURL string `json:"cover_art_url,omitempty"`
+}
+
+// NewMAClient returns a client whose requests each time out after timeout
+func NewMAClient(baseURL, token string, timeout time.Duration) *MAClient {
+	return &MAClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		searchCache:   maSearchCache{entries: make(map[string]maSearchEntry)},
+		durationCache: maDurationCache{entries: make(map[string]maDurationEntry)},
+	}
+}
+
+// ErrMADisabled is returned by every MAClient call when MA_API_URL is empty
+var ErrMADisabled = errors.New("Music Assistant integration disabled (MA_API_URL not configured)")
+
+// Enabled reports whether a Music Assistant URL is configured
+func (c *MAClient) Enabled() bool {
+	return c.baseURL != ""
+}
+
+// SetToken replaces the bearer token used for subsequent requests
+func (c *MAClient) SetToken(token string) {
+	c.tokenMu.Lock()
+	c.token = token
+	c.tokenMu.Unlock()
+}
+
+func (c *MAClient) getToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.token
+}
+
+// newRequest builds a request against the MA API, authenticated when a token is set
+func (c *MAClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	if !c.Enabled() {
+		return nil, ErrMADisabled
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if token := c.getToken(); token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	return req, nil
+}
+
+// Ping checks that Music Assistant is reachable and accepts the token
+func (c *MAClient) Ping(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", "/api/info", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("MA API returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// GetPlaylists returns every playlist in the MA library
+func (c *MAClient) GetPlaylists(ctx context.Context) ([]MAPlaylist, error) {
+	req, err := c.newRequest(ctx, "GET", "/api/playlists", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("MA API returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var playlists []MAPlaylist
+	if err := json.NewDecoder(resp.Body).Decode(&playlists); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return playlists, nil
+}
+
+// maPlaylistDetail is the part of MA's playlist detail response used for durations
+type maPlaylistDetail struct {
+	Duration float64 `json:"duration"` // seconds; 0 when MA hasn't totalled it
+	Tracks   []struct {
+		Duration float64 `json:"duration"`
+	} `json:"tracks"`
+}
+
+// GetPlaylistDuration returns the total length of the playlist with the given
+// URI, summing its tracks when MA doesn't report a total. Results are cached per URI.
+func (c *MAClient) GetPlaylistDuration(ctx context.Context, uri string) (time.Duration, error) {
+	cache := &c.durationCache
+	cache.mu.Lock()
+	if entry, ok := cache.entries[uri]; ok && time.Since(entry.fetchedAt) < maDurationCacheTTL {
+		cache.mu.Unlock()
+		return entry.duration, entry.err
+	}
+	cache.mu.Unlock()
+
+	duration, err := c.fetchPlaylistDuration(ctx, uri)
+	cache.mu.Lock()
+	cache.entries[uri] = maDurationEntry{duration: duration, err: err, fetchedAt: time.Now()}
+	cache.mu.Unlock()
+	return duration, err
+}
+
+func (c *MAClient) fetchPlaylistDuration(ctx context.Context, uri string) (time.Duration, error) {
+	req, err := c.newRequest(ctx, "GET", "/api/playlists/"+url.PathEscape(uri), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("MA API returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var detail maPlaylistDetail
+	if err := json.NewDecoder(resp.Body).Decode(&detail); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	seconds := detail.Duration
+	if seconds == 0 {
+		for _, track := range detail.Tracks {
+			seconds += track.Duration
+		}
+	}
+	if seconds <= 0 {
+		return 0, errors.New("MA reported no duration")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// PlayMedia replaces playerID's queue with uri and starts playback
+func (c *MAClient) PlayMedia(ctx context.Context, playerID, uri, mediaType string, shuffle bool, option string) error {
+	payload := map[string]interface{}{
+		"uri":        uri,
+		"media_type": mediaType,
+		"shuffle":    shuffle,
+	}
+	if option != "" {
+		payload["option"] = option
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	req, err := c.newRequest(ctx, "POST", fmt.Sprintf("/api/player_queue/%s/play_media", url.PathEscape(playerID)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("MA API returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// SearchPlaylists searches the MA library for playlists matching query. Results
+// are cached per query and limit; the result is never nil.
+func (c *MAClient) SearchPlaylists(ctx context.Context, query string, limit int) ([]MAPlaylist, error) {
+	key := fmt.Sprintf("%d:%s", limit, query)
+	cache := &c.searchCache
+	cache.mu.Lock()
+	if entry, ok := cache.entries[key]; ok && time.Since(entry.fetchedAt) < maSearchCacheTTL {
+		cache.mu.Unlock()
+		return entry.playlists, nil
+	}
+	cache.mu.Unlock()
+
+	params := url.Values{}
+	params.Set("search", query)
+	params.Set("media_type", "playlist")
+	params.Set("limit", strconv.Itoa(limit))
+	req, err := c.newRequest(ctx, "GET", "/api/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("MA API returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var playlists []MAPlaylist
+	if err := json.NewDecoder(resp.Body).Decode(&playlists); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if playlists == nil {
+		playlists = []MAPlaylist{}
+	}
+
+	cache.mu.Lock()
+	now := time.Now()
+	for k, entry := range cache.entries {
+		if now.Sub(entry.fetchedAt) >= maSearchCacheTTL {
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[key] = maSearchEntry{playlists: playlists, fetchedAt: now}
+	cache.mu.Unlock()
+	return playlists, nil
+}
+
 func main() {
-	config := &Config{
-		Port:         getEnv("PORT", defaultPort),
-		DBPath:       getEnv("DB_PATH", defaultDBPath),
-		HAURL:        getEnv("HA_URL", defaultHAURL),
-		HAToken:      getEnv("HA_API_TOKEN", defaultHAToken),
-		MAAPIURL:     getEnv("MA_API_URL", defaultMAAPIURL),
-		MQTTBroker:   getEnv("MQTT_BROKER", defaultMQTTBroker),
-		MQTTUser:     getEnv("MQTT_USER", defaultMQTTUser),
-		MQTTPass:     getEnv("MQTT_PASS", defaultMQTTPass),
-		MQTTClientID: getEnv("MQTT_CLIENT_ID", defaultMQTTClientID),
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if errs := config.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Invalid configuration: %v", err)
+		}
+		log.Fatalf("Refusing to start with %d configuration error(s)", len(errs))
+	}
+	if config.HAURL == "" {
+		log.Printf("[Config] Warning: HA_URL not configured, Home Assistant integration disabled")
+	} else if config.HAToken == "" {
+		log.Printf("[Config] Warning: HA_API_TOKEN is not set; Home Assistant calls will fail")
+	}
+	if config.MAAPIURL == "" {
+		log.Printf("[Config] Warning: MA_API_URL not configured, Music Assistant integration disabled")
 	}
 
 	db, err := NewDatabase(config.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer db.Close()
 
 	coordinator, err := NewCoordinator(db, config)
 	if err != nil {
+		db.Close()
 		log.Fatalf("Failed to initialize coordinator: %v", err)
 	}
-	defer coordinator.mqttClient.Disconnect(250)
-
-	http.HandleFunc("/api/play", coordinator.HandlePlayIntent)
-	http.HandleFunc("/play", coordinator.HandlePlayIntent)
-	http.HandleFunc("/api/intents", coordinator.HandleIntents)
-	http.HandleFunc("/api/intents/", coordinator.HandleIntent)
-	http.HandleFunc("/api/locations", coordinator.HandleLocations)
-	http.HandleFunc("/api/locations/", coordinator.HandleLocation)
-	http.HandleFunc("/api/playlist-groups", coordinator.HandlePlaylistGroups)
-	http.HandleFunc("/api/playlist-groups/", coordinator.HandlePlaylistGroup)
-	http.HandleFunc("/api/available-playlists", coordinator.HandleAvailablePlaylists)
-	http.HandleFunc("/api/media-players", coordinator.HandleMediaPlayers)
-	http.HandleFunc("/api/sync-locations", coordinator.HandleSyncLocations)
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
 
-	fs := http.FileServer(http.Dir("./ui"))
-	http.Handle("/", http.StripPrefix("/", fs))
+	handler := coordinator.Handler()
+	server := newHTTPServer(config, config.Port, handler)
+
+	// With TLS the API moves to HTTPS_PORT and PORT only redirects (plus health
+	// checks, so container probes keep working over plain HTTP)
+	var redirectServer *http.Server
+	if config.TLSEnabled() {
+		server.Addr = ":" + config.HTTPSPort
+		redirect := redirectToHTTPS(config.HTTPSPort, handler)
+		if config.AutocertDomain != "" {
+			manager := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(config.AutocertDomain),
+				Cache:      autocert.DirCache(config.AutocertCache),
+			}
+			server.TLSConfig = manager.TLSConfig()
+			// Answers ACME http-01 challenges, redirecting everything else
+			redirect = manager.HTTPHandler(redirect)
+		}
+		redirectServer = newHTTPServer(config, config.Port, redirect)
+	}
+
+	server.RegisterOnShutdown(coordinator.events.close)
+	server.RegisterOnShutdown(coordinator.hub.close)
+
+	go coordinator.playLimiter.runCleanup(coordinator.done)
+	go coordinator.watchMQTT(mqttWatchInterval, coordinator.done)
+	go coordinator.runCountRefresh(countRefreshInterval, coordinator.done)
+	go coordinator.runOrphanCleanup(orphanCleanupInterval, coordinator.done)
+
+	serverErr := make(chan error, 2)
+	go func() {
+		var err error
+		if config.TLSEnabled() {
+			log.Printf("Server %s (%s) starting with TLS on port %s", version, gitCommit, config.HTTPSPort)
+			// Empty paths make ListenAndServeTLS use server.TLSConfig (autocert)
+			err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		} else {
+			log.Printf("Server %s (%s) starting on port %s", version, gitCommit, config.Port)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+	if redirectServer != nil {
+		go func() {
+			log.Printf("Redirecting HTTP port %s to HTTPS port %s", config.Port, config.HTTPSPort)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				serverErr <- err
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+wait:
+	for {
+		select {
+		case <-reload:
+			log.Printf("[Config] Received SIGHUP, reloading configuration")
+			coordinator.reloadFromEnvironment()
+		case sig := <-stop:
+			log.Printf("[Shutdown] Received %v, shutting down", sig)
+			break wait
+		case err := <-serverErr:
+			log.Printf("Server failed: %v", err)
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	log.Printf("[Shutdown] Stopping HTTP server")
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			log.Printf("[Shutdown] HTTP redirect server shutdown error: %v", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[Shutdown] HTTP server shutdown error: %v", err)
+	}
+
+	log.Printf("[Shutdown] Stopping coordinator")
+	if err := coordinator.Shutdown(ctx); err != nil {
+		log.Printf("[Shutdown] Coordinator shutdown error: %v", err)
+	}
+
+	log.Printf("[Shutdown] Done")
+}
 
-	log.Printf("Server starting on port %s", config.Port)
-	if err := http.ListenAndServe(":"+config.Port, nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+func newHTTPServer(config *Config, port string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + port,
+		Handler:           handler,
+		ReadTimeout:       config.HTTPReadTimeout,
+		WriteTimeout:      config.HTTPWriteTimeout,
+		IdleTimeout:       config.HTTPIdleTimeout,
+		ReadHeaderTimeout: config.HTTPReadHeaderTimeout,
 	}
 }
 
+// redirectToHTTPS sends plain-HTTP clients to the same URL on httpsPort. Health
+// checks are served directly by next instead.
+func redirectToHTTPS(httpsPort string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/health/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := url.URL{
+			Scheme:   "https",
+			Host:     net.JoinHostPort(host, httpsPort),
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+		if httpsPort == "443" {
+			target.Host = host
+		}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func orDefault(value, defaultValue string) string {
+	if value != "" {
+		return value
+	}
+	return defaultValue
+}
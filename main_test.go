@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestCoordinator returns a Coordinator backed by a fresh in-memory database
+// and no MQTT connection, for exercising the HTTP handlers
+func newTestCoordinator(t *testing.T) *Coordinator {
+	t.Helper()
+
+	db, err := NewDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	config := &Config{RateLimitRPS: defaultRateLimitRPS, RateLimitBurst: defaultRateLimitBurst, PlayTimeout: defaultPlayTimeout}
+	c := &Coordinator{
+		db:          db,
+		audit:       NewAuditLogger(db),
+		config:      config,
+		haClient:    NewHAClient("http://127.0.0.1:0", "", defaultPlayTimeout, 0, 0),
+		maClient:    NewMAClient("http://127.0.0.1:0", "", defaultPlayTimeout),
+		playLimiter: newIPRateLimiter(config.RateLimitRPS, config.RateLimitBurst),
+		etags:       newETagCache(),
+		events:      &eventBus{},
+		hub:         newWebsocketHub(),
+		playQueue:   make(map[string][]QueueEntry),
+		chainRuns:   make(map[string]*chainRun),
+		done:        make(chan struct{}),
+	}
+	go c.hub.run()
+	t.Cleanup(c.hub.close)
+	return c
+}
+
+func serve(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestNamedRoutesWithSpecialCharacters(t *testing.T) {
+	names := []struct {
+		name    string
+		escaped string
+	}{
+		{"Jazz & Blues", "Jazz%20%26%20Blues"},
+		{"AC/DC", "AC%2FDC"},
+		{"café", "caf%C3%A9"},
+		{"50% off", "50%25%20off"},
+	}
+
+	for _, tt := range names {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCoordinator(t)
+			h := c.Handler()
+
+			body, _ := json.Marshal(Intent{Name: tt.name, Playlists: []string{"spotify:playlist:abc"}})
+			if w := serve(t, h, http.MethodPost, "/api/v1/intents", string(body)); w.Code != http.StatusOK {
+				t.Fatalf("create intent: status %d: %s", w.Code, w.Body.String())
+			}
+			body, _ = json.Marshal(Location{Name: tt.name, SpeakerEntity: "media_player.kitchen"})
+			if w := serve(t, h, http.MethodPost, "/api/v1/locations", string(body)); w.Code != http.StatusOK {
+				t.Fatalf("create location: status %d: %s", w.Code, w.Body.String())
+			}
+
+			for _, prefix := range []string{"/api/v1", "/api"} {
+				w := serve(t, h, http.MethodGet, prefix+"/intents/"+tt.escaped, "")
+				if w.Code != http.StatusOK {
+					t.Fatalf("GET %s/intents/%s: status %d: %s", prefix, tt.escaped, w.Code, w.Body.String())
+				}
+				var intent Intent
+				if err := json.NewDecoder(w.Body).Decode(&intent); err != nil {
+					t.Fatalf("decode intent: %v", err)
+				}
+				if intent.Name != tt.name {
+					t.Errorf("GET %s/intents/%s: name = %q, want %q", prefix, tt.escaped, intent.Name, tt.name)
+				}
+
+				w = serve(t, h, http.MethodGet, prefix+"/locations/"+tt.escaped, "")
+				if w.Code != http.StatusOK {
+					t.Fatalf("GET %s/locations/%s: status %d: %s", prefix, tt.escaped, w.Code, w.Body.String())
+				}
+			}
+
+			for _, target := range []string{"/api/v1/intents/" + tt.escaped + "/history", "/api/v1/locations/" + tt.escaped + "/history"} {
+				if w := serve(t, h, http.MethodGet, target, ""); w.Code != http.StatusOK {
+					t.Errorf("GET %s: status %d: %s", target, w.Code, w.Body.String())
+				}
+			}
+
+			if w := serve(t, h, http.MethodDelete, "/api/v1/intents/"+tt.escaped, ""); w.Code != http.StatusOK {
+				t.Fatalf("delete intent: status %d: %s", w.Code, w.Body.String())
+			}
+			if w := serve(t, h, http.MethodGet, "/api/v1/intents/"+tt.escaped, ""); w.Code != http.StatusNotFound {
+				t.Errorf("GET after delete: status %d, want %d", w.Code, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestRouting(t *testing.T) {
+	c := newTestCoordinator(t)
+	h := c.Handler()
+
+	tests := []struct {
+		method string
+		target string
+		want   int
+	}{
+		{http.MethodGet, "/api/v1/intents", http.StatusOK},
+		{http.MethodGet, "/api/v1/intents/missing", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/intents/missing/history", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/intents/a/b/c", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/locations/missing/history", http.StatusNotFound},
+		{http.MethodPost, "/api/v1/locations/missing/pause", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/locations/missing/pause", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/v1/locations/missing/queue", http.StatusNotFound},
+		{http.MethodOptions, "/api/v1/intents/anything", http.StatusOK},
+		{http.MethodOptions, "/api/v1/locations/anything/volume", http.StatusOK},
+		{http.MethodPatch, "/api/v1/intents/anything", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/locations/kitchen", http.StatusOK},
+		{http.MethodGet, "/missing.js", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/unknown", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/intents/", http.StatusOK},
+		{http.MethodGet, "/api/intents/", http.StatusOK},
+		{http.MethodGet, "/api/v1/intents/missing/", http.StatusNotFound},
+		{http.MethodPost, "/api/v1/locations/missing/pause/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serve(t, h, tt.method, tt.target, ""); w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d (%s)", tt.method, tt.target, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+func TestParsePlaylists(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"empty", "", []string{}},
+		{"single", "spotify:playlist:abc", []string{"spotify:playlist:abc"}},
+		{"json array", `["spotify:playlist:abc","spotify:playlist:def"]`, []string{"spotify:playlist:abc", "spotify:playlist:def"}},
+		{"comma separated", "spotify:playlist:abc, spotify:playlist:def", []string{"spotify:playlist:abc", "spotify:playlist:def"}},
+		{"newline separated", "spotify:playlist:abc\nspotify:playlist:def", []string{"spotify:playlist:abc", "spotify:playlist:def"}},
+		{"windows line endings", "spotify:playlist:abc\r\nspotify:playlist:def\r\n", []string{"spotify:playlist:abc", "spotify:playlist:def"}},
+		{"blank lines and whitespace", "\n  spotify:playlist:abc  \n\n\t\nspotify:playlist:def\n", []string{"spotify:playlist:abc", "spotify:playlist:def"}},
+		{"commas and newlines mixed", "spotify:playlist:abc,\nspotify:playlist:def\nspotify:playlist:ghi", []string{"spotify:playlist:abc", "spotify:playlist:def", "spotify:playlist:ghi"}},
+		{"duplicates collapse", "spotify:playlist:abc\nSpotify:Playlist:abc", []string{"spotify:playlist:abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parsePlaylists(tt.data)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parsePlaylists(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeIntentRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want IntentRequest
+	}{
+		{"single location", `{"intent":"morning","location":"kitchen","queue_mode":"next","triggered_by":"alarm"}`,
+			IntentRequest{Intent: "morning", Location: "kitchen", QueueMode: "next", TriggeredBy: "alarm"}},
+		{"location array", `{"intent":"morning","location":["kitchen","office"],"locations":["garage"]}`,
+			IntentRequest{Intent: "morning", Locations: []string{"kitchen", "office", "garage"}}},
+		{"override without location", `{"playlist_override":"spotify:playlist:abc","location":null}`,
+			IntentRequest{PlaylistOverride: "spotify:playlist:abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Decoding over a used request must not keep its old fields
+			got := IntentRequest{Intent: "stale", Location: "stale"}
+			if err := json.Unmarshal([]byte(tt.data), &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if got.Intent != tt.want.Intent || got.Location != tt.want.Location || !slices.Equal(got.Locations, tt.want.Locations) ||
+				got.TriggeredBy != tt.want.TriggeredBy || got.QueueMode != tt.want.QueueMode || got.PlaylistOverride != tt.want.PlaylistOverride {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	var req IntentRequest
+	if err := json.Unmarshal([]byte(`{"location":7}`), &req); err == nil {
+		t.Error("decoded a numeric location")
+	}
+}
+
+// listen starts a TCP listener on a free local port and hands every
+// connection to handle until the test ends
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestConnectMQTTFallsBackWhenPrimaryUnreachable(t *testing.T) {
+	// The primary accepts TCP but never answers CONNECT, so only the
+	// failover timeout gets us off it
+	primary := listen(t, func(conn net.Conn) {
+		t.Cleanup(func() { conn.Close() })
+	})
+	// The fallback accepts any CONNECT and then keeps the session open
+	fallback := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00}) // CONNACK, accepted
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	})
+
+	config := &Config{MQTTClientID: "music-coordinator-test"}
+	client, broker, err := connectMQTT(config, []string{primary, fallback}, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("connectMQTT: %v", err)
+	}
+	defer client.Disconnect(0)
+
+	if broker != fallback {
+		t.Errorf("connected to %s, want fallback %s", broker, fallback)
+	}
+	if !client.IsConnected() {
+		t.Error("client is not connected")
+	}
+}
+
+func TestConnectMQTTOverWebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		conn.WriteMessage(websocket.BinaryMessage, []byte{0x20, 0x02, 0x00, 0x00}) // CONNACK, accepted
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	broker := "ws" + strings.TrimPrefix(server.URL, "http") + "/mqtt"
+	if err := validateBrokerAddress(broker); err != nil {
+		t.Fatalf("validateBrokerAddress(%q): %v", broker, err)
+	}
+	config := &Config{MQTTClientID: "music-coordinator-test"}
+	client, _, err := connectMQTT(config, []string{broker}, time.Second)
+	if err != nil {
+		t.Fatalf("connectMQTT: %v", err)
+	}
+	defer client.Disconnect(0)
+	if !client.IsConnected() {
+		t.Error("client is not connected")
+	}
+}
+
+func TestValidateBrokerAddress(t *testing.T) {
+	tests := []struct {
+		broker string
+		valid  bool
+	}{
+		{"tcp://localhost:1883", true},
+		{"localhost:1883", true},
+		{"tcp://localhost", false},
+		{"ws://broker.example.com/mqtt", true},
+		{"wss://broker.example.com:8884/mqtt", true},
+		{"wss://:8884/mqtt", false},
+	}
+	for _, tt := range tests {
+		if err := validateBrokerAddress(tt.broker); (err == nil) != tt.valid {
+			t.Errorf("validateBrokerAddress(%q) = %v, want valid %v", tt.broker, err, tt.valid)
+		}
+	}
+}
+
+// newBenchDatabase returns a database with one intent and one location, the
+// rows every play looks up
+func newBenchDatabase(b *testing.B) *Database {
+	b.Helper()
+	db, err := NewDatabase(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("NewDatabase: %v", err)
+	}
+	b.Cleanup(func() { db.Close() })
+	if err := db.CreateIntent("morning", []string{"spotify:playlist:abc", "spotify:playlist:def"}, "", IntentSettings{}); err != nil {
+		b.Fatalf("CreateIntent: %v", err)
+	}
+	if err := db.CreateLocation("kitchen", "media_player.kitchen", "", ""); err != nil {
+		b.Fatalf("CreateLocation: %v", err)
+	}
+	return db
+}
+
+// benchStmtCache runs lookup with the statement cache warm and, to compare, with
+// it emptied before every call so each lookup prepares its statement again
+func benchStmtCache(b *testing.B, db *Database, lookup func() error) {
+	for _, bb := range []struct {
+		name  string
+		reset bool
+	}{
+		{"cached", false},
+		{"uncached", true},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if bb.reset {
+					db.resetStmts()
+				}
+				if err := lookup(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetIntentPlaylist(b *testing.B) {
+	db := newBenchDatabase(b)
+	benchStmtCache(b, db, func() error {
+		_, err := db.GetIntentPlaylist("morning")
+		return err
+	})
+}
+
+func BenchmarkGetLocationSpeaker(b *testing.B) {
+	db := newBenchDatabase(b)
+	benchStmtCache(b, db, func() error {
+		_, err := db.GetLocationSpeaker("kitchen")
+		return err
+	})
+}
+
+func TestUpdatePlaylistGroupWritesOnlyTheDifference(t *testing.T) {
+	c := newTestCoordinator(t)
+	db := c.db
+	coverArt := map[string]string{"spotify:playlist:b": "https://example.com/b.jpg"}
+	if err := db.CreatePlaylistGroup("focus", []string{"spotify:playlist:a", "spotify:playlist:b"}, coverArt, nil); err != nil {
+		t.Fatalf("CreatePlaylistGroup: %v", err)
+	}
+	type item struct {
+		id        int
+		createdAt string
+	}
+	items := func() map[string]item {
+		t.Helper()
+		rows, err := db.db.Query("SELECT id, playlist, created_at FROM playlist_group_item WHERE group_name = 'focus'")
+		if err != nil {
+			t.Fatalf("query items: %v", err)
+		}
+		defer rows.Close()
+		result := make(map[string]item)
+		for rows.Next() {
+			var playlist string
+			var it item
+			if err := rows.Scan(&it.id, &playlist, &it.createdAt); err != nil {
+				t.Fatalf("scan item: %v", err)
+			}
+			result[playlist] = it
+		}
+		return result
+	}
+	before := items()
+
+	// Log every write to the items the update makes
+	for _, stmt := range []string{
+		"CREATE TABLE item_write (op TEXT, playlist TEXT)",
+		"CREATE TRIGGER item_insert AFTER INSERT ON playlist_group_item BEGIN INSERT INTO item_write VALUES ('insert', NEW.playlist); END",
+		"CREATE TRIGGER item_update AFTER UPDATE ON playlist_group_item BEGIN INSERT INTO item_write VALUES ('update', NEW.playlist); END",
+		"CREATE TRIGGER item_delete AFTER DELETE ON playlist_group_item BEGIN INSERT INTO item_write VALUES ('delete', OLD.playlist); END",
+	} {
+		if _, err := db.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	if err := db.UpdatePlaylistGroup("focus", []string{"spotify:playlist:b", "spotify:playlist:c"}, coverArt, nil); err != nil {
+		t.Fatalf("UpdatePlaylistGroup: %v", err)
+	}
+
+	after := items()
+	if after["spotify:playlist:b"] != before["spotify:playlist:b"] {
+		t.Errorf("kept item = %+v, want its row unchanged from %+v", after["spotify:playlist:b"], before["spotify:playlist:b"])
+	}
+	if _, ok := after["spotify:playlist:a"]; ok || len(after) != 2 {
+		t.Errorf("items = %v, want b and c", after)
+	}
+	if _, art, err := db.GetGroupItems("focus"); err != nil || art["spotify:playlist:b"] != coverArt["spotify:playlist:b"] {
+		t.Errorf("cover art = %v, %v; want b's kept", art, err)
+	}
+
+	var writes []string
+	rows, err := db.db.Query("SELECT op || ' ' || playlist FROM item_write ORDER BY rowid")
+	if err != nil {
+		t.Fatalf("query writes: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var write string
+		rows.Scan(&write)
+		writes = append(writes, write)
+	}
+	want := []string{"delete spotify:playlist:a", "insert spotify:playlist:c"}
+	if !slices.Equal(writes, want) {
+		t.Errorf("writes = %v, want %v", writes, want)
+	}
+}
+
+func TestRenamePlaylistGroupKeepsIntentsPlaying(t *testing.T) {
+	c := newTestCoordinator(t)
+	h := c.Handler()
+
+	if err := c.db.CreatePlaylistGroup("focus", []string{"spotify:playlist:abc"}, nil, nil); err != nil {
+		t.Fatalf("CreatePlaylistGroup: %v", err)
+	}
+	if err := c.db.CreateIntent("work", nil, "focus", IntentSettings{}); err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+
+	client := &wsClient{send: make(chan []byte, 16)}
+	c.hub.register <- client
+
+	if w := serve(t, h, http.MethodPost, "/api/v1/playlist-groups/focus/rename", `{"name":"deep work"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename: status %d: %s", w.Code, w.Body.String())
+	}
+	select {
+	case msg := <-client.send:
+		var event ChangeEvent
+		if err := json.Unmarshal(msg, &event); err != nil {
+			t.Fatalf("decode change event %s: %v", msg, err)
+		}
+		if event != (ChangeEvent{Type: "playlist_group_renamed", Name: "deep work", OldName: "focus"}) {
+			t.Errorf("change event = %+v, want one playlist_group_renamed from focus", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change event after the rename")
+	}
+	select {
+	case msg := <-client.send:
+		t.Errorf("unexpected second change event %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	playlist, err := c.db.GetIntentPlaylist("work")
+	if err != nil {
+		t.Fatalf("GetIntentPlaylist after rename: %v", err)
+	}
+	if playlist != "spotify:playlist:abc" {
+		t.Errorf("GetIntentPlaylist = %q, want %q", playlist, "spotify:playlist:abc")
+	}
+	if playlists, _, err := c.db.GetGroupItems("deep work"); err != nil || len(playlists) != 1 {
+		t.Errorf("GetGroupItems(renamed) = %q, %v; want the group's playlist", playlists, err)
+	}
+	if w := serve(t, h, http.MethodPost, "/api/v1/playlist-groups/missing/rename", `{"name":"other"}`); w.Code != http.StatusNotFound {
+		t.Errorf("rename missing: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func BenchmarkGetAllIntents(b *testing.B) {
+	db, err := NewDatabase(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("NewDatabase: %v", err)
+	}
+	b.Cleanup(func() { db.Close() })
+	if err := db.CreatePlaylistGroup("focus", []string{"spotify:playlist:abc", "spotify:playlist:def"}, nil, nil); err != nil {
+		b.Fatalf("CreatePlaylistGroup: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.CreateIntent(fmt.Sprintf("intent-%d", i), nil, "focus", IntentSettings{}); err != nil {
+			b.Fatalf("CreateIntent: %v", err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		intents, err := db.GetAllIntents()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(intents) != 100 || len(intents[0].Playlists) != 2 {
+			b.Fatalf("got %d intents", len(intents))
+		}
+	}
+}
+
+// listPlaylistGroupsPerGroup is how ListPlaylistGroups used to load groups, one
+// items query per group, kept to compare against the join
+func listPlaylistGroupsPerGroup(db *Database) ([]PlaylistGroup, error) {
+	rows, err := db.db.Query("SELECT id, name FROM playlist_group ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []PlaylistGroup
+	for rows.Next() {
+		var group PlaylistGroup
+		if err := rows.Scan(&group.ID, &group.Name); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	for i := range groups {
+		groups[i].Playlists, groups[i].CoverArt, _ = db.GetGroupItems(groups[i].Name)
+	}
+	return groups, nil
+}
+
+func BenchmarkGetAllPlaylistGroups(b *testing.B) {
+	db, err := NewDatabase(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("NewDatabase: %v", err)
+	}
+	b.Cleanup(func() { db.Close() })
+	for g := 0; g < 50; g++ {
+		playlists := make([]string, 20)
+		for p := range playlists {
+			playlists[p] = fmt.Sprintf("spotify:playlist:%d-%d", g, p)
+		}
+		if err := db.CreatePlaylistGroup(fmt.Sprintf("group-%d", g), playlists, nil, nil); err != nil {
+			b.Fatalf("CreatePlaylistGroup: %v", err)
+		}
+	}
+
+	for _, bb := range []struct {
+		name string
+		list func() ([]PlaylistGroup, error)
+	}{
+		{"join", db.GetAllPlaylistGroups},
+		{"per-group", func() ([]PlaylistGroup, error) { return listPlaylistGroupsPerGroup(db) }},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				groups, err := bb.list()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(groups) != 50 || len(groups[0].Playlists) != 20 {
+					b.Fatalf("got %d groups", len(groups))
+				}
+			}
+		})
+	}
+}
+
+func TestMusicAssistantDisabledWithoutURL(t *testing.T) {
+	c := newTestCoordinator(t)
+	c.maClient = NewMAClient("", "", defaultPlayTimeout)
+	h := c.Handler()
+
+	if w := serve(t, h, http.MethodGet, "/api/v1/ma/playlists", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /api/v1/ma/playlists = %d, want 503", w.Code)
+	}
+
+	var health HealthResponse
+	if err := json.Unmarshal(serve(t, h, http.MethodGet, "/health/ready", "").Body.Bytes(), &health); err != nil {
+		t.Fatalf("decode readiness: %v", err)
+	}
+	if _, ok := health.Components["music_assistant"]; ok {
+		t.Error("readiness checks Music Assistant although it is disabled")
+	}
+
+	config := Config{MAAPIURL: "", PlayTransport: playTransportMAHTTP}
+	found := false
+	for _, err := range config.Validate() {
+		if strings.Contains(err.Error(), "MA_API_URL") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Validate accepted PLAY_TRANSPORT=ma_http without MA_API_URL")
+	}
+}
+
+func TestHomeAssistantNotConfigured(t *testing.T) {
+	c := newTestCoordinator(t)
+	c.haClient = NewHAClient("", "", defaultPlayTimeout, 0, 0)
+	h := c.Handler()
+
+	w := serve(t, h, http.MethodGet, "/api/v1/media-players", "")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "HA_URL") {
+		t.Errorf("GET /api/v1/media-players = %d %s, want 503 naming HA_URL", w.Code, w.Body)
+	}
+
+	config := Config{PlayTransport: playTransportMQTT, CheckSpeakerAvailability: true}
+	found := false
+	for _, err := range config.Validate() {
+		if strings.Contains(err.Error(), "HA_URL") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Validate accepted CHECK_SPEAKER_AVAILABILITY without HA_URL")
+	}
+}